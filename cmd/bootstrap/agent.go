@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"linuxvm/pkg/agent"
+	"linuxvm/pkg/define"
+	"linuxvm/pkg/system"
+	"linuxvm/pkg/vmconfig"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mdlayher/vsock"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// serveAgent serves the guest agent on the agent vsock port until ctx is
+// done, shutdown is called on a shutdown request like for the control socket.
+// The listener is up when serveAgent returns.
+func serveAgent(ctx context.Context, shutdown func()) {
+	l, err := vsock.Listen(define.AgentVsockPort, nil)
+	if err != nil {
+		logrus.Warnf("failed to listen on agent vsock port %d: %v", define.AgentVsockPort, err)
+		return
+	}
+
+	closeOnDone(ctx, l)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handleAgent(conn, shutdown)
+		}
+	}()
+}
+
+// handleAgent answers the request of conn, see package agent
+func handleAgent(conn net.Conn, shutdown func()) {
+	defer conn.Close() //nolint:errcheck
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		logrus.Warnf("failed to read agent request: %v", err)
+		return
+	}
+
+	var req agent.Request
+	if err = json.Unmarshal(line, &req); err != nil {
+		respond(conn, agent.Response{Error: fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+	if req.Version != agent.Version {
+		respond(conn, agent.Response{Error: fmt.Sprintf("unsupported protocol version %d, the agent speaks %d", req.Version, agent.Version)})
+		return
+	}
+
+	switch req.Method {
+	case agent.MethodInfo:
+		info, err := guestInfo()
+		respond(conn, agent.Response{Info: info, Error: errorString(err)})
+	case agent.MethodProcesses:
+		procs, err := guestProcesses()
+		respond(conn, agent.Response{Processes: procs, Error: errorString(err)})
+	case agent.MethodShutdown:
+		respond(conn, agent.Response{})
+		logrus.Infof("shutdown requested by the agent client")
+		shutdown()
+	case agent.MethodExec:
+		if req.Exec == nil || len(req.Exec.Args) == 0 {
+			respond(conn, agent.Response{Error: "no cmdline to exec"})
+			return
+		}
+		agentExec(conn, r, req.Exec)
+	case agent.MethodRead:
+		if req.File == nil || !filepath.IsAbs(req.File.Path) {
+			respond(conn, agent.Response{Error: "an absolute file path is required"})
+			return
+		}
+		agentRead(conn, req.File)
+	case agent.MethodWrite:
+		if req.File == nil || !filepath.IsAbs(req.File.Path) {
+			respond(conn, agent.Response{Error: "an absolute file path is required"})
+			return
+		}
+		agentWrite(conn, r, req.File)
+	default:
+		respond(conn, agent.Response{Error: fmt.Sprintf("unknown method %q", req.Method)})
+	}
+}
+
+func respond(conn net.Conn, resp agent.Response) {
+	resp.Version = agent.Version
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		logrus.Warnf("failed to send agent response: %v", err)
+	}
+}
+
+// sendStatus sends the status frame ending exec, read and write
+func sendStatus(mux *agent.Mux, status agent.Status) {
+	b, _ := json.Marshal(status)
+	_ = mux.WriteFrame(agent.StreamStatus, b)
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// agentExec runs req in its own process group with the stdio streams of conn.
+// The process group is killed if the client goes away before it exits.
+func agentExec(conn net.Conn, r io.Reader, req *agent.ExecRequest) {
+	cmd := exec.Command(req.Args[0], req.Args[1:]...)
+	cmd.Dir = req.Dir
+	if cmd.Dir == "" {
+		cmd.Dir = "/"
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	// a daemon started by the process keeps stdout open, it is not waited for
+	cmd.WaitDelay = time.Second
+
+	env := os.Environ()
+	if req.User != "" || req.Group != "" {
+		cred, err := system.LookupCredential("/etc/passwd", "/etc/group", req.User, req.Group)
+		if err != nil {
+			respond(conn, agent.Response{Error: err.Error()})
+			return
+		}
+		cmd.SysProcAttr.Credential = &syscall.Credential{
+			Uid:    cred.UID,
+			Gid:    cred.GID,
+			Groups: cred.Groups,
+		}
+		env = vmconfig.MergeEnvs(env, []string{"HOME=" + cred.Home, "USER=" + cred.Name, "LOGNAME=" + cred.Name})
+	}
+	cmd.Env = vmconfig.MergeEnvs(env, req.Env)
+
+	// e.g. the executable is not found in PATH
+	if cmd.Err != nil {
+		respond(conn, agent.Response{Error: cmd.Err.Error()})
+		return
+	}
+
+	mux := agent.NewMux(conn)
+	cmd.Stdout = mux.Stream(agent.StreamStdout)
+	cmd.Stderr = mux.Stream(agent.StreamStderr)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		respond(conn, agent.Response{Error: err.Error()})
+		return
+	}
+
+	// the output is copied to conn as soon as the process starts, so the
+	// response goes first and a failing start ends the exec with its status
+	respond(conn, agent.Response{})
+	if err = reaper.Start(cmd, cmd.Start); err != nil {
+		_ = stdin.Close()
+		sendStatus(mux, agent.Status{Code: define.ExitCodeCannotExec, Error: err.Error()})
+		return
+	}
+
+	// the client sends nothing once stdin is closed, the conn is only read
+	// further to find out when the client goes away
+	exited := make(chan struct{})
+	go func() {
+		_, err := copyStdin(stdin, r)
+		_ = stdin.Close()
+		if err == nil {
+			_, _, err = agent.ReadFrame(r)
+		}
+		if err == nil {
+			err = errors.New("unexpected frame after stdin is closed")
+		}
+		select {
+		case <-exited:
+		default:
+			logrus.Warnf("agent client of %q gone, kill it: %v", req.Args, err)
+			_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+	}()
+
+	_ = reaper.Wait(cmd)
+	close(exited)
+
+	code := cmd.ProcessState.ExitCode()
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		code = define.ExitCodeSignalBase + int(status.Signal())
+	}
+	sendStatus(mux, agent.Status{Code: code})
+}
+
+// copyStdin writes the stdin frames of r to w until the empty frame closing
+// stdin. werr is the first error writing w, the rest of stdin is read and
+// dropped then, e.g. the process does not read it. err is the error reading
+// r, the client is gone.
+func copyStdin(w io.Writer, r io.Reader) (werr, err error) {
+	for {
+		stream, p, rerr := agent.ReadFrame(r)
+		if rerr != nil {
+			return werr, rerr
+		}
+		if stream != agent.StreamStdin {
+			return werr, fmt.Errorf("unexpected stream %d", stream)
+		}
+		if len(p) == 0 {
+			return werr, nil
+		}
+		if werr == nil {
+			_, werr = w.Write(p)
+		}
+	}
+}
+
+// agentRead sends the file in stdout frames
+func agentRead(conn net.Conn, req *agent.FileRequest) {
+	f, err := os.Open(req.Path)
+	if err != nil {
+		respond(conn, agent.Response{Error: err.Error()})
+		return
+	}
+	defer f.Close() //nolint:errcheck
+	respond(conn, agent.Response{})
+
+	mux := agent.NewMux(conn)
+	_, err = io.Copy(mux.Stream(agent.StreamStdout), f)
+	sendStatus(mux, agent.Status{Error: errorString(err)})
+}
+
+// agentWrite writes the stdin frames to a temporary file next to the file and
+// renames it over the file once stdin is closed, the file is never seen half
+// written
+func agentWrite(conn net.Conn, r io.Reader, req *agent.FileRequest) {
+	mode := os.FileMode(req.Mode).Perm()
+	if mode == 0 {
+		mode = 0o644
+	}
+
+	dir, name := filepath.Split(req.Path)
+	f, err := os.CreateTemp(dir, "."+name+".revm-*")
+	if err != nil {
+		respond(conn, agent.Response{Error: err.Error()})
+		return
+	}
+	defer os.Remove(f.Name()) //nolint:errcheck
+	respond(conn, agent.Response{})
+
+	werr, err := copyStdin(f, r)
+	if err != nil {
+		_ = f.Close()
+		logrus.Warnf("failed to receive %q: %v", req.Path, err)
+		return
+	}
+	err = errors.Join(werr, f.Chmod(mode), f.Sync(), f.Close())
+	if err == nil {
+		err = os.Rename(f.Name(), req.Path)
+	}
+	sendStatus(agent.NewMux(conn), agent.Status{Error: errorString(err)})
+}
+
+func guestInfo() (*agent.Info, error) {
+	info := &agent.Info{Version: agent.Version}
+
+	var err error
+	if info.Hostname, err = os.Hostname(); err != nil {
+		return nil, err
+	}
+
+	var uts unix.Utsname
+	if err = unix.Uname(&uts); err != nil {
+		return nil, err
+	}
+	info.Kernel = unix.ByteSliceToString(uts.Release[:])
+
+	b, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return nil, err
+	}
+	uptime, _, _ := strings.Cut(string(b), " ")
+	if info.Uptime, err = strconv.ParseFloat(uptime, 64); err != nil {
+		return nil, fmt.Errorf("invalid /proc/uptime: %w", err)
+	}
+	return info, nil
+}
+
+func guestProcesses() ([]agent.Process, error) {
+	stats, err := system.ListProcesses()
+	if err != nil {
+		return nil, err
+	}
+	procs := make([]agent.Process, 0, len(stats))
+	for _, st := range stats {
+		procs = append(procs, agent.Process{
+			PID:     st.PID,
+			PPID:    st.PPID,
+			UID:     st.UID,
+			State:   st.State,
+			Name:    st.Name,
+			Cmdline: st.Cmdline,
+		})
+	}
+	return procs, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"linuxvm/pkg/agent"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveTestAgent serves the agent on a unix socket and returns its client
+func serveTestAgent(t *testing.T) *agent.Client {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handleAgent(conn, func() {})
+		}
+	}()
+	return agent.NewClient(socket)
+}
+
+// TestAgentExec runs short lived processes in a loop, the output they write
+// right away must not overtake the response of the exec
+func TestAgentExec(t *testing.T) {
+	client := serveTestAgent(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	tests := []struct {
+		args   []string
+		stdin  string
+		code   int
+		stdout string
+		stderr string
+	}{
+		{args: []string{"true"}},
+		{args: []string{"false"}, code: 1},
+		{args: []string{"echo", "hello"}, stdout: "hello\n"},
+		{args: []string{"sh", "-c", "echo out; echo err >&2; exit 3"}, code: 3, stdout: "out\n", stderr: "err\n"},
+		{args: []string{"cat"}, stdin: "from stdin", stdout: "from stdin"},
+	}
+
+	for i := 0; i < 200; i++ {
+		for _, tt := range tests {
+			var stdout, stderr bytes.Buffer
+			code, err := client.Exec(ctx, agent.ExecRequest{Args: tt.args}, strings.NewReader(tt.stdin), &stdout, &stderr)
+			if err != nil {
+				t.Fatalf("Exec(%q) error = %v", tt.args, err)
+			}
+			if code != tt.code || stdout.String() != tt.stdout || stderr.String() != tt.stderr {
+				t.Fatalf("Exec(%q) = %d, stdout %q, stderr %q, want %d, %q, %q", tt.args, code, stdout.String(), stderr.String(), tt.code, tt.stdout, tt.stderr)
+			}
+		}
+	}
+}
+
+func TestAgentExecFailure(t *testing.T) {
+	client := serveTestAgent(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if _, err := client.Exec(ctx, agent.ExecRequest{Args: []string{"no-such-command-revm"}}, nil, nil, nil); err == nil {
+		t.Error("Exec of a missing command succeeded")
+	}
+	if _, err := client.Exec(ctx, agent.ExecRequest{Args: []string{"true"}, Dir: "/no/such/dir"}, nil, nil, nil); err == nil {
+		t.Error("Exec in a missing dir succeeded")
+	}
+}
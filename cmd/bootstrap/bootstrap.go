@@ -2,58 +2,432 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"linuxvm/pkg/define"
 	"linuxvm/pkg/filesystem"
 	"linuxvm/pkg/network"
+	"linuxvm/pkg/system"
+	"linuxvm/pkg/vmconfig"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
-	"golang.org/x/sync/errgroup"
+	"golang.org/x/sys/unix"
 )
 
 const (
-	eth0     = "eth0"
-	attempts = 1
+	eth0      = "eth0"
+	attempts  = 1
+	etcHosts  = "/etc/hosts"
+	etcResolv = "/etc/resolv.conf"
+	// stageTimeout is the default timeout of the stages which may hang
+	stageTimeout = 30 * time.Second
 )
 
+// options of the cmdline, revm passes them before "--"
+type options struct {
+	workdir   string
+	user      string
+	group     string
+	serveInit string
+}
+
+// reaper starts the children of the bootstrap, which reaps every orphan of
+// the guest
+var reaper = system.NewReaper()
+
+// listeners are the listeners of the servers of the bootstrap, done once they
+// are closed, see closeOnDone
+var listeners sync.WaitGroup
+
+// closeOnDone closes l once ctx is done, the companion of the init listens on
+// the same ports once listeners are done
+func closeOnDone(ctx context.Context, l io.Closer) {
+	listeners.Add(1)
+	go func() {
+		defer listeners.Done()
+		<-ctx.Done()
+		_ = l.Close()
+	}()
+}
+
 func main() {
-	g, ctx := errgroup.WithContext(context.Background())
-	g.Go(func() error {
-		return configureNetwork()
-	})
+	opts := options{}
+	flag.StringVar(&opts.workdir, "workdir", "/", "working dir of the cmdline")
+	flag.StringVar(&opts.user, "user", "", "run the cmdline as user, a name or uid")
+	flag.StringVar(&opts.group, "group", "", "run the cmdline as group, a name or gid")
+	flag.StringVar(&opts.serveInit, "serve-init", "", "run as the companion of the init, see handOff")
+	flag.Parse()
 
-	g.Go(func() error {
-		return filesystem.MountTmpfs()
-	})
+	if opts.serveInit != "" {
+		vmc, err := vmconfig.LoadVMConfig(vmConfigFile())
+		if err != nil {
+			logrus.Fatalf("failed to load vm config: %v", err)
+		}
+		serveInit(vmc, opts.serveInit)
+		return
+	}
 
-	g.Go(func() error {
-		return filesystem.MountVirtioFS(filepath.Join("/", "vmconfig.json"))
-	})
+	if flag.NArg() < 1 {
+		logrus.Errorf("no cmdline provided")
+		exit(define.ExitCodeRevmError)
+	}
 
-	g.Go(func() error {
-		return doExecCmdLine(ctx, os.Args[1], os.Args[2:])
-	})
+	// libkrun execs the bootstrap as pid 1, the orphans are reparented to it
+	if os.Getpid() != 1 {
+		if err := system.SetSubreaper(); err != nil {
+			logrus.Warnf("failed to reap orphans: %v", err)
+		}
+	}
+	go reaper.Reap()
 
-	if err := g.Wait(); err != nil {
-		logrus.Errorf("failed to run cmd: %v", err)
+	vmc, err := vmconfig.LoadVMConfig(vmConfigFile())
+	if err != nil {
+		logrus.Errorf("failed to load vm config: %v", err)
+		exit(define.ExitCodeRevmError)
 	}
+
+	// exitCode stays the revm error if the cmdline does not run
+	exitCode := define.ExitCodeRevmError
+
+	// a shutdown request from the host or SIGTERM stops the boot or the cmdline
+	ctx, shutdown := context.WithCancel(context.Background())
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGTERM)
+	defer stop()
+
+	serveControl(ctx, shutdown)
+	serveAgent(ctx, shutdown)
+
+	// the cmdline only runs once the required stages are done, e.g. it finds
+	// the files of the shares and the network up
+	switch err = runStages(ctx, bootStages(ctx, vmc, opts)); {
+	case err != nil:
+		logrus.Errorf("failed to boot: %v", err)
+	case vmc.Init:
+		err = handOff(flag.Arg(0), flag.Args()[1:], func() {
+			shutdown()
+			listeners.Wait()
+		})
+		logrus.Errorf("failed to hand off to init: %v", err)
+		exitCode = define.ExitCodeCannotExec
+	default:
+		exitCode, err = doExecCmdLine(ctx, opts, flag.Arg(0), flag.Args()[1:])
+		if err != nil {
+			logrus.Errorf("failed to run cmd: %v", err)
+		}
+	}
+
+	// a process left, e.g. a daemon the cmdline started, keeps the filesystems
+	// busy
+	if os.Getpid() == 1 {
+		system.KillAll(define.GuestStopTimeout)
+	}
+
+	// data disks and shares must be consistent before the vm is gone
+	if err := filesystem.UnmountAll(); err != nil {
+		logrus.Warnf("failed to unmount filesystems: %v", err)
+	}
+
+	exit(exitCode)
 }
 
-func doExecCmdLine(ctx context.Context, targetBin string, targetBinArgs []string) error {
+// bootStages are the stages run before the cmdline with their default
+// policies, overridden by the boot stages of vmc. The servers started by the
+// stages run until ctx is done.
+func bootStages(ctx context.Context, vmc *vmconfig.VMConfig, opts options) []stage {
+	stages := []stage{
+		{
+			name:     vmconfig.StageBase,
+			required: true,
+			run: func(context.Context) error {
+				return filesystem.MountBase(filesystem.SelectBaseMounts(vmc.BaseMounts.Extra, vmc.BaseMounts.Skip))
+			},
+		},
+		{
+			name:     vmconfig.StageMounts,
+			needs:    []string{vmconfig.StageBase},
+			required: true,
+			timeout:  stageTimeout,
+			run: func(context.Context) error {
+				return filesystem.MountVirtioFS(vmConfigFile())
+			},
+		},
+		{
+			name:     vmconfig.StageNetwork,
+			required: true,
+			timeout:  stageTimeout,
+			run: func(context.Context) error {
+				return configureNetwork(vmc.Network.Mode)
+			},
+		},
+		{
+			// a share mounted on /etc would hide the files
+			name:  vmconfig.StageDNS,
+			needs: []string{vmconfig.StageMounts},
+			run: func(context.Context) error {
+				return configureDNS(vmc)
+			},
+		},
+		{
+			name:  vmconfig.StageSockets,
+			needs: []string{vmconfig.StageMounts},
+			run: func(context.Context) error {
+				return serveSockets(ctx, vmc.Sockets, socketOwner(opts))
+			},
+		},
+		{
+			name:  vmconfig.StageSSH,
+			needs: []string{vmconfig.StageMounts},
+			run: func(context.Context) error {
+				return startSSH(ctx, vmc.SSH)
+			},
+		},
+	}
+
+	// the companion of the init serves the sockets and ssh, the servers of
+	// the bootstrap are gone once it execs the init
+	if vmc.Init {
+		stages = slices.DeleteFunc(stages, func(st stage) bool {
+			return st.name == vmconfig.StageSockets || st.name == vmconfig.StageSSH
+		})
+	}
+
+	applyBootStages(stages, vmc.BootStages)
+	return stages
+}
+
+// vmConfigFile returns the vmconfig.json next to the bootstrap, which is
+// either the revm share or the rootfs
+func vmConfigFile() string {
+	exe, err := os.Executable()
+	if err != nil {
+		logrus.Warnf("failed to get executable path: %v", err)
+		return filepath.Join(define.GuestShareDir, define.VMConfig)
+	}
+	return filepath.Join(filepath.Dir(exe), define.VMConfig)
+}
+
+// exit hands the exit status over to the VMM, so the host revm process exits
+// with the same status as the guest cmdline. As pid 1 the bootstrap powers the
+// vm off, the kernel panics if pid 1 exits.
+func exit(code int) {
+	if err := system.SetExitCode(code); err != nil {
+		logrus.Warnf("failed to pass exit code %d to host: %v", code, err)
+	}
+	if os.Getpid() == 1 {
+		err := system.PowerOff()
+		logrus.Warnf("failed to power off: %v", err)
+	}
+	os.Exit(code)
+}
+
+// doExecCmdLine runs the cmdline and returns the exit status the host should
+// see: the exit code of the cmdline, 128+N if it was killed by signal N, or
+// 126/127 if it could not be started. Once ctx is done the process group of
+// the cmdline gets SIGTERM, and the cmdline SIGKILL if it is still alive after
+// GuestStopTimeout. SIGINT and SIGHUP of the bootstrap are forwarded to the
+// process group.
+//
+// The bootstrap keeps running as root to unmount on shutdown, only the
+// cmdline runs with the user and group of opts.
+func doExecCmdLine(ctx context.Context, opts options, targetBin string, targetBinArgs []string) (int, error) {
 	cmd := exec.CommandContext(ctx, targetBin, targetBinArgs...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.Stdin = os.Stdin
-	logrus.Infof("cmdline: %q", cmd.Args)
-	if err := cmd.Run(); err != nil {
+	cmd.Dir = opts.workdir
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+	cmd.WaitDelay = define.GuestStopTimeout
+
+	// the cmdline leads its own process group, which takes over the terminal
+	// so job control and ^C keep working
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if isControllingTerminal(os.Stdin) {
+		cmd.SysProcAttr.Foreground = true
+		cmd.SysProcAttr.Ctty = 0
+	}
+
+	if opts.user != "" || opts.group != "" {
+		cred, err := system.LookupCredential("/etc/passwd", "/etc/group", opts.user, opts.group)
+		if err != nil {
+			logrus.Errorf("failed to resolve user: %v", err)
+			return define.ExitCodeCannotExec, err
+		}
+		cmd.SysProcAttr.Credential = &syscall.Credential{
+			Uid:    cred.UID,
+			Gid:    cred.GID,
+			Groups: cred.Groups,
+		}
+		cmd.Env = userEnv(os.Environ(), cred)
+		logrus.Infof("run cmdline as uid %d, gid %d, groups %v", cred.UID, cred.GID, cred.Groups)
+	}
+
+	logrus.Infof("cmdline: %q in %q", cmd.Args, cmd.Dir)
+
+	err := reaper.Start(cmd, cmd.Start)
+	if err == nil {
+		stop := forwardSignals(cmd.Process.Pid)
+		err = reaper.Wait(cmd)
+		stop()
+	}
+	if cmd.ProcessState == nil {
 		logrus.Errorf("failed to run cmd: %v", err)
+		if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+			return define.ExitCodeNotFound, err
+		}
+		return define.ExitCodeCannotExec, err
+	}
+
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		logrus.Infof("cmdline killed by signal: %v", status.Signal())
+		return define.ExitCodeSignalBase + int(status.Signal()), nil
+	}
+
+	logrus.Infof("cmdline exit with code: %d", cmd.ProcessState.ExitCode())
+	return cmd.ProcessState.ExitCode(), nil
+}
+
+// forwardSignals sends SIGINT and SIGHUP of the bootstrap to the process group
+// pgid until stop is called. SIGTERM stops the cmdline by ctx instead.
+func forwardSignals(pgid int) (stop func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGHUP)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				logrus.Infof("forward %v to the cmdline", sig)
+				_ = syscall.Kill(-pgid, sig.(syscall.Signal))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
+
+// isControllingTerminal reports whether f is the controlling terminal of the
+// bootstrap, the process group of the cmdline can only take that over
+func isControllingTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetInt(int(f.Fd()), unix.TIOCGPGRP)
+	return err == nil
+}
+
+// socketOwner returns the credential of the cmdline, nil if it runs as root
+// or the user can not be resolved, doExecCmdLine reports the error
+func socketOwner(opts options) *system.Credential {
+	if opts.user == "" && opts.group == "" {
+		return nil
+	}
+	cred, err := system.LookupCredential("/etc/passwd", "/etc/group", opts.user, opts.group)
+	if err != nil {
+		return nil
+	}
+	return cred
+}
+
+// userEnv sets HOME, USER and LOGNAME of the user unless they are given
+func userEnv(env []string, cred *system.Credential) []string {
+	defaults := []string{"HOME=" + cred.Home, "USER=" + cred.Name, "LOGNAME=" + cred.Name}
+	return vmconfig.MergeEnvs(defaults, env)
+}
+
+// configureDNS writes the hosts and the resolver of the vm, they must be in
+// place before the cmdline resolves names
+func configureDNS(vmc *vmconfig.VMConfig) error {
+	var errs []error
+	if err := configureHosts(vmc.Network); err != nil {
+		errs = append(errs, fmt.Errorf("failed to configure %s: %w", etcHosts, err))
+	}
+	if err := configureResolvConf(vmc.Resolver); err != nil {
+		errs = append(errs, fmt.Errorf("failed to configure %s: %w", etcResolv, err))
+	}
+	return errors.Join(errs...)
+}
+
+// configureHosts writes the hosts and dns zone records of the vm into a copy
+// of /etc/hosts next to the bootstrap and bind mounts it on /etc/hosts, so a
+// read-only rootfs is never written
+func configureHosts(n vmconfig.Network) error {
+	base, err := os.ReadFile(etcHosts)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
 		return err
 	}
-	return nil
+
+	content := network.HostsFile(base, n)
+	if content == nil {
+		return nil
+	}
+
+	return bindFile(etcHosts, define.GuestHostsFile, content)
+}
+
+// configureResolvConf writes the resolver derived by revm on the host to
+// /etc/resolv.conf the same way as configureHosts. A vm without nameservers
+// keeps the /etc/resolv.conf of the rootfs.
+func configureResolvConf(r vmconfig.Resolver) error {
+	if len(r.Nameservers) == 0 {
+		return nil
+	}
+	return bindFile(etcResolv, define.GuestResolvFile, network.ResolvConfFile(r))
+}
+
+// bindFile writes content to name next to the bootstrap and bind mounts it on
+// target. target is created if it does not exist, a symlink is followed, e.g.
+// /etc/resolv.conf linking to the stub-resolv.conf of systemd-resolved which
+// only exists once systemd-resolved runs.
+func bindFile(target, name string, content []byte) error {
+	if resolved, err := filepath.EvalSymlinks(target); err == nil {
+		target = resolved
+	} else if link, lerr := os.Readlink(target); lerr == nil {
+		if !filepath.IsAbs(link) {
+			link = filepath.Join(filepath.Dir(target), link)
+		}
+		target = link
+	}
+
+	// the bind mount needs an existing target
+	if _, err := os.Stat(target); errors.Is(err, os.ErrNotExist) {
+		if err = os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+			err = os.WriteFile(target, nil, 0644)
+		}
+		if err != nil {
+			return fmt.Errorf("%s does not exist and can not be created: %w", target, err)
+		}
+	}
+
+	file := filepath.Join(filepath.Dir(vmConfigFile()), name)
+	if err := os.WriteFile(file, content, 0644); err != nil {
+		return err
+	}
+
+	return filesystem.BindMount(file, target)
 }
 
-func configureNetwork() error {
+// configureNetwork leases the guest address by dhcp, from gvproxy or passt
+func configureNetwork(mode string) error {
+	if mode == vmconfig.NetNone {
+		logrus.Infof("network mode %s, skip dhcp", mode)
+		return nil
+	}
+
 	verbose := false
 	if _, find := os.LookupEnv("REVM_DEBUG"); find {
 		verbose = true
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"linuxvm/pkg/define"
+	"net"
+	"strings"
+
+	"github.com/mdlayher/vsock"
+	"github.com/sirupsen/logrus"
+)
+
+// serveControl accepts requests from the host on the control vsock port until
+// ctx is done, shutdown is called on a shutdown request. The listener is up
+// when serveControl returns.
+func serveControl(ctx context.Context, shutdown func()) {
+	l, err := vsock.Listen(define.ControlVsockPort, nil)
+	if err != nil {
+		logrus.Warnf("failed to listen on control vsock port %d: %v", define.ControlVsockPort, err)
+		return
+	}
+
+	closeOnDone(ctx, l)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handleControl(conn, shutdown)
+		}
+	}()
+}
+
+func handleControl(conn net.Conn, shutdown func()) {
+	defer conn.Close() //nolint:errcheck
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		logrus.Warnf("failed to read control request: %v", err)
+		return
+	}
+
+	switch request := strings.TrimSpace(line); request {
+	case define.ShutdownRequest:
+		logrus.Infof("shutdown requested by host")
+		shutdown()
+	default:
+		logrus.Warnf("unknown control request %q", request)
+	}
+}
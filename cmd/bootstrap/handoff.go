@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"linuxvm/pkg/vmconfig"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// sigRTMin4 is SIGRTMIN+4 of glibc, systemd powers off on it
+const sigRTMin4 = syscall.Signal(38)
+
+// handOff starts the companion of the init and execs initBin as pid 1, the
+// init inherits the environment prepared for the cmdline. It only returns on
+// error.
+//
+// The servers of the bootstrap are gone once the init runs, the companion
+// serves the host instead: the shutdown requests, the guest agent, the unix
+// sockets and ssh. stopServers closes the listeners of the bootstrap before
+// the companion listens on the same ports.
+func handOff(initBin string, args []string, stopServers func()) error {
+	// an init which is not pid 1 does not get the orphans and the power off
+	// signals of the guest
+	if pid := os.Getpid(); pid != 1 {
+		return fmt.Errorf("the bootstrap runs as pid %d, the init can only be handed off to by pid 1", pid)
+	}
+
+	path, err := exec.LookPath(initBin)
+	if err != nil {
+		return err
+	}
+
+	stopServers()
+
+	// the init reaps the companion, it is not started by the reaper
+	companion := exec.Command("/proc/self/exe", "--serve-init", initBin)
+	companion.Stdout = os.Stdout
+	companion.Stderr = os.Stderr
+	companion.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err = companion.Start(); err != nil {
+		logrus.Warnf("failed to start the companion of the init, revm stop and the sockets will not work: %v", err)
+	}
+
+	if err = os.Chdir("/"); err != nil {
+		return err
+	}
+
+	logrus.Infof("hand off to init %q %q", path, args)
+	return syscall.Exec(path, append([]string{initBin}, args...), os.Environ())
+}
+
+// serveInit is the companion of the init: it serves the control requests,
+// the guest agent, the unix sockets and ssh until it gets SIGTERM, e.g. when
+// the init stops every process on shutdown. A shutdown request asks the init
+// to power off.
+func serveInit(vmc *vmconfig.VMConfig, initBin string) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+	defer stop()
+
+	sig := initStopSignal(initBin)
+	shutdown := func() {
+		logrus.Infof("send %v to init", sig)
+		if err := syscall.Kill(1, sig); err != nil {
+			logrus.Warnf("failed to stop init: %v", err)
+		}
+	}
+	serveControl(ctx, shutdown)
+	serveAgent(ctx, shutdown)
+
+	if err := serveSockets(ctx, vmc.Sockets, nil); err != nil {
+		logrus.Warnf("failed to serve sockets: %v", err)
+	}
+
+	// the init starts the sshd of the rootfs as a service
+	s := vmc.SSH
+	if s.Mode == vmconfig.SSHRootFS {
+		s.Mode = vmconfig.SSHKeys
+	}
+	if err := startSSH(ctx, s); err != nil {
+		logrus.Warnf("failed to set up ssh: %v", err)
+	}
+
+	<-ctx.Done()
+}
+
+// initStopSignal is the signal the init powers off on: SIGRTMIN+4 for
+// systemd, SIGUSR2 for busybox init and openrc-init
+func initStopSignal(initBin string) syscall.Signal {
+	if resolved, err := filepath.EvalSymlinks(initBin); err == nil {
+		initBin = resolved
+	}
+	if strings.Contains(filepath.Base(initBin), "systemd") {
+		return sigRTMin4
+	}
+	return syscall.SIGUSR2
+}
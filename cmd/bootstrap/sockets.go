@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"linuxvm/pkg/system"
+	"linuxvm/pkg/vmconfig"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/mdlayher/vsock"
+	"github.com/sirupsen/logrus"
+)
+
+// serveSockets makes the forwarded host sockets available at their guest
+// paths and the guest sockets available to the published host paths until
+// ctx is done. The guest paths of forwarded sockets are owned by cred, so the
+// cmdline can connect, cred is nil if the cmdline runs as root.
+//
+// The listeners are up when serveSockets returns, so the cmdline finds the
+// forwarded sockets. A socket failing is returned, the others are served
+// anyway.
+func serveSockets(ctx context.Context, sockets []vmconfig.SocketMapping, cred *system.Credential) error {
+	var errs []error
+	for _, sock := range sockets {
+		var (
+			l   net.Listener
+			err error
+		)
+		if sock.Direction == vmconfig.SocketPublish {
+			l, err = vsock.Listen(sock.VsockPort, nil)
+		} else {
+			l, err = listenUnix(sock.GuestPath, cred)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to serve socket %s: %w", sock, err))
+			continue
+		}
+		logrus.Infof("serve socket %s on vsock port %d", sock, sock.VsockPort)
+
+		closeOnDone(ctx, l)
+		go acceptSocket(l, sock)
+	}
+	return errors.Join(errs...)
+}
+
+// acceptSocket proxies the connections of l to the other end of sock, the
+// vsock port libkrun connects to the host socket, or the guest socket
+func acceptSocket(l net.Listener, sock vmconfig.SocketMapping) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			var (
+				peer net.Conn
+				err  error
+			)
+			if sock.Direction == vmconfig.SocketPublish {
+				peer, err = net.Dial("unix", sock.GuestPath)
+			} else {
+				peer, err = vsock.Dial(vsock.Host, sock.VsockPort, nil)
+			}
+			if err != nil {
+				logrus.Warnf("failed to connect socket %s: %v", sock, err)
+				_ = conn.Close()
+				return
+			}
+			proxy(conn, peer)
+		}()
+	}
+}
+
+// listenUnix listens on path, a stale socket is removed
+func listenUnix(path string, cred *system.Credential) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err = os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if cred != nil {
+		err = os.Lchown(path, int(cred.UID), int(cred.GID))
+	}
+	if err == nil {
+		err = os.Chmod(path, 0600)
+	}
+	if err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// proxy copies between a and b until both directions are done, the write
+// side of a conn is closed once its peer sent everything
+func proxy(a, b net.Conn) {
+	defer a.Close() //nolint:errcheck
+	defer b.Close() //nolint:errcheck
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		if _, err := io.Copy(dst, src); err != nil && !errors.Is(err, net.ErrClosed) {
+			logrus.Debugf("socket proxy: %v", err)
+		}
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go pipe(a, b)
+	go pipe(b, a)
+	<-done
+	<-done
+}
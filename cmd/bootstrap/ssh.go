@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"linuxvm/pkg/define"
+	"linuxvm/pkg/system"
+	"linuxvm/pkg/vmconfig"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	sshd       = "/usr/sbin/sshd"
+	sshdRunDir = "/run/sshd"
+	sshPath    = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+)
+
+// startSSH authorizes the key of the vm for the ssh user and starts the ssh
+// server of the mode, which stops once ctx is done
+func startSSH(ctx context.Context, s vmconfig.SSH) error {
+	if !s.Enabled() {
+		return nil
+	}
+
+	cred, err := system.LookupCredential("/etc/passwd", "/etc/group", s.User, "")
+	if err != nil {
+		return fmt.Errorf("failed to resolve ssh user: %w", err)
+	}
+	if err = authorizeKey(cred, s.AuthorizedKey); err != nil {
+		return fmt.Errorf("failed to authorize the ssh key of the vm: %w", err)
+	}
+
+	switch s.Mode {
+	case vmconfig.SSHRootFS:
+		err = startSSHD(ctx)
+	case vmconfig.SSHBuiltin:
+		err = serveBuiltinSSH(ctx, s, cred)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to start ssh server: %w", err)
+	}
+	logrus.Infof("ssh mode %s, user %q", s.Mode, cred.Name)
+	return nil
+}
+
+// authorizeKey appends key to ~/.ssh/authorized_keys of cred unless it is
+// there. A read-only rootfs gets a copy with the key bind mounted instead.
+func authorizeKey(cred *system.Credential, key string) error {
+	dir := filepath.Join(cred.Home, ".ssh")
+	file := filepath.Join(dir, "authorized_keys")
+
+	content, err := os.ReadFile(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if fields := strings.Fields(key); len(fields) > 1 && bytes.Contains(content, []byte(fields[1])) {
+		return nil
+	}
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		content = append(content, '\n')
+	}
+	content = append(content, key+"\n"...)
+
+	err = writeAuthorizedKeys(dir, file, content, cred)
+	if errors.Is(err, syscall.EROFS) {
+		return bindFile(file, define.GuestAuthorizedKeysFile, content)
+	}
+	return err
+}
+
+// writeAuthorizedKeys writes the file with the modes sshd insists on
+func writeAuthorizedKeys(dir, file string, content []byte, cred *system.Credential) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(file, content, 0600); err != nil {
+		return err
+	}
+	for _, path := range []string{dir, file} {
+		if err := os.Lchown(path, int(cred.UID), int(cred.GID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startSSHD starts the sshd of the rootfs in the foreground, the host keys
+// are generated if the rootfs has none, e.g. fresh from a container image
+func startSSHD(ctx context.Context) error {
+	if _, err := os.Stat(sshd); err != nil {
+		return fmt.Errorf("rootfs has no sshd: %w", err)
+	}
+
+	if keys, _ := filepath.Glob("/etc/ssh/ssh_host_*_key"); len(keys) == 0 {
+		var out bytes.Buffer
+		keygen := exec.Command("ssh-keygen", "-A")
+		keygen.Stdout = &out
+		keygen.Stderr = &out
+		if err := reaper.Run(keygen); err != nil {
+			return fmt.Errorf("failed to generate ssh host keys: %w: %s", err, out.Bytes())
+		}
+	}
+	// the privilege separation dir, /run is empty at boot
+	if err := os.MkdirAll(sshdRunDir, 0755); err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, sshd, "-D", "-e")
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := reaper.Start(cmd, cmd.Start); err != nil {
+		return err
+	}
+	go func() {
+		if err := reaper.Wait(cmd); ctx.Err() == nil {
+			logrus.Warnf("sshd exit: %v", err)
+		}
+	}()
+	return nil
+}
+
+// serveBuiltinSSH serves ssh on the guest ssh port for the rootfs without
+// sshd. Only the key of the vm logs in, as cred, the host key is generated
+// per boot.
+func serveBuiltinSSH(ctx context.Context, s vmconfig.SSH, cred *system.Credential) error {
+	authorized, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s.AuthorizedKey))
+	if err != nil {
+		return fmt.Errorf("invalid authorized key: %w", err)
+	}
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		return err
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			user := meta.User()
+			if (user == cred.Name || user == s.User) && bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("key not authorized for %q", user)
+		},
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", ":"+strconv.Itoa(define.SSHGuestPort))
+	if err != nil {
+		return err
+	}
+	closeOnDone(ctx, l)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handleSSHConn(conn, config, cred)
+		}
+	}()
+	return nil
+}
+
+func handleSSHConn(conn net.Conn, config *ssh.ServerConfig, cred *system.Credential) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		logrus.Debugf("ssh handshake: %v", err)
+		return
+	}
+	defer sconn.Close() //nolint:errcheck
+
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			_ = nc.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+		ch, requests, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go handleSSHSession(ch, requests, cred)
+	}
+}
+
+// sshSession is a session channel, it runs a shell or a command once
+type sshSession struct {
+	ch      ssh.Channel
+	cred    *system.Credential
+	env     []string
+	term    string
+	size    *pty.Winsize
+	ptmx    *os.File
+	started bool
+}
+
+func handleSSHSession(ch ssh.Channel, reqs <-chan *ssh.Request, cred *system.Credential) {
+	s := &sshSession{ch: ch, cred: cred}
+	for req := range reqs {
+		ok := s.handle(req)
+		if req.WantReply {
+			_ = req.Reply(ok, nil)
+		}
+	}
+}
+
+// handle serves the session requests of RFC 4254, the requests are handled
+// in order by a single goroutine
+func (s *sshSession) handle(req *ssh.Request) bool {
+	switch req.Type {
+	case "pty-req":
+		var p struct {
+			Term          string
+			Cols, Rows    uint32
+			Width, Height uint32
+			Modes         string
+		}
+		if s.started || ssh.Unmarshal(req.Payload, &p) != nil {
+			return false
+		}
+		s.term = p.Term
+		s.size = &pty.Winsize{Cols: uint16(p.Cols), Rows: uint16(p.Rows)}
+		return true
+	case "window-change":
+		var w struct {
+			Cols, Rows    uint32
+			Width, Height uint32
+		}
+		if s.ptmx == nil || ssh.Unmarshal(req.Payload, &w) != nil {
+			return false
+		}
+		return pty.Setsize(s.ptmx, &pty.Winsize{Cols: uint16(w.Cols), Rows: uint16(w.Rows)}) == nil
+	case "env":
+		var e struct{ Name, Value string }
+		if ssh.Unmarshal(req.Payload, &e) != nil {
+			return false
+		}
+		s.env = append(s.env, e.Name+"="+e.Value)
+		return true
+	case "shell", "exec":
+		if s.started {
+			return false
+		}
+		// a shell is a login shell, argv[0] prefixed with a dash
+		cmd := exec.Command(s.cred.Shell)
+		cmd.Args[0] = "-" + filepath.Base(s.cred.Shell)
+		if req.Type == "exec" {
+			var e struct{ Command string }
+			if ssh.Unmarshal(req.Payload, &e) != nil {
+				return false
+			}
+			cmd = exec.Command(s.cred.Shell, "-c", e.Command)
+		}
+		if err := s.start(cmd); err != nil {
+			logrus.Warnf("ssh session: failed to start %q: %v", cmd.Args, err)
+			return false
+		}
+		s.started = true
+		return true
+	default:
+		return false
+	}
+}
+
+// start runs cmd as the ssh user on a pty if one was requested, the exit
+// status is sent and the channel closed once cmd exits
+func (s *sshSession) start(cmd *exec.Cmd) error {
+	cmd.Dir = s.cred.Home
+	cmd.Env = vmconfig.MergeEnvs([]string{
+		sshPath,
+		"HOME=" + s.cred.Home,
+		"USER=" + s.cred.Name,
+		"LOGNAME=" + s.cred.Name,
+		"SHELL=" + s.cred.Shell,
+	}, s.env)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{
+			Uid:    s.cred.UID,
+			Gid:    s.cred.GID,
+			Groups: s.cred.Groups,
+		},
+	}
+
+	if s.size == nil {
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+		cmd.Stdout = s.ch
+		cmd.Stderr = s.ch.Stderr()
+		if err = reaper.Start(cmd, cmd.Start); err != nil {
+			return err
+		}
+		go func() {
+			_, _ = io.Copy(stdin, s.ch)
+			_ = stdin.Close()
+		}()
+		go s.wait(cmd, nil)
+		return nil
+	}
+
+	cmd.Env = append(cmd.Env, "TERM="+s.term)
+	var ptmx *os.File
+	err := reaper.Start(cmd, func() (err error) {
+		ptmx, err = pty.StartWithSize(cmd, s.size)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.ptmx = ptmx
+	go func() {
+		_, _ = io.Copy(ptmx, s.ch)
+	}()
+	output := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(s.ch, ptmx)
+		close(output)
+	}()
+	go s.wait(cmd, output)
+	return nil
+}
+
+// wait sends the exit status of cmd the same way revm reports the cmdline,
+// 128+N if it was killed by signal N. output is closed once the pty is read
+// empty, a background process keeping the pty open is not waited for long.
+func (s *sshSession) wait(cmd *exec.Cmd, output chan struct{}) {
+	_ = reaper.Wait(cmd)
+	if output != nil {
+		select {
+		case <-output:
+		case <-time.After(time.Second):
+		}
+		_ = s.ptmx.Close()
+	}
+
+	code := cmd.ProcessState.ExitCode()
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		code = define.ExitCodeSignalBase + int(status.Signal())
+	}
+	_, _ = s.ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(code)}))
+	_ = s.ch.Close()
+}
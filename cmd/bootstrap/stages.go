@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"linuxvm/pkg/vmconfig"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// stage is a step of the boot, it runs once the stages it needs are done
+type stage struct {
+	name  string
+	needs []string
+	// required stages must succeed, else the cmdline is not run
+	required bool
+	// timeout fails the stage if it takes longer, 0 never times out
+	timeout time.Duration
+	run     func(ctx context.Context) error
+}
+
+// applyBootStages overrides the policies of stages by the boot stages of the
+// vm config
+func applyBootStages(stages []stage, overrides []vmconfig.BootStage) {
+	for _, o := range overrides {
+		for i := range stages {
+			if stages[i].name != o.Name {
+				continue
+			}
+			if o.Policy != "" {
+				stages[i].required = o.Policy == vmconfig.StageRequired
+			}
+			if o.Timeout != "" {
+				stages[i].timeout = o.TimeoutDuration()
+			}
+		}
+	}
+}
+
+// runStages runs every stage once the stages it needs are done, independent
+// stages run concurrently. A stage needing a failed optional stage still runs.
+// It returns the error of the first required stage failing, the stages not
+// started by then are skipped, or the error of ctx if it is done before. It
+// fails without running a stage if the needs of the stages are not satisfiable.
+func runStages(ctx context.Context, stages []stage) error {
+	if err := checkStages(stages); err != nil {
+		return err
+	}
+
+	done := make(map[string]chan struct{}, len(stages))
+	for _, st := range stages {
+		done[st.name] = make(chan struct{})
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var wg sync.WaitGroup
+	for _, st := range stages {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done[st.name])
+
+			for _, need := range st.needs {
+				select {
+				case <-done[need]:
+				case <-ctx.Done():
+				}
+			}
+			if ctx.Err() != nil {
+				logrus.Infof("boot stage %s skipped", st.name)
+				return
+			}
+
+			start := time.Now()
+			err := runStage(ctx, st)
+			switch {
+			case err == nil:
+				logrus.Infof("boot stage %s done in %v", st.name, time.Since(start))
+			case st.required:
+				cancel(fmt.Errorf("required boot stage %s failed: %w", st.name, err))
+			default:
+				logrus.Warnf("optional boot stage %s failed: %v", st.name, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return context.Cause(ctx)
+}
+
+// runStage runs the stage with a ctx of its own, which is cancelled once the
+// timeout expires, ctx is done or the stage returns. runStage does not wait
+// for a stage which does not return then, e.g. a hanging mount: the stage is
+// abandoned and keeps running until it notices its ctx, its error is dropped.
+func runStage(ctx context.Context, st stage) error {
+	var cancel context.CancelFunc
+	if st.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, st.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- st.run(ctx)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		go func() {
+			err := <-errCh
+			logrus.Debugf("abandoned boot stage %s returned: %v", st.name, err)
+		}()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("timed out after %v", st.timeout)
+		}
+		return ctx.Err()
+	}
+}
+
+// checkStages fails if a stage needs a stage which is not given or the needs
+// form a cycle, runStages would wait forever for such a need
+func checkStages(stages []stage) error {
+	byName := make(map[string]stage, len(stages))
+	for _, st := range stages {
+		if _, dup := byName[st.name]; dup {
+			return fmt.Errorf("boot stage %s is given twice", st.name)
+		}
+		byName[st.name] = st
+	}
+	for _, st := range stages {
+		for _, need := range st.needs {
+			if _, found := byName[need]; !found {
+				return fmt.Errorf("boot stage %s needs the unknown stage %s", st.name, need)
+			}
+		}
+	}
+
+	// 1 while the needs of the stage are visited, 2 once they are
+	state := make(map[string]int, len(stages))
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("boot stage %s needs itself", name)
+		case 2:
+			return nil
+		}
+		state[name] = 1
+		for _, need := range byName[name].needs {
+			if err := visit(need); err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+		return nil
+	}
+	for _, st := range stages {
+		if err := visit(st.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCheckStages(t *testing.T) {
+	tests := []struct {
+		name    string
+		stages  []stage
+		wantErr bool
+	}{
+		{
+			name:   "needs given",
+			stages: []stage{{name: "base"}, {name: "mounts", needs: []string{"base"}}},
+		},
+		{
+			name:    "unknown need",
+			stages:  []stage{{name: "base"}, {name: "mounts", needs: []string{"bsae"}}},
+			wantErr: true,
+		},
+		{
+			name:    "duplicate stage",
+			stages:  []stage{{name: "base"}, {name: "base"}},
+			wantErr: true,
+		},
+		{
+			name:    "cycle",
+			stages:  []stage{{name: "a", needs: []string{"c"}}, {name: "b", needs: []string{"a"}}, {name: "c", needs: []string{"b"}}},
+			wantErr: true,
+		},
+		{
+			name:    "needs itself",
+			stages:  []stage{{name: "a", needs: []string{"a"}}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkStages(tt.stages); (err != nil) != tt.wantErr {
+				t.Errorf("checkStages() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunStagesUnknownNeed(t *testing.T) {
+	ran := false
+	stages := []stage{
+		{name: "base", run: func(context.Context) error { ran = true; return nil }},
+		{name: "mounts", needs: []string{"unknown"}, run: func(context.Context) error { return nil }},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := runStages(ctx, stages); err == nil || errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("runStages() error = %v, want the unknown need", err)
+	}
+	if ran {
+		t.Error("a stage ran although the needs are not satisfiable")
+	}
+}
+
+func TestRunStageTimeout(t *testing.T) {
+	cancelled := make(chan struct{})
+	st := stage{
+		name:    "hang",
+		timeout: 10 * time.Millisecond,
+		run: func(ctx context.Context) error {
+			<-ctx.Done()
+			close(cancelled)
+			// the stage keeps running after runStage gave up on it
+			time.Sleep(50 * time.Millisecond)
+			return ctx.Err()
+		},
+	}
+
+	if err := runStage(context.Background(), st); err == nil {
+		t.Fatal("runStage() of a hanging stage succeeded")
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the ctx of the timed out stage is not cancelled")
+	}
+}
+
+func TestRunStagesRequiredFailure(t *testing.T) {
+	failed := errors.New("mount failed")
+	skipped := true
+	stages := []stage{
+		{name: "base", required: true, run: func(context.Context) error { return failed }},
+		{name: "optional", run: func(context.Context) error { return errors.New("optional failed") }},
+		{name: "mounts", needs: []string{"base"}, run: func(context.Context) error { skipped = false; return nil }},
+	}
+
+	if err := runStages(context.Background(), stages); !errors.Is(err, failed) {
+		t.Fatalf("runStages() error = %v, want %v", err, failed)
+	}
+	if !skipped {
+		t.Error("a stage needing the failed required stage ran")
+	}
+}
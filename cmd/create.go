@@ -0,0 +1,110 @@
+//go:build darwin
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"linuxvm/pkg/network"
+	"linuxvm/pkg/state"
+	"linuxvm/pkg/vmconfig"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v3"
+)
+
+var createCommand = &cli.Command{
+	Name:      "create",
+	Usage:     "create a named vm in the state dir, boot it with start",
+	UsageText: "create [flags] <name> [-- <cmdline>]",
+	Flags:     vmFlags(),
+	Action:    CreateVM,
+}
+
+func CreateVM(ctx context.Context, command *cli.Command) error {
+	name := command.Args().First()
+	if name == "" {
+		return fmt.Errorf("no vm name provided")
+	}
+
+	spec, err := loadSpec(command, command.Args().Tail())
+	if err != nil {
+		return err
+	}
+
+	store, err := state.NewStore()
+	if err != nil {
+		return err
+	}
+
+	vm, err := store.Create(name, spec.VMConfig(), cmdlineFromSpec(spec))
+	if err != nil {
+		return err
+	}
+
+	if err = allocateNetwork(vm, spec.Network); err != nil {
+		_ = store.Remove(vm.Name)
+		return err
+	}
+
+	logrus.Infof("vm %q created in %q", vm.Name, vm.Dir)
+	return nil
+}
+
+// allocateNetwork leases a distinct network to the vm and saves it into the
+// vm config, the values given in want are kept
+func allocateNetwork(vm *state.VM, want vmconfig.Network) error {
+	ipam, err := newIPAM()
+	if err != nil {
+		return err
+	}
+
+	cfg, err := vm.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	cfg.VMConfig.Network, err = ipam.Allocate(vm.Name, 0, want)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("vm %q leased subnet %s, guest ip %s, mac %s", vm.Name,
+		cfg.VMConfig.Network.Subnet, cfg.VMConfig.Network.GuestIP, cfg.VMConfig.Network.GuestMAC)
+
+	if err = vm.SaveConfig(cfg); err != nil {
+		_ = ipam.Release(vm.Name)
+		return err
+	}
+	return nil
+}
+
+// newIPAM returns the IPAM of the state dir, the pool is read from
+// $REVM_SUBNET_POOL if set, see network.SubnetPool
+func newIPAM() (*network.IPAM, error) {
+	base, err := state.BaseDir()
+	if err != nil {
+		return nil, err
+	}
+
+	return network.NewIPAM(base, network.SubnetPool())
+}
+
+// lookupVM returns the VM named by the first positional arg
+func lookupVM(command *cli.Command) (*state.Store, *state.VM, error) {
+	name := command.Args().First()
+	if name == "" {
+		return nil, nil, fmt.Errorf("no vm name provided")
+	}
+
+	store, err := state.NewStore()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	vm, err := store.Get(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return store, vm, nil
+}
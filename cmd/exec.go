@@ -0,0 +1,81 @@
+//go:build darwin
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"linuxvm/pkg/agent"
+	"linuxvm/pkg/define"
+	"linuxvm/pkg/state"
+	"os"
+
+	"github.com/urfave/cli/v3"
+)
+
+var execCommand = &cli.Command{
+	Name:      "exec",
+	Usage:     "run a command in a running vm by the guest agent",
+	UsageText: "exec [flags] <name> -- <cmdline>",
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "envs",
+			Usage: "set envs for the command, e.g. --envs=FOO=bar --envs=BAZ=qux",
+		},
+		&cli.StringFlag{
+			Name:  "workdir",
+			Usage: "working dir of the command in the guest (default: /)",
+		},
+		&cli.StringFlag{
+			Name:  "user",
+			Usage: "run the command as user, a name or uid in the /etc/passwd of the rootfs (default: root)",
+		},
+		&cli.StringFlag{
+			Name:  "group",
+			Usage: "run the command as group, a name or gid in the /etc/group of the rootfs",
+		},
+	},
+	Action: ExecVM,
+}
+
+// ExecVM runs the command in the guest with the stdio of revm, revm exits with
+// the exit status of the command
+func ExecVM(ctx context.Context, command *cli.Command) error {
+	_, vm, err := lookupVM(command)
+	if err != nil {
+		return err
+	}
+	args := command.Args().Tail()
+	if len(args) == 0 {
+		return fmt.Errorf("no cmdline provided")
+	}
+
+	st, err := vm.Status()
+	if err != nil {
+		return err
+	}
+	if st.State != state.Running {
+		return fmt.Errorf("vm %q is not running", vm.Name)
+	}
+
+	cfg, err := state.LoadConfigFile(vm.Path(define.RuntimeConfig))
+	if err != nil {
+		return err
+	}
+	if cfg.VMConfig.AgentSocket == "" {
+		return fmt.Errorf("vm %q has no guest agent, recreate it", vm.Name)
+	}
+
+	client := agent.NewClient(cfg.VMConfig.AgentSocket)
+	exitCode, err := client.Exec(ctx, agent.ExecRequest{
+		Args:  args,
+		Env:   command.StringSlice("envs"),
+		Dir:   command.String("workdir"),
+		User:  command.String("user"),
+		Group: command.String("group"),
+	}, os.Stdin, os.Stdout, os.Stderr)
+	if err != nil {
+		return err
+	}
+	return exitWith(exitCode)
+}
@@ -0,0 +1,354 @@
+//go:build darwin
+
+package main
+
+import (
+	"fmt"
+	"linuxvm/pkg/filesystem"
+	"linuxvm/pkg/vmconfig"
+	"os"
+
+	"github.com/urfave/cli/v3"
+)
+
+// vmFlags are shared by the commands which define a VM, e.g. run and create.
+// Flags explicitly given override the values of the --config spec file.
+func vmFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "config",
+			Usage: "load the vm spec from a yaml or json file, flags given on the cmdline override it",
+		},
+		&cli.StringFlag{
+			Name:  "rootfs",
+			Usage: "rootfs path, e.g. /var/lib/libkrun/rootfs/alpine-3.15.0",
+		},
+		&cli.Int8Flag{
+			Name:  "cpus",
+			Usage: "given how many cpu cores",
+			Value: 1,
+		},
+		&cli.Int32Flag{
+			Name:  "memory",
+			Usage: "set memory in MB",
+			Value: 512,
+		},
+		&cli.StringFlag{
+			Name:  "log-level",
+			Usage: "libkrun log level, one of OFF, ERROR, WARN, INFO, DEBUG, TRACE",
+		},
+		&cli.StringSliceFlag{
+			Name:  "envs",
+			Usage: "set envs for cmdline, e.g. --envs=FOO=bar --envs=BAZ=qux",
+		},
+		&cli.StringSliceFlag{
+			Name:  "data-disk",
+			Usage: "set data disk path, the disk will be map into /dev/vdX",
+		},
+		&cli.StringSliceFlag{
+			Name:  "mount",
+			Usage: "mount host dir to guest dir",
+		},
+		&cli.StringSliceFlag{
+			Name:    "publish",
+			Aliases: []string{"p"},
+			Usage:   "publish a guest port on the host, [hostIP:]hostPort:guestPort[/udp], e.g. -p 8080:80 (default host ip: 127.0.0.1)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "forward-socket",
+			Usage: "make a host unix socket available in the guest, /host/path.sock:/guest/path.sock, e.g. --forward-socket $SSH_AUTH_SOCK:/run/ssh-agent.sock",
+		},
+		&cli.StringSliceFlag{
+			Name:  "publish-socket",
+			Usage: "make a guest unix socket available on the host, /host/path.sock:/guest/path.sock",
+		},
+		&cli.StringFlag{
+			Name:  "ssh",
+			Usage: "enable revm ssh, keys only authorizes the vm key, rootfs also starts the sshd of the rootfs, builtin serves ssh from the bootstrap",
+		},
+		&cli.StringFlag{
+			Name:  "ssh-user",
+			Usage: "user revm ssh logs in as (default: --user)",
+		},
+		&cli.Uint16Flag{
+			Name:  "ssh-port",
+			Usage: "host port on 127.0.0.1 forwarded to the guest ssh port (default: a free port)",
+		},
+		&cli.StringFlag{
+			Name:  "net",
+			Usage: "network mode, gvproxy, passt (needs passt in $PATH) or none for no network access at all (default: gvproxy)",
+		},
+		&cli.StringFlag{
+			Name:  "subnet",
+			Usage: "ipv4 subnet of the virtual network, must not collide with the host routes (default: 192.168.127.0/24)",
+		},
+		&cli.StringFlag{
+			Name:  "gateway-ip",
+			Usage: "gateway and dns server address in the subnet (default: first address of the subnet)",
+		},
+		&cli.StringFlag{
+			Name:  "guest-ip",
+			Usage: "guest address in the subnet (default: second address of the subnet)",
+		},
+		&cli.StringFlag{
+			Name:  "guest-mac",
+			Usage: "mac address of the guest nic (default: 5a:94:ef:e4:0c:ee)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "add-host",
+			Usage: "add a name:ip entry to /etc/hosts of the guest, e.g. --add-host db:10.0.0.5",
+		},
+		&cli.BoolFlag{
+			Name:  "import-hosts",
+			Usage: "add the entries of /etc/hosts of the host to /etc/hosts of the guest, loopback entries are skipped",
+		},
+		&cli.StringSliceFlag{
+			Name:  "dns-zone",
+			Usage: "serve a dns zone to the guest, zone=name:ip[,name:ip...], e.g. --dns-zone corp.internal=db:10.0.0.5",
+		},
+		&cli.StringSliceFlag{
+			Name:  "dns",
+			Usage: "nameserver the guest queries instead of the gateway, by default the guest resolves by the host resolver",
+		},
+		&cli.StringSliceFlag{
+			Name:  "dns-search",
+			Usage: "search domain of the guest, by default the search domains of the host",
+		},
+		&cli.StringSliceFlag{
+			Name:  "dns-option",
+			Usage: "resolv.conf option of the guest, e.g. --dns-option ndots:2, by default the options of the host",
+		},
+		&cli.StringSliceFlag{
+			Name:  "egress",
+			Usage: "egress rule of the guest, action:target[:ports][/protocol], the first matching rule decides, e.g. --egress allow:mirror.example.com:443/tcp",
+		},
+		&cli.StringFlag{
+			Name:  "egress-default",
+			Usage: "egress action of the traffic no rule matches, allow or deny",
+		},
+		&cli.StringFlag{
+			Name:  "log-connections",
+			Usage: "log the connections of the guest to a json lines file",
+		},
+		&cli.StringFlag{
+			Name:  "log-dns",
+			Usage: "log the dns queries of the guest to a json lines file",
+		},
+		&cli.StringFlag{
+			Name:  "pcap",
+			Usage: "capture the guest traffic to a pcap file",
+		},
+		&cli.IntFlag{
+			Name:  "pcap-max-size",
+			Usage: "rotate the pcap file once it grows beyond the size in MB, 0 never rotates",
+		},
+		&cli.IntFlag{
+			Name:  "pcap-max-files",
+			Usage: "how many rotated pcap files FILE.1 ... FILE.N are kept (default: 1)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "base-mount",
+			Usage: "mount an optional pseudo filesystem in the guest, binfmt_misc or debugfs",
+		},
+		&cli.StringSliceFlag{
+			Name:  "skip-base-mount",
+			Usage: "do not mount a default pseudo filesystem in the guest: proc, sysfs, devtmpfs, devpts, shm, run, tmp or cgroup2",
+		},
+		&cli.StringSliceFlag{
+			Name:  "boot-stage",
+			Usage: "policy of a boot stage run before the cmdline, name[:required|optional][:timeout], e.g. --boot-stage network:optional:10s, stages: base, mounts, network, dns, sockets, ssh",
+		},
+		&cli.BoolFlag{
+			Name:  "init",
+			Usage: "exec the cmdline as the init of the guest once it is set up, e.g. systemd or openrc to run services (default cmdline: /sbin/init)",
+		},
+		&cli.StringFlag{
+			Name:  "workdir",
+			Usage: "working dir of the cmdline in the guest (default: /)",
+		},
+		&cli.StringFlag{
+			Name:  "user",
+			Usage: "run the cmdline as user, a name or uid in the /etc/passwd of the rootfs (default: root)",
+		},
+		&cli.StringFlag{
+			Name:  "group",
+			Usage: "run the cmdline as group, a name or gid in the /etc/group of the rootfs (default: primary group of --user)",
+		},
+	}
+}
+
+// loadSpec resolves the vm spec, the precedence from low to high is: the
+// defaults, the --config spec file, the flags and args given on the cmdline
+func loadSpec(command *cli.Command, args []string) (*vmconfig.Spec, error) {
+	spec := vmconfig.DefaultSpec()
+
+	if file := command.String("config"); file != "" {
+		fileSpec, err := vmconfig.LoadSpec(file)
+		if err != nil {
+			return nil, err
+		}
+		spec.Merge(fileSpec)
+	}
+
+	flagSpec, err := specFromFlags(command, args)
+	if err != nil {
+		return nil, err
+	}
+	spec.Merge(flagSpec)
+
+	if spec.IsInit() && len(spec.Command) == 0 {
+		spec.Command = []string{vmconfig.DefaultInit}
+	}
+
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+
+	return spec, nil
+}
+
+// specFromFlags only carries the flags explicitly set on the cmdline
+func specFromFlags(command *cli.Command, args []string) (*vmconfig.Spec, error) {
+	spec := &vmconfig.Spec{
+		RootFS:    command.String("rootfs"),
+		LogLevel:  command.String("log-level"),
+		Envs:      command.StringSlice("envs"),
+		DataDisks: command.StringSlice("data-disk"),
+		Command:   args,
+		Workdir:   command.String("workdir"),
+		User:      command.String("user"),
+		Group:     command.String("group"),
+		Init:      boolFlag(command, "init"),
+		Network: vmconfig.Network{
+			Mode:      command.String("net"),
+			Subnet:    command.String("subnet"),
+			GatewayIP: command.String("gateway-ip"),
+			GuestIP:   command.String("guest-ip"),
+			GuestMAC:  command.String("guest-mac"),
+		},
+		BaseMounts: vmconfig.BaseMounts{
+			Extra: command.StringSlice("base-mount"),
+			Skip:  command.StringSlice("skip-base-mount"),
+		},
+		SSH: vmconfig.SSH{
+			Mode:     command.String("ssh"),
+			User:     command.String("ssh-user"),
+			HostPort: command.Uint16("ssh-port"),
+		},
+	}
+
+	if command.IsSet("cpus") {
+		spec.Cpus = command.Int8("cpus")
+	}
+	if command.IsSet("memory") {
+		spec.Memory = command.Int32("memory")
+	}
+
+	for i, volume := range command.StringSlice("mount") {
+		if volume == "" {
+			continue
+		}
+		_, source, target, readOnly := filesystem.SplitVolume(i, volume)
+		spec.Mounts = append(spec.Mounts, vmconfig.MountSpec{
+			Source:   source,
+			Target:   target,
+			ReadOnly: readOnly,
+		})
+	}
+
+	spec.Network.Capture.File = command.String("pcap")
+	spec.Network.Log.Connections = command.String("log-connections")
+	spec.Network.Log.DNS = command.String("log-dns")
+	spec.Network.Capture.MaxSizeMB = command.Int("pcap-max-size")
+	spec.Network.Capture.MaxFiles = command.Int("pcap-max-files")
+
+	spec.Network.ImportHosts = boolFlag(command, "import-hosts")
+	for _, addHost := range command.StringSlice("add-host") {
+		h, err := vmconfig.ParseHostEntry(addHost)
+		if err != nil {
+			return nil, err
+		}
+		spec.Network.Hosts = append(spec.Network.Hosts, h)
+	}
+	for _, dnsZone := range command.StringSlice("dns-zone") {
+		z, err := vmconfig.ParseDNSZone(dnsZone)
+		if err != nil {
+			return nil, err
+		}
+		spec.Network.DNSZones = vmconfig.MergeDNSZones(spec.Network.DNSZones, []vmconfig.DNSZone{z})
+	}
+	spec.Network.Egress.Default = command.String("egress-default")
+	for _, egress := range command.StringSlice("egress") {
+		r, err := vmconfig.ParseEgressRule(egress)
+		if err != nil {
+			return nil, err
+		}
+		spec.Network.Egress.Rules = append(spec.Network.Egress.Rules, r)
+	}
+	spec.Network.DNS = vmconfig.Resolver{
+		Nameservers: command.StringSlice("dns"),
+		Search:      command.StringSlice("dns-search"),
+		Options:     command.StringSlice("dns-option"),
+	}
+
+	for _, bootStage := range command.StringSlice("boot-stage") {
+		stage, err := vmconfig.ParseBootStage(bootStage)
+		if err != nil {
+			return nil, err
+		}
+		spec.BootStages = vmconfig.MergeBootStages(spec.BootStages, []vmconfig.BootStage{stage})
+	}
+
+	for _, publish := range command.StringSlice("publish") {
+		port, err := vmconfig.ParsePortMapping(publish)
+		if err != nil {
+			return nil, err
+		}
+		spec.Ports = append(spec.Ports, port)
+	}
+
+	for _, flag := range []struct{ name, direction string }{
+		{"forward-socket", vmconfig.SocketForward},
+		{"publish-socket", vmconfig.SocketPublish},
+	} {
+		for _, socket := range command.StringSlice(flag.name) {
+			m, err := vmconfig.ParseSocketMapping(socket, flag.direction)
+			if err != nil {
+				return nil, err
+			}
+			spec.Sockets = append(spec.Sockets, m)
+		}
+	}
+
+	// relative paths are given against the working dir of revm
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get working dir: %w", err)
+	}
+	spec.ResolvePaths(cwd)
+
+	return spec, nil
+}
+
+// boolFlag is nil unless the flag is set, so --flag=false overrides the spec
+// file
+func boolFlag(command *cli.Command, name string) *bool {
+	if !command.IsSet(name) {
+		return nil
+	}
+	b := command.Bool(name)
+	return &b
+}
+
+// cmdlineFromSpec builds the guest cmdline, when the vm boots the bootstrap
+// runs first and execs it within the rootfs
+func cmdlineFromSpec(spec *vmconfig.Spec) vmconfig.Cmdline {
+	return vmconfig.Cmdline{
+		Workspace:     spec.Workdir,
+		TargetBin:     spec.Command[0],
+		TargetBinArgs: spec.Command[1:],
+		Env:           spec.Envs,
+		User:          spec.User,
+		Group:         spec.Group,
+	}
+}
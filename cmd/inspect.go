@@ -0,0 +1,50 @@
+//go:build darwin
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"linuxvm/pkg/state"
+	"os"
+
+	"github.com/urfave/cli/v3"
+)
+
+var inspectCommand = &cli.Command{
+	Name:      "inspect",
+	Usage:     "show the config and status of a named vm",
+	UsageText: "inspect <name>",
+	Action:    InspectVM,
+}
+
+type inspectResponse struct {
+	Dir    string
+	Config *state.Config
+	Status *state.Status
+}
+
+func InspectVM(ctx context.Context, command *cli.Command) error {
+	_, vm, err := lookupVM(command)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := vm.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	st, err := vm.Status()
+	if err != nil {
+		return err
+	}
+
+	coder := json.NewEncoder(os.Stdout)
+	coder.SetIndent("", "  ")
+	return coder.Encode(inspectResponse{
+		Dir:    vm.Dir,
+		Config: cfg,
+		Status: st,
+	})
+}
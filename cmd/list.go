@@ -0,0 +1,48 @@
+//go:build darwin
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"linuxvm/pkg/state"
+	"os"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v3"
+)
+
+var listCommand = &cli.Command{
+	Name:    "list",
+	Aliases: []string{"ls"},
+	Usage:   "list named vms",
+	Action:  ListVM,
+}
+
+func ListVM(ctx context.Context, command *cli.Command) error {
+	store, err := state.NewStore()
+	if err != nil {
+		return err
+	}
+
+	vms, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintln(w, "NAME\tSTATUS\tCPUS\tMEMORY\tROOTFS")
+	for _, vm := range vms {
+		cfg, err := vm.LoadConfig()
+		if err != nil {
+			return err
+		}
+		st, err := vm.Status()
+		if err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%d\t%dMB\t%s\n", vm.Name, st.State, cfg.VMConfig.Cpus, cfg.VMConfig.MemoryInMB, cfg.VMConfig.RootFS)
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,131 @@
+//go:build darwin
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"linuxvm/pkg/define"
+	"linuxvm/pkg/network"
+	"linuxvm/pkg/vmconfig"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v3"
+)
+
+var pcapCommand = &cli.Command{
+	Name:  "pcap",
+	Usage: "capture the traffic of a running vm to a pcap file",
+	Commands: []*cli.Command{
+		{
+			Name:      "start",
+			Usage:     "start capturing, a running capture is restarted",
+			UsageText: "pcap start [flags] <name>",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "file",
+					Usage: "pcap file (default: capture.pcap in the vm state dir)",
+				},
+				&cli.IntFlag{
+					Name:  "max-size",
+					Usage: "rotate the pcap file once it grows beyond the size in MB, 0 never rotates",
+				},
+				&cli.IntFlag{
+					Name:  "max-files",
+					Usage: "how many rotated pcap files FILE.1 ... FILE.N are kept (default: 1)",
+				},
+			},
+			Action: StartCapture,
+		},
+		{
+			Name:      "stop",
+			Usage:     "stop capturing",
+			UsageText: "pcap stop <name>",
+			Action:    StopCapture,
+		},
+		{
+			Name:      "status",
+			Usage:     "show the capture of a running vm",
+			UsageText: "pcap status <name>",
+			Action:    CaptureStatus,
+		},
+	},
+}
+
+func StartCapture(ctx context.Context, command *cli.Command) error {
+	client, file, err := captureClient(command)
+	if err != nil {
+		return err
+	}
+
+	if f := command.String("file"); f != "" {
+		if file, err = filepath.Abs(f); err != nil {
+			return fmt.Errorf("failed to get absolute path: %w", err)
+		}
+	}
+
+	st, err := client.Start(ctx, vmconfig.Capture{
+		File:      file,
+		MaxSizeMB: command.Int("max-size"),
+		MaxFiles:  command.Int("max-files"),
+	})
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("capture to %q", st.File)
+	return nil
+}
+
+func StopCapture(ctx context.Context, command *cli.Command) error {
+	client, _, err := captureClient(command)
+	if err != nil {
+		return err
+	}
+
+	st, err := client.Stop(ctx)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("capture stopped, %q has %d bytes", st.File, st.Size)
+	return nil
+}
+
+func CaptureStatus(ctx context.Context, command *cli.Command) error {
+	client, _, err := captureClient(command)
+	if err != nil {
+		return err
+	}
+
+	st, err := client.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !st.Enabled {
+		fmt.Println("capture: off")
+		return nil
+	}
+	fmt.Printf("capture: on\nfile: %s\nsize: %d bytes\n", st.File, st.Size)
+	if st.MaxSizeMB > 0 {
+		fmt.Printf("rotate: every %dMB, keep %d files\n", st.MaxSizeMB, st.MaxFiles)
+	}
+	return nil
+}
+
+// captureClient returns a client of the capture of the running vm named by
+// the first positional arg, and the default capture file of the vm
+func captureClient(command *cli.Command) (*network.CaptureClient, string, error) {
+	vm, _, err := gvproxyVM(command)
+	if err != nil {
+		return nil, "", err
+	}
+
+	client, err := network.NewCaptureClient(vm.GVproxyEndpoint())
+	if err != nil {
+		return nil, "", err
+	}
+	return client, vm.Path(define.CaptureFile), nil
+}
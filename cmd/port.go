@@ -0,0 +1,170 @@
+//go:build darwin
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"linuxvm/pkg/network"
+	"linuxvm/pkg/state"
+	"linuxvm/pkg/vmconfig"
+	"os"
+	"text/tabwriter"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v3"
+)
+
+var portCommand = &cli.Command{
+	Name:  "port",
+	Usage: "manage the ports forwarded to a running vm, changes last until the vm stops",
+	Commands: []*cli.Command{
+		{
+			Name:      "add",
+			Usage:     "forward host ports to a running vm",
+			UsageText: "port add <name> [hostIP:]hostPort:guestPort[/udp]...",
+			Action:    AddPort,
+		},
+		{
+			Name:      "rm",
+			Usage:     "stop forwarding host ports to a running vm",
+			UsageText: "port rm <name> [hostIP:]hostPort[/udp]...",
+			Action:    RemovePort,
+		},
+		{
+			Name:      "ls",
+			Usage:     "list the ports forwarded to a running vm",
+			UsageText: "port ls <name>",
+			Action:    ListPort,
+		},
+	},
+}
+
+func AddPort(ctx context.Context, command *cli.Command) error {
+	if command.Args().Len() < 2 {
+		return fmt.Errorf("no port provided")
+	}
+
+	client, err := forwarderClient(command)
+	if err != nil {
+		return err
+	}
+
+	forwarded, err := client.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	var ports []vmconfig.PortMapping
+	for _, arg := range command.Args().Tail() {
+		p, err := vmconfig.ParsePortMapping(arg)
+		if err != nil {
+			return err
+		}
+		if err = network.CheckPortConflict(p, forwarded); err != nil {
+			return err
+		}
+		ports = append(ports, p)
+	}
+
+	// fail before gvproxy does, the forwarded ports are bound by gvproxy and
+	// only checked for conflicts
+	if err = network.CheckPortMappings(ports); err != nil {
+		return err
+	}
+
+	for _, p := range ports {
+		if err = client.Expose(ctx, p); err != nil {
+			return err
+		}
+		logrus.Infof("port %s forwarded", p)
+	}
+
+	return nil
+}
+
+func RemovePort(ctx context.Context, command *cli.Command) error {
+	if command.Args().Len() < 2 {
+		return fmt.Errorf("no port provided")
+	}
+
+	client, err := forwarderClient(command)
+	if err != nil {
+		return err
+	}
+
+	for _, arg := range command.Args().Tail() {
+		p, err := vmconfig.ParseHostPort(arg)
+		if err != nil {
+			return err
+		}
+		if err = client.Unexpose(ctx, p); err != nil {
+			return err
+		}
+		logrus.Infof("port %s/%s removed", p.HostAddr(), p.Protocol)
+	}
+
+	return nil
+}
+
+func ListPort(ctx context.Context, command *cli.Command) error {
+	client, err := forwarderClient(command)
+	if err != nil {
+		return err
+	}
+
+	ports, err := client.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	_, _ = fmt.Fprintln(w, "HOST\tGUEST PORT\tPROTOCOL")
+	for _, p := range ports {
+		_, _ = fmt.Fprintf(w, "%s\t%d\t%s\n", p.HostAddr(), p.GuestPort, p.Protocol)
+	}
+
+	return w.Flush()
+}
+
+// forwarderClient returns a client of the gvproxy of the running vm named by
+// the first positional arg
+func forwarderClient(command *cli.Command) (*network.ForwarderClient, error) {
+	vm, cfg, err := gvproxyVM(command)
+	if err != nil {
+		return nil, err
+	}
+
+	return network.NewForwarderClient(vm.GVproxyEndpoint(), cfg.VMConfig.Network.GuestIP)
+}
+
+// gvproxyVM returns the running vm named by the first positional arg, whose
+// network is served by the gvproxy of its revm process
+func gvproxyVM(command *cli.Command) (*state.VM, *state.Config, error) {
+	_, vm, err := lookupVM(command)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	st, err := vm.Status()
+	if err != nil {
+		return nil, nil, err
+	}
+	if st.State != state.Running {
+		return nil, nil, fmt.Errorf("vm %q is not running", vm.Name)
+	}
+
+	cfg, err := vm.LoadConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	// vms created before the network was configurable have it empty
+	if err = cfg.VMConfig.Network.SetDefaults(); err != nil {
+		return nil, nil, err
+	}
+	if cfg.VMConfig.Network.Mode != vmconfig.NetGVproxy {
+		return nil, nil, fmt.Errorf("vm %q runs in network mode %s, only %s is supported", vm.Name, cfg.VMConfig.Network.Mode, vmconfig.NetGVproxy)
+	}
+
+	return vm, cfg, nil
+}
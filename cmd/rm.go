@@ -0,0 +1,81 @@
+//go:build darwin
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"linuxvm/pkg/state"
+	"linuxvm/pkg/system"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v3"
+)
+
+var rmCommand = &cli.Command{
+	Name:      "rm",
+	Usage:     "remove a named vm and its state dir",
+	UsageText: "rm [flags] <name>",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:    "force",
+			Aliases: []string{"f"},
+			Usage:   "stop the vm first if it is running",
+		},
+	},
+	Action: RemoveVM,
+}
+
+func RemoveVM(ctx context.Context, command *cli.Command) error {
+	store, vm, err := lookupVM(command)
+	if err != nil {
+		return err
+	}
+
+	st, err := vm.Status()
+	if err != nil {
+		return err
+	}
+
+	if st.State == state.Running {
+		if !command.Bool("force") {
+			return fmt.Errorf("vm %q is running, stop it first or use --force", vm.Name)
+		}
+		if err = stopVM(ctx, vm, stopTimeout); err != nil {
+			return err
+		}
+		if system.IsProcessAlive(st.PID) {
+			return fmt.Errorf("vm %q is still running as pid %d, it is not removed", vm.Name, st.PID)
+		}
+	}
+
+	// the revm process running the vm holds the lock until it is gone, so the
+	// state dir is not removed under a vm starting or cleaning up
+	unlock, err := vm.Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if st, err = vm.Status(); err != nil {
+		return err
+	}
+	if st.State == state.Running {
+		return fmt.Errorf("vm %q is running, stop it first or use --force", vm.Name)
+	}
+
+	if err = store.Remove(vm.Name); err != nil {
+		return fmt.Errorf("failed to remove vm %q: %w", vm.Name, err)
+	}
+
+	ipam, err := newIPAM()
+	if err != nil {
+		return err
+	}
+	if err = ipam.Release(vm.Name); err != nil {
+		return fmt.Errorf("failed to release the network of vm %q: %w", vm.Name, err)
+	}
+
+	logrus.Infof("vm %q removed", vm.Name)
+	return nil
+}
@@ -0,0 +1,432 @@
+//go:build darwin
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"linuxvm/pkg/define"
+	"linuxvm/pkg/network"
+	"linuxvm/pkg/sshkey"
+	"linuxvm/pkg/state"
+	"linuxvm/pkg/system"
+	"linuxvm/pkg/vmconfig"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v3"
+	"golang.org/x/sync/errgroup"
+)
+
+var runCommand = &cli.Command{
+	Name:      "run",
+	Usage:     "run a one-shot vm which is not kept in the state dir",
+	UsageText: "run [flags] [-- <cmdline>]",
+	Flags:     append(vmFlags(), keepFlag()),
+	Action:    RunVM,
+}
+
+// keepFlag disables the cleanup of the files revm creates to boot a vm
+func keepFlag() cli.Flag {
+	return &cli.BoolFlag{
+		Name:  "keep",
+		Usage: "keep the sockets, temp dirs and rootfs files created by revm after the vm exits, for debugging",
+	}
+}
+
+func RunVM(ctx context.Context, command *cli.Command) error {
+	spec, err := loadSpec(command, command.Args().Slice())
+	if err != nil {
+		return err
+	}
+
+	tracker, err := state.NewTracker(command.Bool("keep"))
+	if err != nil {
+		return err
+	}
+	defer cleanup(tracker)
+
+	tmpdir, err := os.MkdirTemp("", "gvproxy")
+	if err != nil {
+		return fmt.Errorf("failed to create temp dir: %v", err)
+	}
+	if err = tracker.Track(tmpdir); err != nil {
+		return err
+	}
+
+	ipam, err := newIPAM()
+	if err != nil {
+		return err
+	}
+	vmc := spec.VMConfig()
+	if vmc.Network, err = ipam.Allocate("", os.Getpid(), spec.Network); err != nil {
+		return err
+	}
+	defer func() {
+		if err := ipam.ReleasePID(os.Getpid()); err != nil {
+			logrus.Warnf("failed to release the network lease: %v", err)
+		}
+	}()
+
+	vmc.GVproxyEndpoint = fmt.Sprintf("unix://%s/%s", tmpdir, define.GVproxyControlSocket)
+	vmc.NetworkStackBackend = fmt.Sprintf("unixgram://%s/%s", tmpdir, define.NetworkBackendSocket)
+	vmc.ControlSocket = filepath.Join(tmpdir, define.ControlSocket)
+	vmc.AgentSocket = filepath.Join(tmpdir, define.AgentSocket)
+
+	cfg := &state.Config{
+		CreatedAt: time.Now(),
+		VMConfig:  vmc,
+		Cmdline:   cmdlineFromSpec(spec),
+	}
+
+	exitCode, err := bootVM(ctx, tmpdir, cfg, tracker)
+	if err != nil {
+		return err
+	}
+
+	return exitWith(exitCode)
+}
+
+func cleanup(tracker *state.Tracker) {
+	if err := tracker.Cleanup(); err != nil {
+		logrus.Warnf("failed to cleanup: %v", err)
+	}
+}
+
+// exitWith makes revm exit with the exit status of the guest cmdline
+func exitWith(exitCode int) error {
+	if exitCode == 0 {
+		return nil
+	}
+	return cli.Exit("", exitCode)
+}
+
+// bootVM starts the networking and the ign server, then boots the vm in a vmm
+// child process. On SIGINT/SIGTERM the guest is asked to shut down orderly,
+// the networking is torn down after the vmm exits. The runtime files of the vm
+// are kept in runDir, every file created for the vm is recorded by tracker.
+// It returns the exit status of the guest cmdline.
+func bootVM(ctx context.Context, runDir string, cfg *state.Config, tracker *state.Tracker) (int, error) {
+	vmc := cfg.VMConfig
+	vmc.ShareDir = filepath.Join(runDir, define.ShareDir)
+
+	err := system.Rlimit()
+	if err != nil {
+		logrus.Infof("failed to set rlimit: %v", err)
+		return define.ExitCodeRevmError, err
+	}
+
+	// vms created before the network was configurable have it empty
+	if err = vmc.Network.SetDefaults(); err != nil {
+		return define.ExitCodeRevmError, err
+	}
+	if vmc.Network.Mode != vmconfig.NetNone {
+		if err = network.CheckSubnet(vmc.Network.Subnet); err != nil {
+			return define.ExitCodeRevmError, err
+		}
+	}
+
+	// imported when the vm boots, so the guest sees the current entries, the
+	// entries given by the user win
+	if vmc.Network.IsImportHosts() {
+		imported, err := network.ParseHostsFile("/etc/hosts")
+		if err != nil {
+			return define.ExitCodeRevmError, err
+		}
+		vmc.Network.Hosts = vmconfig.MergeHosts(imported, vmc.Network.Hosts)
+	}
+
+	// derived when the vm boots as well, the host may have changed networks
+	vmc.Resolver = network.GuestResolver(vmc.Network)
+
+	if vmc.SSH.Enabled() {
+		if err = setupSSH(runDir, &vmc, cfg.Cmdline); err != nil {
+			return define.ExitCodeRevmError, err
+		}
+	}
+
+	// fail before booting instead of gvproxy failing to forward a port later
+	if err = network.CheckPortMappings(vmc.Ports); err != nil {
+		return define.ExitCodeRevmError, err
+	}
+
+	if err = trackSockets(tracker, vmc); err != nil {
+		return define.ExitCodeRevmError, err
+	}
+
+	cmdline, err := prepareBootstrap(&vmc, cfg.Cmdline, tracker)
+	if err != nil {
+		return define.ExitCodeRevmError, err
+	}
+
+	logrus.Infof("set memory to: %v", vmc.MemoryInMB)
+	logrus.Infof("set cpus to: %v", vmc.Cpus)
+	logrus.Infof("set rootfs to: %v", vmc.RootFS)
+	logrus.Infof("set gvproxy control: %q", vmc.GVproxyEndpoint)
+	logrus.Infof("set network backend: %q", vmc.NetworkStackBackend)
+	logrus.Infof("set control socket: %q", vmc.ControlSocket)
+	logrus.Infof("set agent socket: %q", vmc.AgentSocket)
+	logrus.Infof("set revm share: %q", vmc.ShareDir)
+	logrus.Infof("set envs: %v", cmdline.Env)
+	logrus.Infof("set data disk: %v", vmc.DataDisk)
+	logrus.Infof("set network: %+v", vmc.Network)
+	logrus.Infof("set published ports: %v", vmc.Ports)
+	logrus.Infof("set guest resolver: %+v", vmc.Resolver)
+	logrus.Infof("set sockets: %v", vmc.Sockets)
+	logrus.Infof("set ssh: mode %q, user %q, port %d", vmc.SSH.Mode, vmc.SSH.User, vmc.SSH.HostPort)
+	logrus.Infof("set cmdline: %q, %q", cmdline.TargetBin, cmdline.TargetBinArgs)
+
+	// the vmm inherits its end of the passt socket as the first extra file
+	var passt *network.Passt
+	var extraFiles []*os.File
+	if vmc.Network.Mode == vmconfig.NetPasst {
+		if passt, err = network.NewPasst(vmc); err != nil {
+			return define.ExitCodeRevmError, err
+		}
+		defer passt.VMMFile().Close() //nolint:errcheck
+		extraFiles = append(extraFiles, passt.VMMFile())
+		vmc.PasstFD = 3
+	}
+
+	// the vmm boots exactly what is written here
+	runtimeConfig := filepath.Join(runDir, define.RuntimeConfig)
+	if err = tracker.Track(runtimeConfig); err != nil {
+		return define.ExitCodeRevmError, err
+	}
+	runtimeCfg := &state.Config{
+		Name:      cfg.Name,
+		CreatedAt: cfg.CreatedAt,
+		VMConfig:  vmc,
+		Cmdline:   cmdline,
+	}
+	if err = runtimeCfg.WriteToFile(runtimeConfig); err != nil {
+		return define.ExitCodeRevmError, err
+	}
+
+	// the networking is not bound to ctx, it must outlive the vm
+	netCtx, stopNetworking := context.WithCancel(context.Background())
+	g, netCtx := errgroup.WithContext(netCtx)
+
+	exitCode, err := define.ExitCodeRevmError, startNetworking(netCtx, g, vmc, passt)
+	if err == nil {
+		exitCode, err = runVMM(ctx, netCtx, runtimeConfig, extraFiles, tracker)
+	}
+
+	logrus.Infof("vm exit with code %d, stop networking", exitCode)
+	stopNetworking()
+	if gErr := g.Wait(); gErr != nil {
+		logrus.Warnf("networking exit with error: %v", gErr)
+	}
+
+	return exitCode, err
+}
+
+// startNetworking starts the backend of the network mode in g and waits for
+// it to be ready
+func startNetworking(ctx context.Context, g *errgroup.Group, vmc vmconfig.VMConfig, passt *network.Passt) error {
+	switch vmc.Network.Mode {
+	case vmconfig.NetNone:
+		logrus.Infof("network mode %s, the guest has no network", vmc.Network.Mode)
+		return nil
+	case vmconfig.NetPasst:
+		g.Go(func() error {
+			return passt.Run(ctx)
+		})
+		return nil
+	default:
+		g.Go(func() error {
+			return network.StartNetworking(ctx, vmc)
+		})
+		return waitNetworkBackend(ctx, vmc.NetworkStackBackend)
+	}
+}
+
+// setupSSH authorizes the key of the vm, kept in runDir, and publishes the
+// guest ssh port on 127.0.0.1, a free port if the user gave none
+func setupSSH(runDir string, vmc *vmconfig.VMConfig, cmdline vmconfig.Cmdline) error {
+	key, err := sshkey.Ensure(filepath.Join(runDir, define.SSHKey))
+	if err != nil {
+		return err
+	}
+	vmc.SSH.AuthorizedKey = key
+
+	if vmc.SSH.User == "" {
+		vmc.SSH.User = cmdline.User
+	}
+	if vmc.SSH.User == "" {
+		vmc.SSH.User = "root"
+	}
+
+	if vmc.SSH.HostPort == 0 {
+		if vmc.SSH.HostPort, err = freePort(); err != nil {
+			return err
+		}
+	}
+	vmc.Ports = append(vmc.Ports, vmconfig.PortMapping{
+		HostIP:    "127.0.0.1",
+		HostPort:  vmc.SSH.HostPort,
+		GuestPort: define.SSHGuestPort,
+		Protocol:  vmconfig.TCP,
+	})
+	return nil
+}
+
+// freePort returns a tcp port of 127.0.0.1 nobody listens on
+func freePort() (uint16, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, fmt.Errorf("failed to find a free port: %w", err)
+	}
+	defer ln.Close() //nolint:errcheck
+	return uint16(ln.Addr().(*net.TCPAddr).Port), nil
+}
+
+func trackSockets(tracker *state.Tracker, vmc vmconfig.VMConfig) error {
+	for _, endpoint := range []string{vmc.GVproxyEndpoint, vmc.NetworkStackBackend} {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return fmt.Errorf("failed to parse url: %w", err)
+		}
+		if err = tracker.Track(u.Path); err != nil {
+			return err
+		}
+	}
+	for _, sock := range []string{vmc.ControlSocket, vmc.AgentSocket} {
+		if sock == "" {
+			continue
+		}
+		if err := tracker.Track(sock); err != nil {
+			return err
+		}
+	}
+
+	// libkrun listens on the host path of a published socket, a socket left
+	// by a vm which did not exit cleanly is removed
+	for _, sock := range vmc.Sockets {
+		if sock.Direction != vmconfig.SocketPublish {
+			continue
+		}
+		if fi, err := os.Lstat(sock.HostPath); err == nil {
+			if fi.Mode()&os.ModeSocket == 0 {
+				return fmt.Errorf("can not publish socket on %q, the file exists", sock.HostPath)
+			}
+			if err = os.Remove(sock.HostPath); err != nil {
+				return fmt.Errorf("failed to remove stale socket: %w", err)
+			}
+		}
+		if err := tracker.Track(sock.HostPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitNetworkBackend waits for gvproxy to listen on the network backend
+// socket, libkrun fails to boot if the socket does not exist
+func waitNetworkBackend(ctx context.Context, endpoint string) error {
+	backend, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("failed to parse url: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for !system.IsPathExist(backend.Path) {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("network backend %q is not ready: %w", backend.Path, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+// runVMM runs the vmm child process with extraFiles inherited from fd 3 on,
+// and waits for it. The first SIGINT/SIGTERM,
+// or a networking failure, is forwarded to the vmm as SIGTERM to shut down the
+// guest orderly, the second one kills the vmm.
+func runVMM(ctx, netCtx context.Context, configFile string, extraFiles []*os.File, tracker *state.Tracker) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return define.ExitCodeRevmError, fmt.Errorf("failed to get executable path: %w", err)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	cmd := exec.Command(exe, vmmCommand.Name, "--config", configFile)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = extraFiles
+	if err = cmd.Start(); err != nil {
+		return define.ExitCodeRevmError, fmt.Errorf("failed to start vmm: %w", err)
+	}
+	if err = tracker.AddPID(cmd.Process.Pid); err != nil {
+		logrus.Warnf("%v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	stopping := false
+	stopVMM := func(reason string) {
+		if stopping {
+			logrus.Warnf("%s, kill the vmm", reason)
+			_ = cmd.Process.Kill()
+			return
+		}
+		stopping = true
+		logrus.Infof("%s, shutdown the vm", reason)
+		_ = cmd.Process.Signal(syscall.SIGTERM)
+	}
+
+	ctxDone, netDone := ctx.Done(), netCtx.Done()
+	for {
+		select {
+		case err = <-done:
+			return vmmExitCode(err)
+		case sig := <-sigs:
+			stopVMM(fmt.Sprintf("received %v", sig))
+		case <-ctxDone:
+			ctxDone = nil
+			stopVMM("context canceled")
+		case <-netDone:
+			netDone = nil
+			stopVMM("networking stopped")
+		}
+	}
+}
+
+func vmmExitCode(err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return define.ExitCodeRevmError, fmt.Errorf("failed to wait vmm: %w", err)
+	}
+
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return define.ExitCodeSignalBase + int(status.Signal()), nil
+	}
+
+	return exitErr.ExitCode(), nil
+}
@@ -0,0 +1,154 @@
+//go:build darwin
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"linuxvm/pkg/bootstrap"
+	"linuxvm/pkg/define"
+	"linuxvm/pkg/state"
+	"linuxvm/pkg/system"
+	"linuxvm/pkg/vmconfig"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// trampoline mounts the revm share and execs the bootstrap from it, $@ is
+	// the guest cmdline
+	trampoline = `mkdir -p %[1]s && %[2]s -t virtiofs %[3]s %[1]s && exec %[1]s/%[4]s "$@"`
+)
+
+// mountBins are the paths of mount(8) looked up in the rootfs
+var mountBins = []string{"/bin/mount", "/usr/bin/mount", "/sbin/mount", "/usr/sbin/mount"}
+
+// prepareBootstrap puts the bootstrap and vmconfig.json where the guest loads
+// them, and returns the cmdline which runs cmdline through the bootstrap.
+//
+// The rootfs is left untouched: /bin/sh of the rootfs mounts the revm share
+// and execs the bootstrap from it. Only if the rootfs has no shell or mount
+// the bootstrap is copied into the rootfs, which must be writable then.
+func prepareBootstrap(vmc *vmconfig.VMConfig, cmdline vmconfig.Cmdline, tracker *state.Tracker) (vmconfig.Cmdline, error) {
+	// the bootstrap enters the workdir of the cmdline once the mounts are up
+	wrapped := vmconfig.Cmdline{
+		Workspace: "/",
+		Env:       cmdline.Env,
+	}
+
+	if err := validateCredential(vmc.RootFS, cmdline); err != nil {
+		return wrapped, err
+	}
+
+	arch, err := bootstrap.DetectArch(vmc.RootFS)
+	if err != nil {
+		return wrapped, err
+	}
+	if arch != runtime.GOARCH {
+		logrus.Warnf("rootfs arch %q differs from host arch %q, the vm may fail to boot", arch, runtime.GOARCH)
+	}
+
+	mountBin := findMountBin(vmc.RootFS)
+	if _, hasShell := system.LookupInRootFS(vmc.RootFS, "/bin/sh"); hasShell && mountBin != "" {
+		if err = os.MkdirAll(vmc.ShareDir, 0755); err != nil {
+			return wrapped, fmt.Errorf("failed to create share dir: %w", err)
+		}
+
+		// the share is owned by revm, the bootstrap is kept there across boots
+		if err = installBootstrap(vmc, arch, filepath.Join(vmc.ShareDir, define.BootstrapBin), filepath.Join(vmc.ShareDir, define.VMConfig)); err != nil {
+			return wrapped, err
+		}
+
+		wrapped.TargetBin = "/bin/sh"
+		wrapped.TargetBinArgs = []string{
+			"-c", fmt.Sprintf(trampoline, define.GuestShareDir, mountBin, define.ShareTag, define.BootstrapBin),
+			define.BootstrapBin,
+		}
+		wrapped.TargetBinArgs = append(wrapped.TargetBinArgs, bootstrapArgs(cmdline)...)
+		return wrapped, nil
+	}
+
+	logrus.Warnf("rootfs %q has no /bin/sh or mount, copy the bootstrap into the rootfs", vmc.RootFS)
+	if !system.IsWritable(vmc.RootFS) {
+		return wrapped, fmt.Errorf("rootfs %q is read-only and has no /bin/sh or mount to load the bootstrap from the revm share", vmc.RootFS)
+	}
+
+	// the files of crashed revm processes are gone by now, an existing file
+	// belongs to a running vm or to the rootfs itself and is left alone
+	vmc.ShareDir = ""
+	legacyBootstrap := "/bootstrap-" + arch
+	for _, file := range []string{legacyBootstrap, define.VMConfig} {
+		err = tracker.Claim(filepath.Join(vmc.RootFS, file), 0644)
+		if errors.Is(err, os.ErrExist) {
+			return wrapped, fmt.Errorf("rootfs %q has a %s already, it is used by another vm or belongs to the rootfs", vmc.RootFS, file)
+		}
+		if err != nil {
+			return wrapped, fmt.Errorf("failed to create %s in the rootfs: %w", file, err)
+		}
+	}
+	if err = installBootstrap(vmc, arch, filepath.Join(vmc.RootFS, legacyBootstrap), filepath.Join(vmc.RootFS, define.VMConfig)); err != nil {
+		return wrapped, err
+	}
+
+	wrapped.TargetBin = legacyBootstrap
+	wrapped.TargetBinArgs = bootstrapArgs(cmdline)
+	return wrapped, nil
+}
+
+// installBootstrap writes the bootstrap of arch and vmconfig.json, the
+// bootstrap loads vmconfig.json from its own dir
+func installBootstrap(vmc *vmconfig.VMConfig, arch, bootstrapFile, configFile string) error {
+	if err := bootstrap.Install(arch, bootstrapFile); err != nil {
+		return fmt.Errorf("failed to install bootstrap: %w", err)
+	}
+
+	if err := vmc.WriteToJsonFile(configFile); err != nil {
+		return fmt.Errorf("failed to write vmconfig to json file: %w", err)
+	}
+
+	return nil
+}
+
+// bootstrapArgs are the args of the bootstrap to run cmdline, see
+// cmd/bootstrap
+func bootstrapArgs(cmdline vmconfig.Cmdline) []string {
+	args := []string{"--workdir", cmdline.Workspace}
+	if cmdline.User != "" {
+		args = append(args, "--user", cmdline.User)
+	}
+	if cmdline.Group != "" {
+		args = append(args, "--group", cmdline.Group)
+	}
+	args = append(args, "--", cmdline.TargetBin)
+	return append(args, cmdline.TargetBinArgs...)
+}
+
+// validateCredential fails early if the user or group of cmdline does not
+// exist in the rootfs, the bootstrap resolves them again in the guest
+func validateCredential(rootfs string, cmdline vmconfig.Cmdline) error {
+	if cmdline.User == "" && cmdline.Group == "" {
+		return nil
+	}
+
+	passwdFile, _ := system.LookupInRootFS(rootfs, "/etc/passwd")
+	groupFile, _ := system.LookupInRootFS(rootfs, "/etc/group")
+	cred, err := system.LookupCredential(passwdFile, groupFile, cmdline.User, cmdline.Group)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("run cmdline as uid %d, gid %d, groups %v", cred.UID, cred.GID, cred.Groups)
+	return nil
+}
+
+func findMountBin(rootfs string) string {
+	for _, bin := range mountBins {
+		if _, find := system.LookupInRootFS(rootfs, bin); find {
+			return bin
+		}
+	}
+	return ""
+}
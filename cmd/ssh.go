@@ -0,0 +1,75 @@
+//go:build darwin
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"linuxvm/pkg/define"
+	"linuxvm/pkg/state"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/urfave/cli/v3"
+)
+
+var sshCommand = &cli.Command{
+	Name:      "ssh",
+	Usage:     "log in to a running vm created with --ssh, or run a command in it",
+	UsageText: "ssh <name> [-- <cmdline>]",
+	Action:    SSHVM,
+}
+
+// SSHVM runs the ssh client of the host with the key of the vm on the port
+// the vm was booted with, revm exits with the exit status of ssh
+func SSHVM(ctx context.Context, command *cli.Command) error {
+	_, vm, err := lookupVM(command)
+	if err != nil {
+		return err
+	}
+
+	st, err := vm.Status()
+	if err != nil {
+		return err
+	}
+	if st.State != state.Running {
+		return fmt.Errorf("vm %q is not running", vm.Name)
+	}
+
+	// the runtime config has the user and the port resolved at boot
+	cfg, err := state.LoadConfigFile(vm.Path(define.RuntimeConfig))
+	if err != nil {
+		return err
+	}
+	s := cfg.VMConfig.SSH
+	if !s.Enabled() {
+		return fmt.Errorf("vm %q has no ssh, create it with --ssh", vm.Name)
+	}
+
+	// the host key of the guest is not stable, e.g. the builtin server
+	// generates it per boot, the forwarded port only listens on 127.0.0.1
+	args := []string{
+		"-i", vm.Path(define.SSHKey),
+		"-p", strconv.Itoa(int(s.HostPort)),
+		"-o", "IdentitiesOnly=yes",
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "LogLevel=ERROR",
+		s.User + "@127.0.0.1",
+	}
+	args = append(args, command.Args().Tail()...)
+
+	cmd := exec.CommandContext(ctx, "ssh", args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitWith(exitErr.ExitCode())
+	}
+	return err
+}
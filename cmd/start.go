@@ -0,0 +1,87 @@
+//go:build darwin
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"linuxvm/pkg/define"
+	"linuxvm/pkg/state"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v3"
+)
+
+var startCommand = &cli.Command{
+	Name:      "start",
+	Usage:     "boot a named vm in the foreground",
+	UsageText: "start [flags] <name>",
+	Flags:     []cli.Flag{keepFlag()},
+	Action:    StartVM,
+}
+
+func StartVM(ctx context.Context, command *cli.Command) error {
+	_, vm, err := lookupVM(command)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := vm.Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	cfg, err := vm.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	logFile, err := os.OpenFile(vm.Path(define.InstanceLog), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	defer logFile.Close() //nolint:errcheck
+	logrus.SetOutput(io.MultiWriter(os.Stderr, logFile))
+
+	tracker, err := state.NewTracker(command.Bool("keep"))
+	if err != nil {
+		return err
+	}
+	defer cleanup(tracker)
+
+	// we hold the lock, so sockets left by a previous run are stale
+	for _, sock := range []string{define.GVproxyControlSocket, define.NetworkBackendSocket, define.ControlSocket, define.AgentSocket} {
+		if err = os.Remove(vm.Path(sock)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	}
+
+	st := &state.Status{
+		State:     state.Running,
+		PID:       os.Getpid(),
+		StartedAt: time.Now(),
+	}
+	if err = vm.SaveStatus(st); err != nil {
+		return err
+	}
+
+	exitCode, bootErr := bootVM(ctx, vm.Dir, cfg, tracker)
+
+	st.State = state.Stopped
+	st.PID = 0
+	st.StoppedAt = time.Now()
+	st.ExitCode = exitCode
+	if err = vm.SaveStatus(st); err != nil {
+		logrus.Errorf("failed to save status: %v", err)
+	}
+
+	if bootErr != nil {
+		return bootErr
+	}
+
+	return exitWith(exitCode)
+}
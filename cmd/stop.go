@@ -0,0 +1,101 @@
+//go:build darwin
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"linuxvm/pkg/define"
+	"linuxvm/pkg/state"
+	"linuxvm/pkg/system"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v3"
+)
+
+const (
+	// stopTimeout is how long to wait for the guest to shut down before the
+	// revm process is killed
+	stopTimeout = 30 * time.Second
+	// killTimeout is how long to wait for the revm process to disappear after SIGKILL
+	killTimeout = 5 * time.Second
+)
+
+var stopCommand = &cli.Command{
+	Name:      "stop",
+	Usage:     "stop a running vm",
+	UsageText: "stop [flags] <name>",
+	Flags: []cli.Flag{
+		&cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "wait for the vm to stop before killing it",
+			Value: stopTimeout,
+		},
+	},
+	Action: StopVM,
+}
+
+func StopVM(ctx context.Context, command *cli.Command) error {
+	_, vm, err := lookupVM(command)
+	if err != nil {
+		return err
+	}
+
+	return stopVM(ctx, vm, command.Duration("timeout"))
+}
+
+// stopVM sends SIGTERM to the revm process running the vm, which asks the
+// guest to shut down orderly, and SIGKILL if it is still alive after timeout
+func stopVM(ctx context.Context, vm *state.VM, timeout time.Duration) error {
+	st, err := vm.Status()
+	if err != nil {
+		return err
+	}
+
+	if st.State != state.Running {
+		return fmt.Errorf("vm %q is not running", vm.Name)
+	}
+
+	logrus.Infof("send SIGTERM to vm %q, pid %d", vm.Name, st.PID)
+	if err = syscall.Kill(st.PID, syscall.SIGTERM); err != nil {
+		return fmt.Errorf("failed to send SIGTERM: %w", err)
+	}
+
+	if waitProcessExit(ctx, st.PID, timeout) {
+		// the revm process saved the status itself
+		return nil
+	}
+
+	logrus.Warnf("vm %q did not stop in %v, send SIGKILL", vm.Name, timeout)
+	if err = syscall.Kill(st.PID, syscall.SIGKILL); err != nil {
+		return fmt.Errorf("failed to send SIGKILL: %w", err)
+	}
+	waitProcessExit(ctx, st.PID, killTimeout)
+
+	st.State = state.Stopped
+	st.PID = 0
+	st.StoppedAt = time.Now()
+	st.ExitCode = define.ExitCodeSignalBase + int(syscall.SIGKILL)
+
+	return vm.SaveStatus(st)
+}
+
+func waitProcessExit(ctx context.Context, pid int, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for system.IsProcessAlive(pid) {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+
+	return true
+}
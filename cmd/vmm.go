@@ -0,0 +1,75 @@
+//go:build darwin
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"linuxvm/pkg/libkrun"
+	"linuxvm/pkg/state"
+	"linuxvm/pkg/system"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v3"
+)
+
+// vmmCommand runs libkrun in a child process of revm, since the VMM calls
+// exit() once the guest is down, the parent revm process outlives the vm to
+// tear down the networking and record the exit status.
+var vmmCommand = &cli.Command{
+	Name:   "vmm",
+	Hidden: true,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "config",
+			Usage:    "the vm config written by the parent revm process",
+			Required: true,
+		},
+	},
+	Action: RunVMM,
+}
+
+func RunVMM(ctx context.Context, command *cli.Command) error {
+	cfg, err := state.LoadConfigFile(command.String("config"))
+	if err != nil {
+		return err
+	}
+
+	if err = system.Rlimit(); err != nil {
+		return fmt.Errorf("failed to set rlimit: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go watchParent(ctx, cancel)
+
+	return libkrun.StartVM(ctx, cfg.VMConfig, cfg.Cmdline)
+}
+
+// watchParent cancels ctx if the parent revm process is gone, e.g. killed by
+// SIGKILL, so the guest still gets a chance to shut down orderly.
+func watchParent(ctx context.Context, cancel context.CancelFunc) {
+	ppid := os.Getppid()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if os.Getppid() != ppid {
+				logrus.Warnf("parent revm process %d is gone, shutdown the vm", ppid)
+				cancel()
+				return
+			}
+		}
+	}
+}
@@ -3,7 +3,10 @@ module linuxvm
 go 1.24
 
 require (
+	github.com/creack/pty v1.1.24
 	github.com/google/uuid v1.6.0
+	github.com/jsimonetti/rtnetlink v1.3.5
+	github.com/mdlayher/netlink v1.7.2
 	github.com/moby/sys/mount v0.3.5-0.20240721113140-2c9636d9130c
 	github.com/moby/sys/mountinfo v0.7.2
 	github.com/pkg/errors v0.9.1
@@ -11,13 +14,12 @@ require (
 	github.com/urfave/cli/v3 v3.3.3-0.20250428204840-66d871f8b5bf
 	golang.org/x/sync v0.14.0
 	golang.org/x/sys v0.33.0
+	sigs.k8s.io/yaml v1.4.0
 )
 
 require (
 	github.com/google/go-cmp v0.7.0 // indirect
 	github.com/josharian/native v1.1.0 // indirect
-	github.com/jsimonetti/rtnetlink v1.3.5 // indirect
-	github.com/mdlayher/netlink v1.7.2 // indirect
 	gvisor.dev/gvisor v0.0.0-20240916094835-a174eb65023f // indirect
 )
 
@@ -30,13 +32,13 @@ require (
 	github.com/insomniacslk/dhcp v0.0.0-20250417080101-5f8cf70e8c5f
 	github.com/linuxkit/virtsock v0.0.0-20220523201153-1a23e78aa7a2 // indirect
 	github.com/mdlayher/socket v0.4.1 // indirect
-	github.com/mdlayher/vsock v1.2.1 // indirect
-	github.com/miekg/dns v1.1.65 // indirect
+	github.com/mdlayher/vsock v1.2.1
+	github.com/miekg/dns v1.1.65
 	github.com/pierrec/lz4/v4 v4.1.22 // indirect; indirecte
 	github.com/u-root/uio v0.0.0-20240224005618-d2acac8f3701 // indirect
-	golang.org/x/crypto v0.38.0 // indirect
+	golang.org/x/crypto v0.38.0
 	golang.org/x/mod v0.24.0 // indirect
-	golang.org/x/net v0.38.0 // indirect
+	golang.org/x/net v0.38.0
 	golang.org/x/time v0.5.0 // indirect
 	golang.org/x/tools v0.30.0 // indirect
 )
@@ -0,0 +1,226 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Client talks to the guest agent through the agent socket of a running vm,
+// every call takes its own connection.
+type Client struct {
+	socketPath string
+}
+
+func NewClient(socketPath string) *Client {
+	return &Client{socketPath: socketPath}
+}
+
+// Info returns the status of the guest
+func (c *Client) Info(ctx context.Context) (*Info, error) {
+	resp, err := c.do(ctx, Request{Method: MethodInfo})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Info == nil {
+		return nil, errors.New("agent sent no info")
+	}
+	return resp.Info, nil
+}
+
+// Processes lists the processes of the guest
+func (c *Client) Processes(ctx context.Context) ([]Process, error) {
+	resp, err := c.do(ctx, Request{Method: MethodProcesses})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Processes, nil
+}
+
+// Shutdown asks the guest to stop the cmdline and power off, it returns once
+// the agent got the request, not when the vm is gone
+func (c *Client) Shutdown(ctx context.Context) error {
+	_, err := c.do(ctx, Request{Method: MethodShutdown})
+	return err
+}
+
+// Exec runs req in the guest with stdin, stdout and stderr, any of them may
+// be nil, and returns its exit status. Canceling ctx kills the process.
+func (c *Client) Exec(ctx context.Context, req ExecRequest, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	if len(req.Args) == 0 {
+		return 0, errors.New("no cmdline to exec")
+	}
+
+	conn, r, err := c.start(ctx, Request{Method: MethodExec, Exec: &req})
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close() //nolint:errcheck
+
+	go sendStdin(conn, stdin)
+
+	status, err := readStreams(ctx, r, stdout, stderr)
+	if err != nil {
+		return 0, err
+	}
+	if status.Error != "" {
+		return status.Code, errors.New(status.Error)
+	}
+	return status.Code, nil
+}
+
+// ReadFile copies the guest file path to w
+func (c *Client) ReadFile(ctx context.Context, path string, w io.Writer) error {
+	conn, r, err := c.start(ctx, Request{Method: MethodRead, File: &FileRequest{Path: path}})
+	if err != nil {
+		return err
+	}
+	defer conn.Close() //nolint:errcheck
+
+	return statusError(readStreams(ctx, r, w, nil))
+}
+
+// WriteFile replaces the guest file path by the content of r, mode 0644 if 0.
+// The file is only replaced once r is read to the end.
+func (c *Client) WriteFile(ctx context.Context, path string, mode uint32, r io.Reader) error {
+	conn, br, err := c.start(ctx, Request{Method: MethodWrite, File: &FileRequest{Path: path, Mode: mode}})
+	if err != nil {
+		return err
+	}
+	defer conn.Close() //nolint:errcheck
+
+	if _, err = io.Copy(NewMux(conn).Stream(StreamStdin), r); err != nil {
+		return fmt.Errorf("failed to send %q: %w", path, err)
+	}
+	if err = WriteFrame(conn, StreamStdin, nil); err != nil {
+		return fmt.Errorf("failed to send %q: %w", path, err)
+	}
+	return statusError(readStreams(ctx, br, nil, nil))
+}
+
+// do sends req and returns the response, for the methods without frames
+func (c *Client) do(ctx context.Context, req Request) (*Response, error) {
+	conn, r, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close() //nolint:errcheck
+
+	return roundTrip(ctx, conn, r, req)
+}
+
+// start sends req and returns the conn to go on with frames once the agent
+// accepted req, the conn is closed when ctx is done
+func (c *Client) start(ctx context.Context, req Request) (net.Conn, *bufio.Reader, error) {
+	conn, r, err := c.dial(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err = roundTrip(ctx, conn, r, req); err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	return conn, r, nil
+}
+
+func (c *Client) dial(ctx context.Context) (net.Conn, *bufio.Reader, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", c.socketPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to the guest agent: %w", err)
+	}
+	// the vm may hang, the calls must not
+	context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	return conn, bufio.NewReader(conn), nil
+}
+
+func roundTrip(ctx context.Context, conn net.Conn, r *bufio.Reader, req Request) (*Response, error) {
+	req.Version = Version
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, ctxError(ctx, fmt.Errorf("failed to send %s request: %w", req.Method, err))
+	}
+
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, ctxError(ctx, fmt.Errorf("failed to read %s response: %w", req.Method, err))
+	}
+	var resp Response
+	if err = json.Unmarshal(line, &resp); err != nil {
+		return nil, fmt.Errorf("invalid %s response: %w", req.Method, err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("%s failed: %s", req.Method, resp.Error)
+	}
+	if resp.Version != Version {
+		return nil, fmt.Errorf("agent speaks protocol version %d, want %d", resp.Version, Version)
+	}
+	return &resp, nil
+}
+
+// sendStdin sends stdin in frames and closes the stream at EOF
+func sendStdin(conn net.Conn, stdin io.Reader) {
+	if stdin != nil {
+		_, _ = io.Copy(NewMux(conn).Stream(StreamStdin), stdin)
+	}
+	_ = WriteFrame(conn, StreamStdin, nil)
+}
+
+// readStreams copies the stdout and stderr frames until the status frame
+func readStreams(ctx context.Context, r io.Reader, stdout, stderr io.Writer) (*Status, error) {
+	for {
+		stream, p, err := ReadFrame(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, ctxError(ctx, fmt.Errorf("failed to read from the guest agent: %w", err))
+		}
+
+		var w io.Writer
+		switch stream {
+		case StreamStdout:
+			w = stdout
+		case StreamStderr:
+			w = stderr
+		case StreamStatus:
+			var status Status
+			if err = json.Unmarshal(p, &status); err != nil {
+				return nil, fmt.Errorf("invalid status: %w", err)
+			}
+			return &status, nil
+		default:
+			return nil, fmt.Errorf("unexpected stream %d", stream)
+		}
+		if w == nil {
+			continue
+		}
+		if _, err = w.Write(p); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func statusError(status *Status, err error) error {
+	if err != nil {
+		return err
+	}
+	if status.Error != "" {
+		return errors.New(status.Error)
+	}
+	return nil
+}
+
+// ctxError prefers the error of ctx, closing the conn on cancel fails the
+// pending read or write
+func ctxError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,179 @@
+// Package agent is the protocol of the guest agent the bootstrap serves on
+// define.AgentVsockPort, and its host client. libkrun proxies the agent
+// socket in the vm dir to the vsock port.
+//
+// A connection carries one request. The client sends a Request as a json
+// line, the agent answers with a Response as a json line. exec, read and
+// write go on with frames, see WriteFrame, until the agent sends the Status
+// frame.
+package agent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Version of the protocol, the agent refuses a request of another version
+const Version = 1
+
+// the methods of a Request
+const (
+	// MethodInfo answers with Response.Info
+	MethodInfo = "info"
+	// MethodExec runs Request.Exec, the stdin, stdout and stderr streams are
+	// framed
+	MethodExec = "exec"
+	// MethodRead sends the file Request.File in StreamStdout frames
+	MethodRead = "read"
+	// MethodWrite writes the StreamStdin frames to the file Request.File
+	MethodWrite = "write"
+	// MethodProcesses answers with Response.Processes
+	MethodProcesses = "processes"
+	// MethodShutdown shuts the guest down like revm stop
+	MethodShutdown = "shutdown"
+)
+
+// the streams of a frame
+const (
+	// StreamStdin goes to the agent, an empty frame closes it
+	StreamStdin byte = iota
+	StreamStdout
+	StreamStderr
+	// StreamStatus carries the Status json, it is the last frame
+	StreamStatus
+)
+
+// maxFrame bounds the payload of a frame
+const maxFrame = 1 << 20
+
+type Request struct {
+	Version int          `json:"version"`
+	Method  string       `json:"method"`
+	Exec    *ExecRequest `json:"exec,omitempty"`
+	File    *FileRequest `json:"file,omitempty"`
+}
+
+// ExecRequest runs Args in the guest, Env is added to the environment of the
+// cmdline
+type ExecRequest struct {
+	Args []string `json:"args"`
+	Env  []string `json:"env,omitempty"`
+	// Dir is / by default
+	Dir string `json:"dir,omitempty"`
+	// User and Group are names or numeric ids, root by default
+	User  string `json:"user,omitempty"`
+	Group string `json:"group,omitempty"`
+}
+
+type FileRequest struct {
+	Path string `json:"path"`
+	// Mode of a written file, 0644 by default
+	Mode uint32 `json:"mode,omitempty"`
+}
+
+type Response struct {
+	Version   int       `json:"version"`
+	Error     string    `json:"error,omitempty"`
+	Info      *Info     `json:"info,omitempty"`
+	Processes []Process `json:"processes,omitempty"`
+}
+
+// Info is the status of the guest
+type Info struct {
+	Version  int    `json:"version"`
+	Hostname string `json:"hostname"`
+	Kernel   string `json:"kernel"`
+	// Uptime in seconds
+	Uptime float64 `json:"uptime"`
+}
+
+type Process struct {
+	PID   int    `json:"pid"`
+	PPID  int    `json:"ppid"`
+	UID   int    `json:"uid"`
+	State string `json:"state"`
+	Name  string `json:"name"`
+	// Cmdline is empty for kernel threads
+	Cmdline []string `json:"cmdline,omitempty"`
+}
+
+// Status ends exec, read and write, Code is the exit status of exec, 128+N if
+// the process was killed by signal N
+type Status struct {
+	Code  int    `json:"code"`
+	Error string `json:"error,omitempty"`
+}
+
+// WriteFrame writes p to stream, a frame is the stream byte, the big endian
+// uint32 length of p and p
+func WriteFrame(w io.Writer, stream byte, p []byte) error {
+	if len(p) > maxFrame {
+		return fmt.Errorf("frame of %d bytes exceeds %d", len(p), maxFrame)
+	}
+	header := [5]byte{stream}
+	binary.BigEndian.PutUint32(header[1:], uint32(len(p)))
+	if _, err := w.Write(append(header[:], p...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReadFrame reads a frame written by WriteFrame
+func ReadFrame(r io.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if n > maxFrame {
+		return 0, nil, fmt.Errorf("frame of %d bytes exceeds %d", n, maxFrame)
+	}
+	p := make([]byte, n)
+	if _, err := io.ReadFull(r, p); err != nil {
+		return 0, nil, err
+	}
+	return header[0], p, nil
+}
+
+// Mux writes the frames of several streams to one conn, it is safe for
+// concurrent use
+type Mux struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewMux(w io.Writer) *Mux {
+	return &Mux{w: w}
+}
+
+func (m *Mux) WriteFrame(stream byte, p []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return WriteFrame(m.w, stream, p)
+}
+
+// Stream returns a writer of the frames of stream, an empty write sends no
+// frame, so it never closes the stream
+func (m *Mux) Stream(stream byte) io.Writer {
+	return streamWriter{mux: m, stream: stream}
+}
+
+type streamWriter struct {
+	mux    *Mux
+	stream byte
+}
+
+func (s streamWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), maxFrame)
+		if err := s.mux.WriteFrame(s.stream, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
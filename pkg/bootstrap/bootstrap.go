@@ -0,0 +1,130 @@
+// Package bootstrap carries the guest bootstrap binaries embedded into revm,
+// one per supported guest arch.
+package bootstrap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"debug/elf"
+	"embed"
+	"fmt"
+	"io"
+	"linuxvm/pkg/system"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/sirupsen/logrus"
+)
+
+//go:embed bin
+var binaries embed.FS
+
+// archProbes are the rootfs binaries whose ELF header tells the rootfs arch
+var archProbes = []string{"/bin/sh", "/sbin/init", "/bin/busybox", "/usr/bin/env", "/bin/ls"}
+
+var elfMachines = map[elf.Machine]string{
+	elf.EM_AARCH64: "arm64",
+	elf.EM_X86_64:  "amd64",
+}
+
+func binName(arch string) string {
+	return "bootstrap-" + arch
+}
+
+// DetectArch returns the GOARCH of the rootfs, detected from the ELF header of
+// well known binaries in it. The host arch is assumed if none is found.
+func DetectArch(rootfs string) (string, error) {
+	for _, probe := range archProbes {
+		path, find := system.LookupInRootFS(rootfs, probe)
+		if !find {
+			continue
+		}
+
+		f, err := elf.Open(path)
+		if err != nil {
+			logrus.Debugf("%q is not an elf file: %v", path, err)
+			continue
+		}
+		machine := f.Machine
+		_ = f.Close()
+
+		arch, ok := elfMachines[machine]
+		if !ok {
+			return "", fmt.Errorf("unsupported rootfs arch %v, found in %q", machine, probe)
+		}
+		logrus.Infof("rootfs arch %q, found in %q", arch, probe)
+		return arch, nil
+	}
+
+	logrus.Warnf("can not detect the arch of rootfs %q, assume %q", rootfs, runtime.GOARCH)
+	return runtime.GOARCH, nil
+}
+
+// Binary returns the bootstrap for arch, the embedded one if revm is built by
+// build.sh, or the bootstrap-<arch> file next to the revm executable.
+func Binary(arch string) ([]byte, error) {
+	b, err := binaries.ReadFile("bin/" + binName(arch))
+	if err == nil {
+		return b, nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get executable path: %w", err)
+	}
+	exe, err = filepath.EvalSymlinks(exe)
+	if err != nil {
+		return nil, fmt.Errorf("failed to eval symlinks: %w", err)
+	}
+
+	path := filepath.Join(filepath.Dir(exe), binName(arch))
+	logrus.Infof("no embedded bootstrap for %q, use %q", arch, path)
+	b, err = os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("no bootstrap for arch %q: %w", arch, err)
+	}
+
+	return b, nil
+}
+
+// Install writes the bootstrap for arch to dest, an existing dest with the
+// same checksum is not rewritten.
+func Install(arch, dest string) error {
+	b, err := Binary(arch)
+	if err != nil {
+		return err
+	}
+
+	want := sha256.Sum256(b)
+	if got, err := fileChecksum(dest); err == nil && bytes.Equal(got, want[:]) {
+		logrus.Infof("bootstrap %q is up to date", dest)
+		return nil
+	}
+
+	logrus.Infof("install bootstrap for %q to %q", arch, dest)
+	tmp := dest + ".tmp"
+	if err = os.WriteFile(tmp, b, 0755); err != nil {
+		return fmt.Errorf("failed to write bootstrap: %w", err)
+	}
+	// WriteFile does not change the mode of an existing file
+	if err = os.Chmod(tmp, 0755); err != nil {
+		return fmt.Errorf("failed to chmod bootstrap: %w", err)
+	}
+
+	return os.Rename(tmp, dest)
+}
+
+func fileChecksum(file string) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() //nolint:errcheck
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
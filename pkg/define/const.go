@@ -1,5 +1,74 @@
 package define
 
+import "time"
+
 const (
 	VMConfig = "vmconfig.json"
+
+	// StateDir is the per-user directory under $HOME that holds all named VMs,
+	// it can be overridden by the REVM_HOME environment variable.
+	StateDir    = ".revm"
+	StateDirEnv = "REVM_HOME"
+	VMsDir      = "vms"
+	// ArtifactsDir keeps the journals of the files created by running revm
+	// processes, see state.Tracker
+	ArtifactsDir = "artifacts"
+	// LeasesFile keeps the subnets, guest ips and macs allocated to the VMs,
+	// see network.IPAM. The pool is read from SubnetPoolEnv if set.
+	LeasesFile    = "leases.json"
+	LeasesLock    = "leases.lock"
+	SubnetPoolEnv = "REVM_SUBNET_POOL"
+
+	// files kept in the state directory of every named VM
+	InstanceConfig       = "config.json"
+	InstanceStatus       = "status.json"
+	InstanceLog          = "revm.log"
+	InstanceLock         = "revm.lock"
+	GVproxyControlSocket = "gvproxy-control.sock"
+	NetworkBackendSocket = "vfkit-network-backend.sock"
+	ControlSocket        = "control.sock"
+	RuntimeConfig        = "runtime.json"
+	// AgentSocket is the host end of the guest agent, see package agent
+	AgentSocket = "agent.sock"
+	// SSHKey is the private key revm ssh logs in with, the public key is
+	// SSHKey.pub
+	SSHKey = "ssh_key"
+	// CaptureFile is the default pcap file of revm pcap start
+	CaptureFile = "capture.pcap"
+
+	// ShareDir is the revm owned dir shared into the guest by virtiofs with
+	// ShareTag and mounted on GuestShareDir, it carries the bootstrap and
+	// vmconfig.json so the rootfs is never written. GuestShareDir lives on the
+	// devtmpfs, which is writable even if the rootfs is not.
+	ShareDir      = "share"
+	ShareTag      = "revm"
+	GuestShareDir = "/dev/.revm"
+	BootstrapBin  = "bootstrap"
+	// GuestHostsFile is written next to the bootstrap and bind mounted on
+	// /etc/hosts of the guest
+	GuestHostsFile = "hosts"
+	// GuestResolvFile is bind mounted on /etc/resolv.conf the same way
+	GuestResolvFile = "resolv.conf"
+	// GuestAuthorizedKeysFile is bind mounted on the authorized_keys of the
+	// ssh user if the rootfs is read-only
+	GuestAuthorizedKeysFile = "authorized_keys"
+
+	// ControlVsockPort is the vsock port the bootstrap listens on for requests
+	// from the host, libkrun proxies ControlSocket on the host to it.
+	ControlVsockPort = 1025
+	// AgentVsockPort is the vsock port of the guest agent, libkrun proxies
+	// AgentSocket on the host to it.
+	AgentVsockPort = 1026
+	// SocketVsockPortBase is the vsock port of the first forwarded or
+	// published unix socket, the next sockets take the next ports
+	SocketVsockPortBase = 1100
+	// SSHGuestPort is the port of the guest ssh server
+	SSHGuestPort = 22
+	// ShutdownRequest asks the bootstrap to stop the guest cmdline, sync and
+	// unmount the filesystems and exit
+	ShutdownRequest = "shutdown"
+
+	// GuestStopTimeout is how long the bootstrap waits for the guest cmdline
+	// to exit after SIGTERM before killing it
+	GuestStopTimeout = 10 * time.Second
 )
@@ -0,0 +1,15 @@
+package define
+
+// Exit codes of revm and the bootstrap besides the exit status of the guest
+// cmdline itself, they follow the convention of `docker run`.
+const (
+	// ExitCodeRevmError revm or the bootstrap itself failed
+	ExitCodeRevmError = 125
+	// ExitCodeCannotExec the guest cmdline can not be invoked
+	ExitCodeCannotExec = 126
+	// ExitCodeNotFound the guest cmdline is not found
+	ExitCodeNotFound = 127
+	// ExitCodeSignalBase the guest cmdline was killed by signal N, exit with
+	// ExitCodeSignalBase+N
+	ExitCodeSignalBase = 128
+)
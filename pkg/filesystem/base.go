@@ -0,0 +1,67 @@
+package filesystem
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	Tmpfs        = "tmpfs"
+	TmpDir       = "/tmp"
+	TmpMountOpts = "rw,nosuid,relatime"
+
+	devpts = "devpts"
+)
+
+// BaseMount is a pseudo filesystem the guest tools expect, e.g. ptys need
+// devpts and container runtimes cgroup2
+type BaseMount struct {
+	Name    string
+	Source  string
+	Target  string
+	FSType  string
+	Options string
+	// Optional mounts are only mounted if asked for
+	Optional bool
+}
+
+// BaseMounts are mounted in order, a mount below another comes after it
+var BaseMounts = []BaseMount{
+	{Name: "proc", Source: "proc", Target: "/proc", FSType: "proc", Options: "nosuid,nodev,noexec"},
+	{Name: "sysfs", Source: "sysfs", Target: "/sys", FSType: "sysfs", Options: "nosuid,nodev,noexec"},
+	{Name: "devtmpfs", Source: "devtmpfs", Target: "/dev", FSType: "devtmpfs", Options: "nosuid,mode=0755"},
+	// gid 5 is the tty group of most distributions
+	{Name: "devpts", Source: "devpts", Target: "/dev/pts", FSType: devpts, Options: "nosuid,noexec,newinstance,ptmxmode=0666,mode=0620,gid=5"},
+	{Name: "shm", Source: "shm", Target: "/dev/shm", FSType: Tmpfs, Options: "nosuid,nodev,mode=1777"},
+	{Name: "run", Source: "run", Target: "/run", FSType: Tmpfs, Options: "nosuid,nodev,mode=0755"},
+	{Name: "tmp", Source: Tmpfs, Target: TmpDir, FSType: Tmpfs, Options: TmpMountOpts},
+	{Name: "cgroup2", Source: "cgroup2", Target: "/sys/fs/cgroup", FSType: "cgroup2", Options: "nosuid,nodev,noexec,nsdelegate"},
+	{Name: "binfmt_misc", Source: "binfmt_misc", Target: "/proc/sys/fs/binfmt_misc", FSType: "binfmt_misc", Options: "nosuid,nodev,noexec", Optional: true},
+	{Name: "debugfs", Source: "debugfs", Target: "/sys/kernel/debug", FSType: "debugfs", Options: "nosuid,nodev,noexec", Optional: true},
+}
+
+// SelectBaseMounts returns the default base mounts without skip plus the
+// optional ones in extra, in mount order
+func SelectBaseMounts(extra, skip []string) []BaseMount {
+	var selected []BaseMount
+	for _, m := range BaseMounts {
+		if slices.Contains(skip, m.Name) || (m.Optional && !slices.Contains(extra, m.Name)) {
+			continue
+		}
+		selected = append(selected, m)
+	}
+	return selected
+}
+
+// CheckBaseMount reports whether name is a base mount
+func CheckBaseMount(name string) error {
+	names := make([]string, 0, len(BaseMounts))
+	for _, m := range BaseMounts {
+		if m.Name == name {
+			return nil
+		}
+		names = append(names, m.Name)
+	}
+	return fmt.Errorf("unknown base mount %q, must be one of %s", name, strings.Join(names, ", "))
+}
@@ -1,6 +1,6 @@
 package filesystem
 
-func MountTmpfs() error {
+func MountBase(mounts []BaseMount) error {
 	return nil
 }
 
@@ -8,3 +8,11 @@ func MountTmpfs() error {
 func MountVirtioFS(f string) error {
 	return nil
 }
+
+func BindMount(src, target string) error {
+	return nil
+}
+
+func UnmountAll() error {
+	return nil
+}
@@ -2,35 +2,83 @@ package filesystem
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/moby/sys/mount"
 	"github.com/moby/sys/mountinfo"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 )
 
 const (
-	Tmpfs        = "tmpfs"
-	TmpDir       = "/tmp"
-	TmpMountOpts = "rw,nosuid,relatime"
-
 	VirtioFs = "virtiofs"
+
+	devPtmx = "/dev/ptmx"
 )
 
-func MountTmpfs() error {
-	isMounted, err := mountinfo.Mounted(TmpDir)
+// MountBase mounts the base mounts in order, a mount already there, e.g. by
+// the init of libkrun, is kept, so MountBase is idempotent. A filesystem the
+// kernel does not support is skipped.
+func MountBase(mounts []BaseMount) error {
+	var errs []error
+	for _, m := range mounts {
+		if err := mountBase(m); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func mountBase(m BaseMount) error {
+	if err := os.MkdirAll(m.Target, 0755); err != nil {
+		return fmt.Errorf("failed to create %q: %w", m.Target, err)
+	}
+
+	isMounted, err := mountinfo.Mounted(m.Target)
 	if err != nil {
-		return fmt.Errorf("failed to check %q mounted: %w", TmpDir, err)
+		return fmt.Errorf("failed to check %q mounted: %w", m.Target, err)
 	}
 	if isMounted {
-		return fmt.Errorf("%q is already mounted, can not mount again", TmpDir)
+		logrus.Debugf("%q is already mounted", m.Target)
+	} else {
+		err = mount.Mount(m.Source, m.Target, m.FSType, m.Options)
+		if errors.Is(err, unix.ENODEV) {
+			logrus.Warnf("skip mounting %q, the kernel has no %s", m.Target, m.FSType)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to mount %s: %w", m.Name, err)
+		}
+	}
+
+	if m.FSType == devpts {
+		return ensurePtmx()
 	}
+	return nil
+}
 
-	if err = os.MkdirAll(TmpDir, 755); err != nil {
-		return fmt.Errorf("failed to create tmp dir: %w", err)
+// ensurePtmx links /dev/ptmx to the ptmx of devpts if /dev has none, a ptmx
+// device node finds the devpts mounted on /dev/pts by itself
+func ensurePtmx() error {
+	if _, err := os.Lstat(devPtmx); !errors.Is(err, os.ErrNotExist) {
+		return err
 	}
+	if err := os.Symlink("pts/ptmx", devPtmx); err != nil {
+		return fmt.Errorf("failed to link %s: %w", devPtmx, err)
+	}
+	return nil
+}
 
-	return mount.Mount(Tmpfs, TmpDir, Tmpfs, TmpMountOpts)
+// BindMount mounts file or dir src on target, which must exist
+func BindMount(src, target string) error {
+	if err := mount.Mount(src, target, "none", "bind"); err != nil {
+		return fmt.Errorf("failed to bind mount %q on %q: %w", src, target, err)
+	}
+	return nil
 }
 
 // VMConfig taken from `pkg/vmconfig/vmconfig.go`
@@ -77,3 +125,41 @@ func MountVirtioFS(file string) error {
 
 	return nil
 }
+
+// UnmountAll syncs and unmounts the virtiofs shares, the data disks and the
+// tmpfs mounted in the guest, in reverse mount order. The rootfs and the dir
+// the bootstrap runs from are kept.
+func UnmountAll() error {
+	unix.Sync()
+
+	keepDir := "/"
+	if exe, err := os.Executable(); err == nil {
+		keepDir = filepath.Dir(exe)
+	}
+
+	// the filter skips the mounts it returns true for
+	mounts, err := mountinfo.GetMounts(func(info *mountinfo.Info) (bool, bool) {
+		if info.Mountpoint == "/" || info.Mountpoint == keepDir {
+			return true, false
+		}
+		unmount := info.FSType == VirtioFs ||
+			strings.HasPrefix(info.Source, "/dev/vd") ||
+			(info.FSType == Tmpfs && info.Mountpoint == TmpDir)
+		return !unmount, false
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get mounts: %w", err)
+	}
+
+	var errs []error
+	for i := len(mounts) - 1; i >= 0; i-- {
+		logrus.Infof("unmount %q", mounts[i].Mountpoint)
+		if err := unix.Unmount(mounts[i].Mountpoint, 0); err != nil {
+			errs = append(errs, fmt.Errorf("failed to unmount %q: %w", mounts[i].Mountpoint, err))
+		}
+	}
+
+	unix.Sync()
+
+	return errors.Join(errs...)
+}
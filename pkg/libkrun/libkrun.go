@@ -9,19 +9,24 @@ package libkrun
 import "C"
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"linuxvm/pkg/define"
 	"linuxvm/pkg/system"
 	"linuxvm/pkg/vmconfig"
+	"net"
 	"net/url"
 	"os"
 	"path/filepath"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 )
 
 // GoStringList2CStringArray takes an array of Go strings and converts it to an array of CStrings.
@@ -87,12 +92,49 @@ func StartVM(ctx context.Context, vmc vmconfig.VMConfig, cmdline vmconfig.Cmdlin
 		return fmt.Errorf("set virtiofs err: %v", err)
 	}
 
+	vm, err = vm.AddVsockPort(define.ControlVsockPort, vm.vmc.ControlSocket, true)
+	if err != nil {
+		return fmt.Errorf("set control vsock port err: %v", err)
+	}
+
+	// vms created before the guest agent have no agent socket
+	if vm.vmc.AgentSocket != "" {
+		vm, err = vm.AddVsockPort(define.AgentVsockPort, vm.vmc.AgentSocket, true)
+		if err != nil {
+			return fmt.Errorf("set agent vsock port err: %v", err)
+		}
+	}
+
+	// libkrun listens on the host path of a published socket, and connects
+	// to the host path of a forwarded socket
+	for _, sock := range vm.vmc.Sockets {
+		vm, err = vm.AddVsockPort(sock.VsockPort, sock.HostPath, sock.Direction == vmconfig.SocketPublish)
+		if err != nil {
+			return fmt.Errorf("set vsock port of socket %s err: %v", sock, err)
+		}
+	}
+
+	vm.SetShutdownEventFD()
+
+	// StartEnter never returns once the vm is booted, so the shutdown request
+	// is sent from another goroutine
+	go func() {
+		<-ctx.Done()
+		if err := vm.RequestShutdown(); err != nil {
+			logrus.Errorf("failed to request guest shutdown: %v", err)
+		}
+	}()
+
 	return vm.StartEnter()
 }
 
 type VMInfo struct {
 	vmc     vmconfig.VMConfig
 	Cmdline vmconfig.Cmdline
+
+	// shutdownFD is the eventfd to signal the guest to shut down orderly, nil
+	// if libkrun does not support it
+	shutdownFD *os.File
 }
 
 func NewVM(vmc vmconfig.VMConfig) (*VMInfo, error) {
@@ -117,17 +159,74 @@ func NewVM(vmc vmconfig.VMConfig) (*VMInfo, error) {
 	return vmInfo, nil
 }
 
+// SetNetworkProvider connects the guest nic to the backend of the network
+// mode. Without a nic libkrun falls back to TSI, which gives the guest the
+// network of the host, so the none mode attaches a nic without a peer.
 func (v *VMInfo) SetNetworkProvider() (*VMInfo, error) {
-	parse, err := url.Parse(v.vmc.NetworkStackBackend)
+	switch v.vmc.Network.Mode {
+	case vmconfig.NetPasst:
+		if ret := C.krun_set_passt_fd(C.uint32_t(v.vmc.CtxID), C.int(v.vmc.PasstFD)); ret != 0 {
+			return nil, fmt.Errorf("failed to set passt fd: %v", syscall.Errno(-ret))
+		}
+	case vmconfig.NetNone:
+		if err := v.setNullNetwork(); err != nil {
+			return nil, err
+		}
+	default:
+		parse, err := url.Parse(v.vmc.NetworkStackBackend)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse url: %v", err)
+		}
+
+		gvpSocket, defunct := GoString2CString(parse.Path)
+		defer defunct()
+
+		if ret := C.krun_set_gvproxy_path(C.uint32_t(v.vmc.CtxID), gvpSocket); ret != 0 {
+			return nil, fmt.Errorf("failed to set gvproxy path: %v", syscall.Errno(-ret))
+		}
+	}
+
+	return v.SetNetMAC()
+}
+
+// setNullNetwork connects the guest nic to a socket whose frames are dropped
+func (v *VMInfo) setNullNetwork() error {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse url: %v", err)
+		return fmt.Errorf("failed to create null network socketpair: %w", err)
 	}
 
-	gvpSocket, defunct := GoString2CString(parse.Path)
-	defer defunct()
+	if ret := C.krun_set_passt_fd(C.uint32_t(v.vmc.CtxID), C.int(fds[0])); ret != 0 {
+		_ = unix.Close(fds[0])
+		_ = unix.Close(fds[1])
+		return fmt.Errorf("failed to set null network: %v", syscall.Errno(-ret))
+	}
+
+	// drain the frames sent by the guest, so the nic never blocks
+	peer := os.NewFile(uintptr(fds[1]), "null-network")
+	go func() {
+		_, _ = io.Copy(io.Discard, peer)
+	}()
+
+	return nil
+}
 
-	if ret := C.krun_set_gvproxy_path(C.uint32_t(v.vmc.CtxID), gvpSocket); ret != 0 {
-		return nil, fmt.Errorf("failed to set gvproxy path: %v", syscall.Errno(-ret))
+// SetNetMAC sets the mac address of the guest nic of every network mode.
+// libkrun.h only mentions the passt backend, but the mac applies to the
+// virtio-net device whichever backend it is connected to: gvproxy leases the
+// guest ip to it, and with passt and none the guest keeps the mac leased to
+// the vm, so two vms never share a mac.
+func (v *VMInfo) SetNetMAC() (*VMInfo, error) {
+	mac, err := net.ParseMAC(v.vmc.Network.GuestMAC)
+	if err != nil || len(mac) != 6 {
+		return nil, fmt.Errorf("invalid guest mac %q", v.vmc.Network.GuestMAC)
+	}
+
+	cMac := (*C.uint8_t)(C.CBytes(mac))
+	defer C.free(unsafe.Pointer(cMac))
+
+	if ret := C.krun_set_net_mac(C.uint32_t(v.vmc.CtxID), cMac); ret != 0 {
+		return nil, fmt.Errorf("failed to set net mac: %v", syscall.Errno(-ret))
 	}
 
 	return v, nil
@@ -223,6 +322,77 @@ func (v *VMInfo) AddDisk() (*VMInfo, error) {
 	return v, nil
 }
 
+// AddVsockPort maps the vsock port of the guest to a unix socket on the host,
+// if listen is true the guest listens on the port and the host connects.
+func (v *VMInfo) AddVsockPort(port uint32, path string, listen bool) (*VMInfo, error) {
+	if path == "" {
+		return v, nil
+	}
+
+	cPath, defunct := GoString2CString(path)
+	defer defunct()
+
+	if ret := C.krun_add_vsock_port2(C.uint32_t(v.vmc.CtxID), C.uint32_t(port), cPath, C.bool(listen)); ret != 0 {
+		return nil, fmt.Errorf("failed to add vsock port %d: %v", port, syscall.Errno(-ret))
+	}
+
+	return v, nil
+}
+
+// SetShutdownEventFD gets the eventfd used to signal the guest to shut down,
+// it is only available in libkrun-efi.
+func (v *VMInfo) SetShutdownEventFD() {
+	fd := C.krun_get_shutdown_eventfd(C.uint32_t(v.vmc.CtxID))
+	if fd < 0 {
+		logrus.Debugf("shutdown eventfd not available: %v", syscall.Errno(-fd))
+		return
+	}
+
+	v.shutdownFD = os.NewFile(uintptr(fd), "shutdown-eventfd")
+}
+
+// RequestShutdown asks the guest to shut down orderly, the bootstrap stops
+// the cmdline, syncs and unmounts the filesystems before the vm exits. The
+// eventfd is signaled if available, the request is always sent to the
+// control socket too, since the eventfd does not reach the bootstrap on
+// every guest kernel.
+func (v *VMInfo) RequestShutdown() error {
+	signaled := false
+	if v.shutdownFD != nil {
+		logrus.Infof("signal guest shutdown by eventfd")
+		b := make([]byte, 8)
+		binary.NativeEndian.PutUint64(b, 1)
+		if _, err := v.shutdownFD.Write(b); err != nil {
+			logrus.Warnf("failed to write shutdown eventfd: %v", err)
+		} else {
+			signaled = true
+		}
+	}
+
+	logrus.Infof("request guest shutdown by %q", v.vmc.ControlSocket)
+	err := sendControlRequest(v.vmc.ControlSocket, define.ShutdownRequest)
+	if err != nil && signaled {
+		logrus.Warnf("%v, rely on the shutdown eventfd", err)
+		return nil
+	}
+	return err
+}
+
+func sendControlRequest(socket, request string) error {
+	conn, err := net.DialTimeout("unix", socket, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to connect control socket: %w", err)
+	}
+	defer conn.Close() //nolint:errcheck
+
+	if _, err = fmt.Fprintln(conn, request); err != nil {
+		return fmt.Errorf("failed to send %q request: %w", request, err)
+	}
+	return nil
+}
+
+// StartEnter boots the vm, it only returns on error. Once the guest is down
+// the VMM exits the process with the exit code set by the bootstrap.
 func (v *VMInfo) StartEnter() error {
 	if ret := C.krun_start_enter(C.uint32_t(v.vmc.CtxID)); ret != 0 {
 		return fmt.Errorf("failed to start enter: %v", syscall.Errno(-ret))
@@ -250,6 +420,13 @@ func addDisk(ctxID uint32, disk string) error {
 }
 
 func (v *VMInfo) AddVirtioFS() (*VMInfo, error) {
+	if v.vmc.ShareDir != "" {
+		if err := addVirtioFS(v.vmc.CtxID, define.ShareTag, v.vmc.ShareDir); err != nil {
+			logrus.Errorf("failed to add revm share: %v", err)
+			return nil, err
+		}
+	}
+
 	for _, mount := range v.vmc.Mounts {
 		if err := addVirtioFS(v.vmc.CtxID, mount.Tag, mount.Source); err != nil {
 			logrus.Errorf("failed to add virtiofs: %v", err)
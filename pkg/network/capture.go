@@ -0,0 +1,281 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"linuxvm/pkg/vmconfig"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	capturePath = "/services/capture"
+
+	// pcap file format, see https://wiki.wireshark.org/Development/LibpcapFileFormat
+	pcapMagic          = 0xa1b2c3d4
+	pcapVersionMajor   = 2
+	pcapVersionMinor   = 4
+	pcapSnapLen        = 256 * 1024
+	pcapLinkTypeEther  = 1
+	pcapHeaderLen      = 24
+	pcapRecordHeadLen  = 16
+	defaultCaptureKeep = 1
+)
+
+// CaptureStatus is the state of the capture reported by the control api
+type CaptureStatus struct {
+	vmconfig.Capture
+	Enabled bool  `json:"enabled"`
+	Size    int64 `json:"size"`
+}
+
+// Capture writes the frames sent and received by the guest nic to a pcap
+// file, it can be started and stopped while the vm runs.
+type Capture struct {
+	mu   sync.Mutex
+	cfg  vmconfig.Capture
+	f    *os.File
+	size int64
+}
+
+// NewCapture returns a capture which is started if cfg.File is set
+func NewCapture(cfg vmconfig.Capture) (*Capture, error) {
+	c := &Capture{}
+	if cfg.File == "" {
+		return c, nil
+	}
+	return c, c.Start(cfg)
+}
+
+// Start truncates cfg.File and captures into it, a running capture is stopped
+// first
+func (c *Capture) Start(cfg vmconfig.Capture) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if cfg.File == "" {
+		return fmt.Errorf("no capture file provided")
+	}
+	if cfg.MaxSizeMB > 0 && cfg.MaxFiles == 0 {
+		cfg.MaxFiles = defaultCaptureKeep
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closeLocked()
+	c.cfg = cfg
+	if err := c.openLocked(); err != nil {
+		c.cfg = vmconfig.Capture{}
+		return err
+	}
+
+	logrus.Infof("capture guest traffic to %q", cfg.File)
+	return nil
+}
+
+// Stop closes the capture file
+func (c *Capture) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.f != nil {
+		logrus.Infof("stop capture to %q", c.cfg.File)
+	}
+	c.closeLocked()
+}
+
+func (c *Capture) Status() CaptureStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CaptureStatus{Capture: c.cfg, Enabled: c.f != nil, Size: c.size}
+}
+
+// Wrap returns conn whose frames are captured, conn must carry one frame per
+// read and write
+func (c *Capture) Wrap(conn net.Conn) net.Conn {
+	return &captureConn{Conn: conn, capture: c}
+}
+
+type captureConn struct {
+	net.Conn
+	capture *Capture
+}
+
+func (cc *captureConn) Read(b []byte) (int, error) {
+	n, err := cc.Conn.Read(b)
+	if n > 0 {
+		cc.capture.writeFrame(b[:n])
+	}
+	return n, err
+}
+
+func (cc *captureConn) Write(b []byte) (int, error) {
+	n, err := cc.Conn.Write(b)
+	if err == nil {
+		cc.capture.writeFrame(b[:n])
+	}
+	return n, err
+}
+
+func (c *Capture) writeFrame(frame []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.f == nil {
+		return
+	}
+
+	captured := frame
+	if len(captured) > pcapSnapLen {
+		captured = captured[:pcapSnapLen]
+	}
+
+	record := int64(pcapRecordHeadLen + len(captured))
+	if c.cfg.MaxSizeMB > 0 && c.size+record > int64(c.cfg.MaxSizeMB)<<20 {
+		if err := c.rotateLocked(); err != nil {
+			logrus.Errorf("failed to rotate capture file, stop capture: %v", err)
+			c.closeLocked()
+			return
+		}
+	}
+
+	now := time.Now()
+	head := make([]byte, pcapRecordHeadLen)
+	binary.LittleEndian.PutUint32(head[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(head[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(head[8:], uint32(len(captured)))
+	binary.LittleEndian.PutUint32(head[12:], uint32(len(frame)))
+
+	if _, err := c.f.Write(append(head, captured...)); err != nil {
+		logrus.Errorf("failed to write capture file, stop capture: %v", err)
+		c.closeLocked()
+		return
+	}
+	c.size += record
+}
+
+// rotateLocked shifts File.N-1 to File.N ... File to File.1 and starts a new
+// File
+func (c *Capture) rotateLocked() error {
+	_ = c.f.Close()
+	c.f = nil
+
+	file := c.cfg.File
+	_ = os.Remove(fmt.Sprintf("%s.%d", file, c.cfg.MaxFiles))
+	for i := c.cfg.MaxFiles - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", file, i), fmt.Sprintf("%s.%d", file, i+1))
+	}
+	if err := os.Rename(file, file+".1"); err != nil {
+		return err
+	}
+
+	return c.openLocked()
+}
+
+// openLocked creates the capture file and writes the pcap header
+func (c *Capture) openLocked() error {
+	f, err := os.OpenFile(c.cfg.File, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create capture file: %w", err)
+	}
+
+	head := make([]byte, pcapHeaderLen)
+	binary.LittleEndian.PutUint32(head[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(head[4:], pcapVersionMajor)
+	binary.LittleEndian.PutUint16(head[6:], pcapVersionMinor)
+	binary.LittleEndian.PutUint32(head[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(head[20:], pcapLinkTypeEther)
+	if _, err = f.Write(head); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to write capture file: %w", err)
+	}
+
+	c.f = f
+	c.size = pcapHeaderLen
+	return nil
+}
+
+func (c *Capture) closeLocked() {
+	if c.f != nil {
+		_ = c.f.Close()
+		c.f = nil
+	}
+}
+
+// Mux serves the control api of the capture: POST start with a
+// vmconfig.Capture, POST stop and GET status
+func (c *Capture) Mux() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+capturePath+"/start", func(w http.ResponseWriter, r *http.Request) {
+		var cfg vmconfig.Capture
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := c.Start(cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeCaptureStatus(w, c.Status())
+	})
+	mux.HandleFunc("POST "+capturePath+"/stop", func(w http.ResponseWriter, _ *http.Request) {
+		c.Stop()
+		writeCaptureStatus(w, c.Status())
+	})
+	mux.HandleFunc("GET "+capturePath+"/status", func(w http.ResponseWriter, _ *http.Request) {
+		writeCaptureStatus(w, c.Status())
+	})
+	return mux
+}
+
+func writeCaptureStatus(w http.ResponseWriter, st CaptureStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(st)
+}
+
+// CaptureClient toggles the capture of a running vm by the gvproxy control
+// endpoint
+type CaptureClient struct {
+	ctl *controlClient
+}
+
+func NewCaptureClient(endpoint string) (*CaptureClient, error) {
+	ctl, err := newControlClient(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &CaptureClient{ctl: ctl}, nil
+}
+
+func (c *CaptureClient) Start(ctx context.Context, cfg vmconfig.Capture) (*CaptureStatus, error) {
+	st := &CaptureStatus{}
+	if err := c.ctl.post(ctx, capturePath+"/start", cfg, st); err != nil {
+		return nil, fmt.Errorf("failed to start capture: %w", err)
+	}
+	return st, nil
+}
+
+func (c *CaptureClient) Stop(ctx context.Context) (*CaptureStatus, error) {
+	st := &CaptureStatus{}
+	if err := c.ctl.post(ctx, capturePath+"/stop", struct{}{}, st); err != nil {
+		return nil, fmt.Errorf("failed to stop capture: %w", err)
+	}
+	return st, nil
+}
+
+func (c *CaptureClient) Status(ctx context.Context) (*CaptureStatus, error) {
+	st := &CaptureStatus{}
+	if err := c.ctl.get(ctx, capturePath+"/status", st); err != nil {
+		return nil, fmt.Errorf("failed to get capture status: %w", err)
+	}
+	return st, nil
+}
@@ -0,0 +1,154 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"linuxvm/pkg/vmconfig"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// pcapRecord is a record of a pcap file, seq is the number the test frames
+// start with
+type pcapRecord struct {
+	inclLen, origLen uint32
+	seq              uint32
+}
+
+// readPcap checks the global header of file and returns its records
+func readPcap(t *testing.T, file string) []pcapRecord {
+	t.Helper()
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) < pcapHeaderLen {
+		t.Fatalf("%s has no pcap header", file)
+	}
+	le := binary.LittleEndian
+	if le.Uint32(b[0:]) != pcapMagic || le.Uint16(b[4:]) != pcapVersionMajor || le.Uint16(b[6:]) != pcapVersionMinor ||
+		le.Uint32(b[16:]) != pcapSnapLen || le.Uint32(b[20:]) != pcapLinkTypeEther {
+		t.Fatalf("%s has an invalid pcap header % x", file, b[:pcapHeaderLen])
+	}
+
+	var records []pcapRecord
+	for b = b[pcapHeaderLen:]; len(b) > 0; {
+		if len(b) < pcapRecordHeadLen {
+			t.Fatalf("%s ends in a truncated record header", file)
+		}
+		r := pcapRecord{inclLen: le.Uint32(b[8:]), origLen: le.Uint32(b[12:])}
+		b = b[pcapRecordHeadLen:]
+		if int(r.inclLen) > len(b) {
+			t.Fatalf("%s ends in a truncated record of %d bytes", file, r.inclLen)
+		}
+		r.seq = le.Uint32(b)
+		b = b[r.inclLen:]
+		records = append(records, r)
+	}
+	return records
+}
+
+func testCaptureFrame(seq, size int) []byte {
+	frame := make([]byte, size)
+	binary.LittleEndian.PutUint32(frame, uint32(seq))
+	return frame
+}
+
+func TestCaptureRotation(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "guest.pcap")
+	c, err := NewCapture(vmconfig.Capture{File: file, MaxSizeMB: 1, MaxFiles: 2})
+	if err != nil {
+		t.Fatalf("NewCapture: %v", err)
+	}
+
+	// a record of 64KiB, 15 of them fit in 1MiB after the global header
+	const frameLen, perFile = 64<<10 - pcapRecordHeadLen, 15
+	for seq := 0; seq < 4*perFile; seq++ {
+		c.writeFrame(testCaptureFrame(seq, frameLen))
+	}
+	if st := c.Status(); !st.Enabled || st.Size != pcapHeaderLen+perFile*(64<<10) {
+		t.Errorf("Status() = %+v, want a full capture file", st)
+	}
+	c.Stop()
+
+	// the oldest file is dropped, File.1 is the file before File
+	tests := []struct {
+		file     string
+		firstSeq int
+	}{
+		{file: file, firstSeq: 3 * perFile},
+		{file: file + ".1", firstSeq: 2 * perFile},
+		{file: file + ".2", firstSeq: perFile},
+	}
+	for _, tt := range tests {
+		t.Run(filepath.Base(tt.file), func(t *testing.T) {
+			if fi, err := os.Stat(tt.file); err != nil || fi.Size() > 1<<20 {
+				t.Fatalf("Stat(%s) = %v, want at most 1MiB", tt.file, err)
+			}
+			records := readPcap(t, tt.file)
+			if len(records) != perFile {
+				t.Fatalf("%d records, want %d", len(records), perFile)
+			}
+			for i, r := range records {
+				if r.inclLen != frameLen || r.origLen != frameLen || r.seq != uint32(tt.firstSeq+i) {
+					t.Errorf("record %d = %+v, want frame %d of %d bytes", i, r, tt.firstSeq+i, frameLen)
+				}
+			}
+		})
+	}
+	if _, err = os.Stat(file + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 is kept beyond MaxFiles: %v", file, err)
+	}
+
+	// frames written after Stop are dropped
+	c.writeFrame(testCaptureFrame(0, 64))
+	if got := readPcap(t, file); len(got) != perFile {
+		t.Errorf("%d records after Stop, want %d", len(got), perFile)
+	}
+}
+
+func TestCaptureSnapLen(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "guest.pcap")
+	c, err := NewCapture(vmconfig.Capture{File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, size := range []int{60, pcapSnapLen + 100} {
+		c.writeFrame(testCaptureFrame(i, size))
+	}
+	c.Stop()
+
+	records := readPcap(t, file)
+	want := []pcapRecord{
+		{inclLen: 60, origLen: 60, seq: 0},
+		{inclLen: pcapSnapLen, origLen: pcapSnapLen + 100, seq: 1},
+	}
+	if fmt.Sprint(records) != fmt.Sprint(want) {
+		t.Errorf("records = %+v, want %+v", records, want)
+	}
+}
+
+func TestCaptureRestart(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "guest.pcap")
+	c, err := NewCapture(vmconfig.Capture{File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.writeFrame(testCaptureFrame(0, 60))
+
+	// a start truncates the file
+	if err = c.Start(vmconfig.Capture{File: file}); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	c.writeFrame(testCaptureFrame(1, 60))
+	c.Stop()
+
+	records := readPcap(t, file)
+	if len(records) != 1 || records[0].seq != 1 {
+		t.Errorf("records = %+v, want the frame after the restart", records)
+	}
+	if err = c.Start(vmconfig.Capture{File: file, MaxSizeMB: -1}); err == nil {
+		t.Error("Start with a negative max size succeeded")
+	}
+}
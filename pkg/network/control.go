@@ -0,0 +1,87 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// controlClient sends json requests to the http api gvproxy serves on the
+// control endpoint of a running vm
+type controlClient struct {
+	client *http.Client
+}
+
+// newControlClient returns a client of the gvproxy control endpoint, e.g.
+// unix:///path/to/gvproxy-control.sock
+func newControlClient(endpoint string) (*controlClient, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse url: %w", err)
+	}
+	if u.Scheme != "unix" {
+		return nil, fmt.Errorf("unsupported gvproxy control endpoint %q", endpoint)
+	}
+
+	dialer := net.Dialer{}
+	return &controlClient{
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", u.Path)
+				},
+			},
+		},
+	}, nil
+}
+
+func (c *controlClient) get(ctx context.Context, path string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://gvproxy"+path, nil)
+	if err != nil {
+		return err
+	}
+	return c.do(req, out)
+}
+
+func (c *controlClient) post(ctx context.Context, path string, body, out any) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://gvproxy"+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return c.do(req, out)
+}
+
+// do sends req and decodes the response into out if it is not nil, gvproxy
+// reports errors as plain text bodies
+func (c *controlClient) do(req *http.Request, out any) error {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("gvproxy: %s", strings.TrimSpace(string(msg)))
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
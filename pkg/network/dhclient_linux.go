@@ -3,13 +3,18 @@
 package network
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"syscall"
 	"time"
 
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv4/client4"
 	"github.com/insomniacslk/dhcp/netboot"
+	"github.com/jsimonetti/rtnetlink/rtnl"
+	"github.com/mdlayher/netlink"
 	"github.com/sirupsen/logrus"
 )
 
@@ -24,7 +29,49 @@ func DHClient4(ifName string, attempts int, verbose bool) error {
 		return fmt.Errorf("failed to get dhcp config: %w", err)
 	}
 
-	return netboot.ConfigureInterface(ifName, &bootConf.NetConf)
+	return configureInterface(ifName, &bootConf.NetConf)
+}
+
+// configureInterface is netboot.ConfigureInterface without writing
+// /etc/resolv.conf, the bootstrap writes it from the vm config. The address
+// and the default route must not depend on a writable /etc/resolv.conf.
+func configureInterface(ifName string, netConf *netboot.NetConf) error {
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return err
+	}
+
+	rt, err := rtnl.Dial(nil)
+	if err != nil {
+		return err
+	}
+	defer rt.Close() //nolint:errcheck
+
+	for _, addr := range netConf.Addresses {
+		if err := rt.AddrAdd(iface, &addr.IPNet); err != nil {
+			return fmt.Errorf("cannot configure %s on %s: %w", addr.IPNet.String(), ifName, err)
+		}
+	}
+
+	if len(netConf.Routers) == 0 || len(netConf.Addresses) == 0 {
+		return nil
+	}
+
+	// replace a default route without gateway, the routes of other gateways
+	// are kept
+	if err := rt.RouteDel(iface, net.IPNet{IP: net.IPv4zero}); err != nil {
+		var opErr *netlink.OpError
+		if !errors.As(err, &opErr) || !(os.IsExist(opErr.Err) || errors.Is(opErr.Err, syscall.ESRCH)) {
+			return fmt.Errorf("could not delete default route on interface %s: %w", ifName, err)
+		}
+	}
+
+	dst := net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}
+	src := netConf.Addresses[0].IPNet
+	if err := rt.RouteAdd(iface, dst, netConf.Routers[0], rtnl.WithRouteSrc(&src)); err != nil {
+		return fmt.Errorf("could not add gateway %s to interface %s: %w", netConf.Routers[0], ifName, err)
+	}
+	return nil
 }
 
 func BringInterfaceUp(ifName string) (_ *net.Interface, err error) {
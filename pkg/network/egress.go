@@ -0,0 +1,303 @@
+package network
+
+import (
+	"fmt"
+	"linuxvm/pkg/vmconfig"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// a denied flow is logged once in the interval, the guest retries a lot
+	egressLogInterval = 10 * time.Second
+	egressLogMax      = 1024
+)
+
+// Egress enforces the egress policy of the vm on the frames the guest sends.
+// Traffic to the gateway, e.g. dhcp and dns, is always allowed, except the dns
+// queries of denied domains, which are answered with NXDOMAIN. With the
+// default deny a domain is denied unless an allow rule matches it, so a
+// denied guest can not tunnel data out in dns queries. The answers of the
+// gateway dns server are recorded, so the domain rules match the addresses
+// the domains resolved to.
+type Egress struct {
+	rules     []egressRule
+	deny      bool
+	gateway   net.IP
+	broadcast net.IP
+	// domains is true if a rule matches by domain
+	domains bool
+
+	mu       sync.Mutex
+	resolved map[string]map[string]struct{}
+	logged   map[string]time.Time
+}
+
+type egressRule struct {
+	vmconfig.EgressRule
+	cidr   *net.IPNet
+	lo, hi uint16
+}
+
+// NewEgress returns the enforcer of the egress policy of n, nil if the policy
+// does not restrict anything
+func NewEgress(n vmconfig.Network) (*Egress, error) {
+	if !n.Egress.Enabled() {
+		return nil, nil
+	}
+
+	_, subnet, err := net.ParseCIDR(n.Subnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet %q: %w", n.Subnet, err)
+	}
+
+	e := &Egress{
+		deny:      n.Egress.Default == vmconfig.EgressDeny,
+		gateway:   net.ParseIP(n.GatewayIP).To4(),
+		broadcast: broadcastIP(subnet),
+		domains:   n.Egress.HasDomainRules(),
+		resolved:  map[string]map[string]struct{}{},
+		logged:    map[string]time.Time{},
+	}
+	for _, r := range n.Egress.Rules {
+		rule := egressRule{EgressRule: r}
+		if r.CIDR != "" {
+			_, cidr, err := net.ParseCIDR(r.CIDR)
+			if err != nil {
+				return nil, fmt.Errorf("invalid egress cidr %q: %w", r.CIDR, err)
+			}
+			rule.cidr = cidr
+		}
+		lo, hi, err := r.PortRange()
+		if err != nil {
+			return nil, err
+		}
+		rule.lo, rule.hi = lo, hi
+		e.rules = append(e.rules, rule)
+	}
+
+	logrus.Infof("egress policy: rules %v, default %s", n.Egress.Rules, n.Egress.Default)
+	return e, nil
+}
+
+// Wrap returns conn whose frames are filtered by the policy, conn must carry
+// one frame per read and write
+func (e *Egress) Wrap(conn net.Conn) net.Conn {
+	return &egressConn{Conn: conn, egress: e}
+}
+
+type egressConn struct {
+	net.Conn
+	egress *Egress
+}
+
+// Read drops the frames of the guest the policy denies
+func (ec *egressConn) Read(b []byte) (int, error) {
+	for {
+		n, err := ec.Conn.Read(b)
+		if err != nil || n == 0 || ec.egress.allow(ec.Conn, b[:n]) {
+			return n, err
+		}
+	}
+}
+
+func (ec *egressConn) Write(b []byte) (int, error) {
+	ec.egress.record(b)
+	return ec.Conn.Write(b)
+}
+
+// allow decides a frame sent by the guest, guest is the conn to answer a
+// denied dns query on
+func (e *Egress) allow(guest net.Conn, frame []byte) bool {
+	pkt, ok := parseFrame(frame)
+	if !ok {
+		// gvproxy only routes ipv4, arp resolves the gateway
+		return isARP(frame)
+	}
+
+	if pkt.dst.Equal(e.gateway) {
+		return e.allowGateway(guest, frame, pkt)
+	}
+	// broadcast and multicast do not leave the virtual network, e.g. dhcp
+	if pkt.dst.Equal(net.IPv4bcast) || pkt.dst.Equal(e.broadcast) || pkt.dst.IsMulticast() {
+		return true
+	}
+
+	if rule, allowed := e.decide(pkt); !allowed {
+		e.logDenied(pkt.String(), rule)
+		return false
+	}
+	return true
+}
+
+// allowGateway answers the dns queries of denied domains with NXDOMAIN. The
+// queries of dns over tcp are not looked at, it is denied with the default
+// deny or if a rule matches by domain, as are the queries which do not parse.
+func (e *Egress) allowGateway(guest net.Conn, frame []byte, pkt packet) bool {
+	if !pkt.hasPorts || pkt.dstPort != dnsPort {
+		return true
+	}
+	strict := e.deny || e.domains
+	if pkt.proto == vmconfig.TCP {
+		return !strict
+	}
+
+	query := new(dns.Msg)
+	if err := query.Unpack(pkt.payload); err != nil || len(query.Question) == 0 {
+		return !strict
+	}
+	for _, q := range query.Question {
+		rule, allowed := e.decideDomain(q.Name)
+		if allowed {
+			continue
+		}
+
+		e.logDenied(fmt.Sprintf("dns query %s of %s", q.Name, pkt.src), rule)
+		reply := new(dns.Msg)
+		reply.SetRcode(query, dns.RcodeNameError)
+		if b, err := reply.Pack(); err == nil {
+			if _, err = guest.Write(udpReply(frame, pkt, b)); err != nil {
+				logrus.Debugf("failed to answer denied dns query: %v", err)
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// decide returns the first rule matching pkt and if pkt is allowed, the rule
+// is nil if the default action decides
+func (e *Egress) decide(pkt packet) (*egressRule, bool) {
+	var names []string
+	if e.domains {
+		e.mu.Lock()
+		for name := range e.resolved[pkt.dst.String()] {
+			names = append(names, name)
+		}
+		e.mu.Unlock()
+	}
+
+	for i := range e.rules {
+		r := &e.rules[i]
+		if r.Protocol != "" && r.Protocol != pkt.proto {
+			continue
+		}
+		if r.Ports != "" && (!pkt.hasPorts || pkt.dstPort < r.lo || pkt.dstPort > r.hi) {
+			continue
+		}
+		if r.cidr != nil && !r.cidr.Contains(pkt.dst) {
+			continue
+		}
+		if r.Domain != "" && !matchAnyDomain(r.EgressRule, names) {
+			continue
+		}
+		return r, r.Action == vmconfig.EgressAllow
+	}
+	return nil, !e.deny
+}
+
+// decideDomain decides a dns query of name by the first rule matching the
+// domain: an allow rule allows it, whatever its ports and protocol, a deny
+// rule only denies it without ports and protocol. The queries of domains no
+// rule decides follow the default, the connections to the addresses are
+// decided by decide.
+func (e *Egress) decideDomain(name string) (*egressRule, bool) {
+	for i := range e.rules {
+		r := &e.rules[i]
+		if r.Domain == "" || !r.MatchDomain(name) {
+			continue
+		}
+		if r.Action == vmconfig.EgressAllow {
+			return r, true
+		}
+		if r.Ports == "" && r.Protocol == "" {
+			return r, false
+		}
+	}
+	return nil, !e.deny
+}
+
+func matchAnyDomain(r vmconfig.EgressRule, names []string) bool {
+	for _, name := range names {
+		if r.MatchDomain(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// record keeps the addresses the gateway dns server answered, frame is sent
+// to the guest
+func (e *Egress) record(frame []byte) {
+	if !e.domains {
+		return
+	}
+	pkt, ok := parseFrame(frame)
+	if !ok || pkt.proto != vmconfig.UDP || !pkt.hasPorts || pkt.srcPort != dnsPort || !pkt.src.Equal(e.gateway) {
+		return
+	}
+
+	answer := new(dns.Msg)
+	if err := answer.Unpack(pkt.payload); err != nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, rr := range answer.Answer {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			continue
+		}
+		names := e.resolved[a.A.String()]
+		if names == nil {
+			names = map[string]struct{}{}
+			e.resolved[a.A.String()] = names
+		}
+		// the question resolves by cname to the address as well
+		names[a.Hdr.Name] = struct{}{}
+		for _, q := range answer.Question {
+			names[q.Name] = struct{}{}
+		}
+	}
+}
+
+// logDenied logs the denied flow once in egressLogInterval
+func (e *Egress) logDenied(flow string, rule *egressRule) {
+	by := "default " + vmconfig.EgressDeny
+	if rule != nil {
+		by = rule.String()
+	}
+
+	e.mu.Lock()
+	now := time.Now()
+	if len(e.logged) > egressLogMax {
+		for k, t := range e.logged {
+			if now.Sub(t) > egressLogInterval {
+				delete(e.logged, k)
+			}
+		}
+	}
+	last, found := e.logged[flow]
+	log := !found || now.Sub(last) > egressLogInterval
+	if log {
+		e.logged[flow] = now
+	}
+	e.mu.Unlock()
+
+	if log {
+		logrus.Warnf("egress denied: %s by %s", flow, by)
+	}
+}
+
+func broadcastIP(subnet *net.IPNet) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	for i := range ip {
+		ip[i] = subnet.IP.To4()[i] | ^subnet.Mask[i]
+	}
+	return ip
+}
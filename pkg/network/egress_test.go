@@ -0,0 +1,226 @@
+package network
+
+import (
+	"linuxvm/pkg/vmconfig"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	testGuest   = "192.168.127.2"
+	testGateway = "192.168.127.1"
+)
+
+// guestConn records the frames written to the guest
+type guestConn struct {
+	net.Conn
+	frames [][]byte
+}
+
+func (c *guestConn) Write(b []byte) (int, error) {
+	c.frames = append(c.frames, append([]byte{}, b...))
+	return len(b), nil
+}
+
+func newTestEgress(t *testing.T, def string, rules ...string) *Egress {
+	t.Helper()
+	policy := vmconfig.EgressPolicy{Default: def}
+	for _, s := range rules {
+		r, err := vmconfig.ParseEgressRule(s)
+		if err != nil {
+			t.Fatalf("ParseEgressRule(%q): %v", s, err)
+		}
+		policy.Rules = append(policy.Rules, r)
+	}
+	e, err := NewEgress(vmconfig.Network{Subnet: "192.168.127.0/24", GatewayIP: testGateway, Egress: policy})
+	if err != nil {
+		t.Fatalf("NewEgress: %v", err)
+	}
+	return e
+}
+
+func dnsQueryFrame(t *testing.T, name string) []byte {
+	t.Helper()
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	b, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testFrame{proto: 17, src: testGuest, dst: testGateway, l4: udpHeader(40000, dnsPort, b)}.bytes()
+}
+
+func dnsAnswerFrame(t *testing.T, name, ip string) []byte {
+	t.Helper()
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	answer := new(dns.Msg)
+	answer.SetReply(query)
+	answer.Answer = append(answer.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP(ip),
+	})
+	b, err := answer.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testFrame{proto: 17, src: testGateway, dst: testGuest, l4: udpHeader(dnsPort, 40000, b)}.bytes()
+}
+
+func tcpFrame(dst string, port uint16) []byte {
+	return testFrame{proto: 6, src: testGuest, dst: dst, l4: tcpHeader(40000, port, tcpSYN, nil)}.bytes()
+}
+
+func TestEgressAllow(t *testing.T) {
+	arp := make([]byte, etherHeaderLen+28)
+	arp[12], arp[13] = 0x08, 0x06
+
+	tests := []struct {
+		name   string
+		def    string
+		rules  []string
+		frame  []byte
+		want   bool
+		answer bool
+	}{
+		{
+			name:  "deny rule before allow rule",
+			rules: []string{"deny:10.0.0.0/8", "allow:10.1.0.0/16"},
+			frame: tcpFrame("10.1.2.3", 443),
+		},
+		{
+			name:  "allow rule before deny rule",
+			rules: []string{"allow:10.1.0.0/16", "deny:10.0.0.0/8"},
+			frame: tcpFrame("10.1.2.3", 443),
+			want:  true,
+		},
+		{
+			name:  "port out of the rule range follows the default",
+			def:   vmconfig.EgressDeny,
+			rules: []string{"allow:0.0.0.0/0:8000-9000/tcp"},
+			frame: tcpFrame("1.1.1.1", 443),
+		},
+		{
+			name:  "port in the rule range",
+			def:   vmconfig.EgressDeny,
+			rules: []string{"allow:0.0.0.0/0:8000-9000/tcp"},
+			frame: tcpFrame("1.1.1.1", 8080),
+			want:  true,
+		},
+		{
+			name:  "later fragment does not match a port rule",
+			def:   vmconfig.EgressDeny,
+			rules: []string{"allow:0.0.0.0/0:53/udp"},
+			frame: testFrame{proto: 17, src: testGuest, dst: "1.1.1.1", fragmentOffset: 185, l4: udpHeader(40000, 53, nil)}.bytes(),
+		},
+		{
+			name:  "arp",
+			def:   vmconfig.EgressDeny,
+			frame: arp,
+			want:  true,
+		},
+		{
+			name:  "truncated frame",
+			rules: []string{"deny:10.0.0.0/8"},
+			frame: tcpFrame("1.1.1.1", 443)[:etherHeaderLen+10],
+		},
+		{
+			name:  "dhcp broadcast under default deny",
+			def:   vmconfig.EgressDeny,
+			frame: testFrame{proto: 17, src: "0.0.0.0", dst: "255.255.255.255", l4: udpHeader(68, 67, nil)}.bytes(),
+			want:  true,
+		},
+		{
+			name:   "unknown domain under default deny",
+			def:    vmconfig.EgressDeny,
+			rules:  []string{"allow:example.com"},
+			frame:  dnsQueryFrame(t, "unknown.org"),
+			answer: true,
+		},
+		{
+			name:  "allowed domain under default deny",
+			def:   vmconfig.EgressDeny,
+			rules: []string{"allow:example.com:443/tcp"},
+			frame: dnsQueryFrame(t, "www.example.com"),
+			want:  true,
+		},
+		{
+			name:   "denied domain",
+			rules:  []string{"deny:example.com"},
+			frame:  dnsQueryFrame(t, "example.com"),
+			answer: true,
+		},
+		{
+			name:  "unknown domain under default allow",
+			rules: []string{"deny:example.com"},
+			frame: dnsQueryFrame(t, "unknown.org"),
+			want:  true,
+		},
+		{
+			name:  "dns over tcp under default deny",
+			def:   vmconfig.EgressDeny,
+			rules: []string{"allow:1.1.1.1"},
+			frame: tcpFrame(testGateway, dnsPort),
+		},
+		{
+			name:  "dns over tcp with domain rules",
+			rules: []string{"deny:example.com"},
+			frame: tcpFrame(testGateway, dnsPort),
+		},
+		{
+			name:  "dns over tcp without domain rules",
+			rules: []string{"deny:10.0.0.0/8"},
+			frame: tcpFrame(testGateway, dnsPort),
+			want:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEgress(t, tt.def, tt.rules...)
+			guest := &guestConn{}
+			if got := e.allow(guest, tt.frame); got != tt.want {
+				t.Errorf("allow() = %v, want %v", got, tt.want)
+			}
+			if tt.answer != (len(guest.frames) == 1) {
+				t.Fatalf("got %d answers to the guest, want an answer %v", len(guest.frames), tt.answer)
+			}
+			if !tt.answer {
+				return
+			}
+
+			pkt, ok := parseFrame(guest.frames[0])
+			if !ok {
+				t.Fatal("the answer does not parse")
+			}
+			reply := new(dns.Msg)
+			if err := reply.Unpack(pkt.payload); err != nil {
+				t.Fatalf("the answer is no dns message: %v", err)
+			}
+			if reply.Rcode != dns.RcodeNameError {
+				t.Errorf("answer rcode = %s, want NXDOMAIN", dns.RcodeToString[reply.Rcode])
+			}
+		})
+	}
+}
+
+func TestEgressRecord(t *testing.T) {
+	e := newTestEgress(t, vmconfig.EgressDeny, "allow:example.com:443/tcp")
+
+	if e.allow(&guestConn{}, tcpFrame("93.184.216.34", 443)) {
+		t.Fatal("the address is allowed before the domain resolved to it")
+	}
+
+	e.record(dnsAnswerFrame(t, "example.com", "93.184.216.34"))
+	if !e.allow(&guestConn{}, tcpFrame("93.184.216.34", 443)) {
+		t.Error("the resolved address of an allowed domain is denied")
+	}
+	if e.allow(&guestConn{}, tcpFrame("93.184.216.34", 80)) {
+		t.Error("the resolved address is allowed on a port the rule does not cover")
+	}
+	if e.allow(&guestConn{}, tcpFrame("93.184.216.35", 443)) {
+		t.Error("an address the domain did not resolve to is allowed")
+	}
+}
@@ -0,0 +1,101 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"linuxvm/pkg/vmconfig"
+	"net"
+	"strconv"
+
+	gvptypes "github.com/containers/gvisor-tap-vsock/pkg/types"
+)
+
+const forwarderPath = "/services/forwarder"
+
+// ForwarderClient talks to the port forwarder API gvproxy serves on the
+// control endpoint of a running vm, ports exposed by it last until the vm
+// stops.
+type ForwarderClient struct {
+	ctl     *controlClient
+	guestIP string
+}
+
+// NewForwarderClient returns a client of the gvproxy control endpoint, e.g.
+// unix:///path/to/gvproxy-control.sock, ports are forwarded to guestIP
+func NewForwarderClient(endpoint, guestIP string) (*ForwarderClient, error) {
+	ctl, err := newControlClient(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &ForwarderClient{ctl: ctl, guestIP: guestIP}, nil
+}
+
+// List returns the tcp and udp ports forwarded to the guest
+func (c *ForwarderClient) List(ctx context.Context) ([]vmconfig.PortMapping, error) {
+	var forwards []gvptypes.ExposeRequest
+	if err := c.ctl.get(ctx, forwarderPath+"/all", &forwards); err != nil {
+		return nil, fmt.Errorf("failed to list forwarded ports: %w", err)
+	}
+
+	ports := make([]vmconfig.PortMapping, 0, len(forwards))
+	for _, f := range forwards {
+		if f.Protocol != gvptypes.TCP && f.Protocol != gvptypes.UDP {
+			continue
+		}
+		p, err := portMappingOf(f)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, p)
+	}
+
+	return ports, nil
+}
+
+// Expose forwards the host address of p to the guest port of p
+func (c *ForwarderClient) Expose(ctx context.Context, p vmconfig.PortMapping) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	err := c.ctl.post(ctx, forwarderPath+"/expose", gvptypes.ExposeRequest{
+		Local:    p.HostAddr(),
+		Remote:   net.JoinHostPort(c.guestIP, strconv.Itoa(int(p.GuestPort))),
+		Protocol: gvptypes.TransportProtocol(p.Protocol),
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to expose %s: %w", p, err)
+	}
+	return nil
+}
+
+// Unexpose stops forwarding the host address of p, the guest port is ignored
+func (c *ForwarderClient) Unexpose(ctx context.Context, p vmconfig.PortMapping) error {
+	err := c.ctl.post(ctx, forwarderPath+"/unexpose", gvptypes.UnexposeRequest{
+		Local:    p.HostAddr(),
+		Protocol: gvptypes.TransportProtocol(p.Protocol),
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to unexpose %s/%s: %w", p.HostAddr(), p.Protocol, err)
+	}
+	return nil
+}
+
+func portMappingOf(f gvptypes.ExposeRequest) (vmconfig.PortMapping, error) {
+	p, err := vmconfig.ParseHostPort(f.Local + "/" + string(f.Protocol))
+	if err != nil {
+		return p, err
+	}
+
+	_, guestPort, err := net.SplitHostPort(f.Remote)
+	if err != nil {
+		return p, fmt.Errorf("invalid remote %q of forward %s: %w", f.Remote, f.Local, err)
+	}
+	port, err := strconv.ParseUint(guestPort, 10, 16)
+	if err != nil {
+		return p, fmt.Errorf("invalid remote %q of forward %s: %w", f.Remote, f.Local, err)
+	}
+	p.GuestPort = uint16(port)
+
+	return p, nil
+}
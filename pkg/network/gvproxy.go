@@ -1,7 +1,6 @@
 package network
 
 import (
-	"bufio"
 	"context"
 	"fmt"
 	"linuxvm/pkg/vmconfig"
@@ -9,8 +8,6 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"runtime"
-	"strings"
 	"time"
 
 	"github.com/containers/gvisor-tap-vsock/pkg/transport"
@@ -22,62 +19,34 @@ import (
 )
 
 const (
-	gatewayIP   = "192.168.127.1"
-	sshHostPort = "192.168.127.2:22"
-	hostIP      = "192.168.127.254"
-	host        = "host"
-	gateway     = "gateway"
+	host    = "host"
+	gateway = "gateway"
 )
 
-func newGvpConfigure() *gvptypes.Configuration {
+func newGvpConfigure(vmc vmconfig.VMConfig) *gvptypes.Configuration {
 	protocol := gvptypes.VfkitProtocol
+	network := vmc.Network
+	gatewayIP, hostIP := network.GatewayIP, network.HostIP
 	config := gvptypes.Configuration{
 		Debug:             false,
 		CaptureFile:       "",
 		MTU:               1500,
-		Subnet:            "192.168.127.0/24",
+		Subnet:            network.Subnet,
 		GatewayIP:         gatewayIP,
-		GatewayMacAddress: "5a:94:ef:e4:0c:dd",
+		GatewayMacAddress: network.GatewayMAC,
 		DHCPStaticLeases: map[string]string{
-			"192.168.127.2": "5a:94:ef:e4:0c:ee",
+			network.GuestIP: network.GuestMAC,
 		},
-		DNS: []gvptypes.Zone{
-			{
-				Name: "containers.internal.",
-				Records: []gvptypes.Record{
-					{
-						Name: gateway,
-						IP:   net.ParseIP(gatewayIP),
-					},
-					{
-						Name: host,
-						IP:   net.ParseIP(hostIP),
-					},
-				},
-			},
-			{
-				Name: "docker.internal.",
-				Records: []gvptypes.Record{
-					{
-						Name: gateway,
-						IP:   net.ParseIP(gatewayIP),
-					},
-					{
-						Name: host,
-						IP:   net.ParseIP(hostIP),
-					},
-				},
-			},
-		},
-		DNSSearchDomains: searchDomains(),
-		// by default, we forward host:2222 to 192.168.127.2:22
-		Forwards: getForwardsMap(2222, sshHostPort),
+		DNS:              dnsZones(network),
+		DNSSearchDomains: vmc.Resolver.Search,
+		// the published ports, and by default host:2222 to the guest ssh port
+		Forwards: forwardsMap(network.GuestIP, vmc.Ports),
 		NAT: map[string]string{
 			hostIP: "127.0.0.1",
 		},
 		GatewayVirtualIPs: []string{hostIP},
 		VpnKitUUIDMacAddresses: map[string]string{
-			"c3d68012-0208-11ea-9fd7-f2189899ab08": "5a:94:ef:e4:0c:ee",
+			"c3d68012-0208-11ea-9fd7-f2189899ab08": network.GuestMAC,
 		},
 		Protocol: protocol,
 	}
@@ -86,62 +55,30 @@ func newGvpConfigure() *gvptypes.Configuration {
 
 }
 
-func searchDomains() []string {
-	if runtime.GOOS == "darwin" || runtime.GOOS == "linux" {
-		f, err := os.Open("/etc/resolv.conf")
-		if err != nil {
-			logrus.Errorf("open file error: %v", err)
-			return nil
-		}
-		defer f.Close() //nolint:errcheck
-		sc := bufio.NewScanner(f)
-		searchPrefix := "search "
-		for sc.Scan() {
-			if strings.HasPrefix(sc.Text(), searchPrefix) {
-				return parseSearchString(sc.Text(), searchPrefix)
-			}
-		}
-		if err := sc.Err(); err != nil {
-			logrus.Errorf("scan file error: %v", err)
-			return nil
-		}
+// dnsZones are the default zones resolving gateway and host, plus the zones
+// of the user, records of a user zone with a default name are added to it
+func dnsZones(network vmconfig.Network) []gvptypes.Zone {
+	defaults := []vmconfig.HostEntry{
+		{Name: gateway, IP: network.GatewayIP},
+		{Name: host, IP: network.HostIP},
 	}
-	return nil
-}
-
-// Parse and sanitize search list
-// macOS has limitation on number of domains (6) and general string length (256 characters)
-// since glibc 2.26 Linux has no limitation on 'search' field
-func parseSearchString(text, searchPrefix string) []string {
-	// macOS allow only 265 characters in search list
-	if runtime.GOOS == "darwin" && len(text) > 256 {
-		logrus.Errorf("Search domains list is too long, it should not exceed 256 chars on macOS: %d", len(text))
-		text = text[:256]
-		lastSpace := strings.LastIndex(text, " ")
-		if lastSpace != -1 {
-			text = text[:lastSpace]
+	zones := vmconfig.MergeDNSZones([]vmconfig.DNSZone{
+		{Name: "containers.internal", Records: defaults},
+		{Name: "docker.internal", Records: defaults},
+	}, network.DNSZones)
+
+	gvpZones := make([]gvptypes.Zone, 0, len(zones))
+	for _, z := range zones {
+		gvpZone := gvptypes.Zone{Name: z.Name + "."}
+		for _, r := range z.Records {
+			gvpZone.Records = append(gvpZone.Records, gvptypes.Record{
+				Name: r.Name,
+				IP:   net.ParseIP(r.IP),
+			})
 		}
+		gvpZones = append(gvpZones, gvpZone)
 	}
-
-	searchDomains := strings.Split(strings.TrimPrefix(text, searchPrefix), " ")
-	logrus.Infof("Using search domains: %v", searchDomains)
-
-	// macOS allow only 6 domains in search list
-	if runtime.GOOS == "darwin" && len(searchDomains) > 6 {
-		logrus.Errorf("Search domains list is too long, it should not exceed 6 domains on macOS: %d", len(searchDomains))
-		searchDomains = searchDomains[:6]
-	}
-
-	return searchDomains
-}
-
-func getForwardsMap(sshPort int, sshHostPort string) map[string]string {
-	if sshPort == -1 {
-		return map[string]string{}
-	}
-	return map[string]string{
-		fmt.Sprintf("127.0.0.1:%d", sshPort): sshHostPort,
-	}
+	return gvpZones
 }
 
 func httpServe(ctx context.Context, g *errgroup.Group, ln net.Listener, mux http.Handler) {
@@ -173,13 +110,21 @@ func withProfiler(vn *virtualnetwork.VirtualNetwork) http.Handler {
 	return mux
 }
 
+// controlMux serves the gvproxy api and the capture api of revm
+func controlMux(vn *virtualnetwork.VirtualNetwork, capture *Capture) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", withProfiler(vn))
+	mux.Handle(capturePath+"/", capture.Mux())
+	return mux
+}
+
 type EndPoints struct {
 	// export the http api
 	ControlEndpoints    []string
 	VFKitSocketEndpoint string
 }
 
-func run(ctx context.Context, g *errgroup.Group, configuration *gvptypes.Configuration, endpoints EndPoints) error {
+func run(ctx context.Context, g *errgroup.Group, configuration *gvptypes.Configuration, endpoints EndPoints, capture *Capture, egress *Egress, netLog *NetLog) error {
 	vn, err := virtualnetwork.New(configuration)
 	if err != nil {
 		return err
@@ -192,10 +137,10 @@ func run(ctx context.Context, g *errgroup.Group, configuration *gvptypes.Configu
 		if err != nil {
 			return errors.Wrap(err, "cannot listen")
 		}
-		httpServe(ctx, g, ln, withProfiler(vn))
+		httpServe(ctx, g, ln, controlMux(vn, capture))
 	}
 
-	ln, err := vn.Listen("tcp", fmt.Sprintf("%s:80", gatewayIP))
+	ln, err := vn.Listen("tcp", fmt.Sprintf("%s:80", configuration.GatewayIP))
 	if err != nil {
 		return err
 	}
@@ -226,7 +171,16 @@ func run(ctx context.Context, g *errgroup.Group, configuration *gvptypes.Configu
 			if err != nil {
 				return errors.Wrap(err, "vfkit accept error")
 			}
-			return vn.AcceptVfkit(ctx, vfkitConn)
+			// the capture sees the frames the egress policy denies as well,
+			// the network log only the allowed ones
+			conn := capture.Wrap(vfkitConn)
+			if egress != nil {
+				conn = egress.Wrap(conn)
+			}
+			if netLog != nil {
+				conn = netLog.Wrap(conn)
+			}
+			return vn.AcceptVfkit(ctx, conn)
 		})
 	}
 
@@ -241,5 +195,24 @@ func StartNetworking(ctx context.Context, vmc vmconfig.VMConfig) error {
 		VFKitSocketEndpoint: vmc.NetworkStackBackend,
 	}
 
-	return run(ctx, g, newGvpConfigure(), endpoints)
+	capture, err := NewCapture(vmc.Network.Capture)
+	if err != nil {
+		return err
+	}
+	defer capture.Stop()
+
+	egress, err := NewEgress(vmc.Network)
+	if err != nil {
+		return err
+	}
+
+	netLog, err := NewNetLog(vmc.Network)
+	if err != nil {
+		return err
+	}
+	if netLog != nil {
+		defer netLog.Close()
+	}
+
+	return run(ctx, g, newGvpConfigure(vmc), endpoints, capture, egress, netLog)
 }
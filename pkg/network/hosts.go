@@ -0,0 +1,76 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"linuxvm/pkg/vmconfig"
+	"net"
+	"os"
+	"strings"
+)
+
+const hostsHeader = "# added by revm"
+
+// ParseHostsFile reads the entries of a hosts file which are reachable from
+// the guest, loopback, link-local and unspecified addresses are skipped
+func ParseHostsFile(file string) ([]vmconfig.HostEntry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open hosts file: %w", err)
+	}
+	defer f.Close() //nolint:errcheck
+
+	var entries []vmconfig.HostEntry
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil || ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+			continue
+		}
+		for _, name := range fields[1:] {
+			entry := vmconfig.HostEntry{Name: name, IP: ip.String()}
+			if entry.Validate() == nil {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	return entries, sc.Err()
+}
+
+// HostsFile returns base, the /etc/hosts of the guest, with the hosts and the
+// dns zone records of n appended, nil if n has none of them
+func HostsFile(base []byte, n vmconfig.Network) []byte {
+	if len(n.Hosts) == 0 && len(n.DNSZones) == 0 {
+		return nil
+	}
+
+	var b bytes.Buffer
+	if len(bytes.TrimSpace(base)) == 0 {
+		b.WriteString("127.0.0.1\tlocalhost\n::1\tlocalhost\n")
+	} else {
+		b.Write(base)
+		if !bytes.HasSuffix(base, []byte("\n")) {
+			b.WriteString("\n")
+		}
+	}
+
+	b.WriteString(hostsHeader + "\n")
+	for _, h := range n.Hosts {
+		fmt.Fprintf(&b, "%s\t%s\n", h.IP, h.Name)
+	}
+	for _, z := range n.DNSZones {
+		for _, r := range z.Records {
+			fmt.Fprintf(&b, "%s\t%s\n", r.IP, z.FQDN(r))
+		}
+	}
+
+	return b.Bytes()
+}
@@ -0,0 +1,253 @@
+package network
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"linuxvm/pkg/define"
+	"linuxvm/pkg/system"
+	"linuxvm/pkg/vmconfig"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// DefaultSubnetPool is split into /24 subnets, one per vm
+	DefaultSubnetPool = "192.168.128.0/17"
+	leaseSubnetPrefix = 24
+
+	// guest macs are allocated in the prefix of vmconfig.DefaultGuestMAC
+	macPrefix0, macPrefix1, macPrefix2 = 0x5a, 0x94, 0xef
+)
+
+// Lease is the network allocated to a vm. A named vm keeps its lease until it
+// is removed, a one-shot vm only while its revm process is alive.
+type Lease struct {
+	Name     string `json:"name,omitempty"`
+	PID      int    `json:"pid,omitempty"`
+	Subnet   string `json:"subnet"`
+	GuestIP  string `json:"guestIP"`
+	GuestMAC string `json:"guestMAC"`
+}
+
+// IPAM allocates a distinct subnet, guest ip and mac to every vm from a pool
+// of subnets, the leases are persisted in a file of the state dir and shared
+// by all revm processes.
+type IPAM struct {
+	dir  string
+	pool *net.IPNet
+}
+
+// SubnetPool is the pool of $REVM_SUBNET_POOL, DefaultSubnetPool if it is
+// not set
+func SubnetPool() string {
+	if pool := os.Getenv(define.SubnetPoolEnv); pool != "" {
+		return pool
+	}
+	return DefaultSubnetPool
+}
+
+// NewIPAM returns the IPAM keeping its leases in dir, pool is an ipv4 subnet
+// of prefix length 24 or shorter.
+func NewIPAM(dir, pool string) (*IPAM, error) {
+	_, ipNet, err := net.ParseCIDR(pool)
+	if err != nil || ipNet.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid subnet pool %q, must be an ipv4 subnet", pool)
+	}
+	if ones, _ := ipNet.Mask.Size(); ones > leaseSubnetPrefix {
+		return nil, fmt.Errorf("subnet pool %q is too small, the prefix length must be at most %d", pool, leaseSubnetPrefix)
+	}
+
+	return &IPAM{dir: dir, pool: ipNet}, nil
+}
+
+// Allocate leases the network of a vm, a named vm is identified by name and a
+// one-shot vm by the pid of its revm process. The values given in want are
+// kept, the subnet is picked from the pool and the mac is generated if they
+// are empty. An error is returned if the subnet or the mac is leased to
+// another vm.
+func (m *IPAM) Allocate(name string, pid int, want vmconfig.Network) (vmconfig.Network, error) {
+	network := want
+
+	err := m.update(func(leases []Lease) ([]Lease, error) {
+		leases = slices.DeleteFunc(leases, func(l Lease) bool {
+			return name != "" && l.Name == name
+		})
+
+		if network.Subnet == "" {
+			subnet, err := m.freeSubnet(leases)
+			if err != nil {
+				return nil, err
+			}
+			network.Subnet = subnet
+		}
+		if network.GuestMAC == "" {
+			mac, err := freeMAC(leases)
+			if err != nil {
+				return nil, err
+			}
+			network.GuestMAC = mac
+		}
+		if err := network.SetDefaults(); err != nil {
+			return nil, err
+		}
+
+		_, subnet, _ := net.ParseCIDR(network.Subnet)
+		for _, l := range leases {
+			_, leased, err := net.ParseCIDR(l.Subnet)
+			if err == nil && (leased.Contains(subnet.IP) || subnet.Contains(leased.IP)) {
+				return nil, fmt.Errorf("subnet %s collides with %s leased to %s", subnet, leased, l.owner())
+			}
+			if l.GuestMAC == network.GuestMAC {
+				return nil, fmt.Errorf("guest mac %s is leased to %s", l.GuestMAC, l.owner())
+			}
+		}
+
+		return append(leases, Lease{
+			Name:     name,
+			PID:      pid,
+			Subnet:   network.Subnet,
+			GuestIP:  network.GuestIP,
+			GuestMAC: network.GuestMAC,
+		}), nil
+	})
+	if err != nil {
+		return vmconfig.Network{}, err
+	}
+
+	return network, nil
+}
+
+// Release drops the lease of the named vm
+func (m *IPAM) Release(name string) error {
+	return m.update(func(leases []Lease) ([]Lease, error) {
+		return slices.DeleteFunc(leases, func(l Lease) bool { return l.Name == name }), nil
+	})
+}
+
+// ReleasePID drops the lease of the one-shot vm run by pid
+func (m *IPAM) ReleasePID(pid int) error {
+	return m.update(func(leases []Lease) ([]Lease, error) {
+		return slices.DeleteFunc(leases, func(l Lease) bool { return l.Name == "" && l.PID == pid }), nil
+	})
+}
+
+// Leases returns the leases in use
+func (m *IPAM) Leases() ([]Lease, error) {
+	var leases []Lease
+	err := m.update(func(l []Lease) ([]Lease, error) {
+		leases = l
+		return l, nil
+	})
+	return leases, err
+}
+
+func (l Lease) owner() string {
+	if l.Name != "" {
+		return fmt.Sprintf("vm %q", l.Name)
+	}
+	return fmt.Sprintf("revm process %d", l.PID)
+}
+
+// freeSubnet returns the first subnet of the pool which is neither leased
+// nor collides with the host routes
+func (m *IPAM) freeSubnet(leases []Lease) (string, error) {
+	poolOnes, _ := m.pool.Mask.Size()
+	mask := net.CIDRMask(leaseSubnetPrefix, 32)
+	base := m.pool.IP.To4()
+
+next:
+	for i := 0; i < 1<<(leaseSubnetPrefix-poolOnes); i++ {
+		ip := make(net.IP, 4)
+		copy(ip, base)
+		v := uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+		v += uint32(i) << (32 - leaseSubnetPrefix)
+		subnet := &net.IPNet{IP: net.IPv4(byte(v>>24), byte(v>>16), byte(v>>8), byte(v)).To4(), Mask: mask}
+
+		for _, l := range leases {
+			_, leased, err := net.ParseCIDR(l.Subnet)
+			if err == nil && (leased.Contains(subnet.IP) || subnet.Contains(leased.IP)) {
+				continue next
+			}
+		}
+		if CheckSubnet(subnet.String()) != nil {
+			continue
+		}
+
+		return subnet.String(), nil
+	}
+
+	return "", fmt.Errorf("no free subnet left in pool %s, remove unused vms or set %s", m.pool, define.SubnetPoolEnv)
+}
+
+// freeMAC generates a locally administered unicast mac which is not leased
+func freeMAC(leases []Lease) (string, error) {
+	for {
+		b := make([]byte, 3)
+		if _, err := rand.Read(b); err != nil {
+			return "", fmt.Errorf("failed to generate mac: %w", err)
+		}
+		mac := net.HardwareAddr{macPrefix0, macPrefix1, macPrefix2, b[0], b[1], b[2]}.String()
+
+		used := mac == vmconfig.DefaultGuestMAC
+		for _, l := range leases {
+			used = used || l.GuestMAC == mac
+		}
+		if !used {
+			return mac, nil
+		}
+	}
+}
+
+// update runs fn on the leases under an exclusive lock and saves the result,
+// the leases of one-shot vms whose revm process is gone are dropped first
+func (m *IPAM) update(fn func([]Lease) ([]Lease, error)) error {
+	if err := os.MkdirAll(m.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create state dir: %w", err)
+	}
+
+	lock, err := os.OpenFile(filepath.Join(m.dir, define.LeasesLock), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open lock file: %w", err)
+	}
+	defer lock.Close() //nolint:errcheck
+
+	if err = unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock leases: %w", err)
+	}
+	defer unix.Flock(int(lock.Fd()), unix.LOCK_UN) //nolint:errcheck
+
+	file := filepath.Join(m.dir, define.LeasesFile)
+	var leases []Lease
+	b, err := os.ReadFile(file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read leases: %w", err)
+	}
+	if len(b) > 0 {
+		if err = json.Unmarshal(b, &leases); err != nil {
+			return fmt.Errorf("failed to parse leases %q: %w", file, err)
+		}
+	}
+
+	leases = slices.DeleteFunc(leases, func(l Lease) bool {
+		return l.Name == "" && !system.IsProcessAlive(l.PID)
+	})
+
+	if leases, err = fn(leases); err != nil {
+		return err
+	}
+
+	if b, err = json.MarshalIndent(leases, "", "  "); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err = os.WriteFile(tmp, b, 0644); err != nil {
+		return fmt.Errorf("failed to save leases: %w", err)
+	}
+	return os.Rename(tmp, file)
+}
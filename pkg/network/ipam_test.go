@@ -0,0 +1,252 @@
+package network
+
+import (
+	"linuxvm/pkg/define"
+	"linuxvm/pkg/vmconfig"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// testPool is unlikely to collide with the routes of the test host
+const testPool = "10.253.0.0/23"
+
+func newTestIPAM(t *testing.T, pool string) *IPAM {
+	t.Helper()
+	m, err := NewIPAM(t.TempDir(), pool)
+	if err != nil {
+		t.Fatalf("NewIPAM(%q): %v", pool, err)
+	}
+	return m
+}
+
+// deadPID returns the pid of a process which exited
+func deadPID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+func leaseOwners(t *testing.T, m *IPAM) []string {
+	t.Helper()
+	leases, err := m.Leases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var owners []string
+	for _, l := range leases {
+		owners = append(owners, l.owner())
+	}
+	return owners
+}
+
+func TestNewIPAM(t *testing.T) {
+	tests := []struct {
+		pool    string
+		wantErr bool
+	}{
+		{pool: DefaultSubnetPool},
+		{pool: "10.0.0.0/24"},
+		{pool: "10.0.0.0/25", wantErr: true},
+		{pool: "fd00::/64", wantErr: true},
+		{pool: "10.0.0.0", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pool, func(t *testing.T) {
+			if _, err := NewIPAM(t.TempDir(), tt.pool); (err != nil) != tt.wantErr {
+				t.Errorf("NewIPAM(%q) error = %v, want error %v", tt.pool, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIPAMAllocate(t *testing.T) {
+	m := newTestIPAM(t, testPool)
+
+	a, err := m.Allocate("a", 0, vmconfig.Network{})
+	if err != nil {
+		t.Fatalf("Allocate(a): %v", err)
+	}
+	if a.Subnet != "10.253.0.0/24" || a.GuestIP == "" || a.GatewayIP == "" {
+		t.Errorf("Allocate(a) = subnet %s, guest %s, gateway %s, want the first subnet of the pool", a.Subnet, a.GuestIP, a.GatewayIP)
+	}
+	if !strings.HasPrefix(a.GuestMAC, "5a:94:ef:") {
+		t.Errorf("Allocate(a) mac = %s, want the prefix 5a:94:ef", a.GuestMAC)
+	}
+
+	b, err := m.Allocate("", os.Getpid(), vmconfig.Network{})
+	if err != nil {
+		t.Fatalf("Allocate(pid): %v", err)
+	}
+	if b.Subnet != "10.253.1.0/24" || b.GuestMAC == a.GuestMAC {
+		t.Errorf("Allocate(pid) = %s %s, want the next subnet and another mac than %s", b.Subnet, b.GuestMAC, a.GuestMAC)
+	}
+
+	// the pool is used up
+	if _, err = m.Allocate("c", 0, vmconfig.Network{}); err == nil {
+		t.Error("Allocate(c) succeeded on a used up pool")
+	}
+
+	// allocating a named vm again replaces its own lease
+	again, err := m.Allocate("a", 0, vmconfig.Network{Subnet: "10.253.0.0/24"})
+	if err != nil {
+		t.Fatalf("Allocate(a) again: %v", err)
+	}
+	if again.Subnet != a.Subnet {
+		t.Errorf("Allocate(a) again = %s, want %s", again.Subnet, a.Subnet)
+	}
+	if got := leaseOwners(t, m); len(got) != 2 {
+		t.Errorf("leases %v, want a and the revm process", got)
+	}
+}
+
+func TestIPAMCollisions(t *testing.T) {
+	m := newTestIPAM(t, testPool)
+	first, err := m.Allocate("a", 0, vmconfig.Network{Subnet: "10.253.0.0/24", GuestMAC: "5a:94:ef:00:00:01"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want vmconfig.Network
+	}{
+		{name: "same subnet", want: vmconfig.Network{Subnet: first.Subnet}},
+		{name: "subnet containing the lease", want: vmconfig.Network{Subnet: "10.253.0.0/16"}},
+		{name: "subnet inside the lease", want: vmconfig.Network{Subnet: "10.253.0.128/25"}},
+		{name: "same mac", want: vmconfig.Network{Subnet: "10.253.1.0/24", GuestMAC: first.GuestMAC}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := m.Allocate("b", 0, tt.want); err == nil || !strings.Contains(err.Error(), `leased to vm "a"`) {
+				t.Errorf("Allocate(%+v) error = %v, want a collision with %s %s", tt.want, err, first.Subnet, first.GuestMAC)
+			}
+		})
+	}
+	if got := leaseOwners(t, m); len(got) != 1 {
+		t.Errorf("leases %v after the collisions, want only a", got)
+	}
+}
+
+func TestIPAMStaleLeases(t *testing.T) {
+	m := newTestIPAM(t, testPool)
+
+	if _, err := m.Allocate("", deadPID(t), vmconfig.Network{Subnet: "10.253.0.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Allocate("named", 0, vmconfig.Network{Subnet: "10.253.1.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the lease of the gone revm process is dropped, the named vm keeps its
+	// lease without a process
+	got, err := m.Allocate("", os.Getpid(), vmconfig.Network{})
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	if got.Subnet != "10.253.0.0/24" {
+		t.Errorf("Allocate() = %s, want the subnet of the stale lease", got.Subnet)
+	}
+	owners := leaseOwners(t, m)
+	if len(owners) != 2 || owners[0] != `vm "named"` {
+		t.Errorf("leases %v, want the named vm and this process", owners)
+	}
+}
+
+func TestIPAMRelease(t *testing.T) {
+	m := newTestIPAM(t, testPool)
+	for _, name := range []string{"a", "b"} {
+		if _, err := m.Allocate(name, 0, vmconfig.Network{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := m.Release("a"); err != nil {
+		t.Fatalf("Release(a): %v", err)
+	}
+	if err := m.Release("unknown"); err != nil {
+		t.Fatalf("Release(unknown): %v", err)
+	}
+	if got := leaseOwners(t, m); len(got) != 1 || got[0] != `vm "b"` {
+		t.Errorf("leases %v, want only b", got)
+	}
+
+	// the released subnet is allocated again
+	c, err := m.Allocate("c", 0, vmconfig.Network{})
+	if err != nil {
+		t.Fatalf("Allocate(c): %v", err)
+	}
+	if c.Subnet != "10.253.0.0/24" {
+		t.Errorf("Allocate(c) = %s, want the released subnet", c.Subnet)
+	}
+
+	if _, err = m.Allocate("", os.Getpid(), vmconfig.Network{Subnet: "10.200.0.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.ReleasePID(os.Getpid()); err != nil {
+		t.Fatalf("ReleasePID: %v", err)
+	}
+	if got := leaseOwners(t, m); len(got) != 2 {
+		t.Errorf("leases %v, want b and c", got)
+	}
+}
+
+func TestFreeSubnetPool(t *testing.T) {
+	t.Setenv(define.SubnetPoolEnv, "10.254.8.0/22")
+	m := newTestIPAM(t, SubnetPool())
+
+	leases := []Lease{
+		{Name: "a", Subnet: "10.254.8.0/24"},
+		{Name: "b", Subnet: "10.254.9.128/25"},
+	}
+	got, err := m.freeSubnet(leases)
+	if err != nil {
+		t.Fatalf("freeSubnet: %v", err)
+	}
+	if got != "10.254.10.0/24" {
+		t.Errorf("freeSubnet() = %s, want 10.254.10.0/24", got)
+	}
+
+	leases = append(leases, Lease{Name: "c", Subnet: "10.254.10.0/23"})
+	if got, err = m.freeSubnet(leases); err == nil {
+		t.Errorf("freeSubnet() = %s of a used up pool", got)
+	}
+
+	t.Setenv(define.SubnetPoolEnv, "")
+	if SubnetPool() != DefaultSubnetPool {
+		t.Errorf("SubnetPool() = %s without %s, want %s", SubnetPool(), define.SubnetPoolEnv, DefaultSubnetPool)
+	}
+}
+
+// TestFreeSubnetHostRoutes checks the subnet of a host address is skipped
+func TestFreeSubnetHostRoutes(t *testing.T) {
+	var host *net.IPNet
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if n, ok := addr.(*net.IPNet); ok && n.IP.To4() != nil && !n.IP.IsLoopback() {
+			host = n
+			break
+		}
+	}
+	if host == nil {
+		t.Skip("the host has no ipv4 address")
+	}
+
+	pool := &net.IPNet{IP: host.IP.Mask(net.CIDRMask(23, 32)), Mask: net.CIDRMask(23, 32)}
+	m := newTestIPAM(t, pool.String())
+	got, err := m.freeSubnet(nil)
+	if err != nil {
+		// the host routes cover the whole pool
+		return
+	}
+	if _, subnet, _ := net.ParseCIDR(got); subnet.Contains(host.IP) {
+		t.Errorf("freeSubnet() = %s, it contains the host address %s", got, host.IP)
+	}
+}
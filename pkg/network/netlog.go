@@ -0,0 +1,421 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"linuxvm/pkg/vmconfig"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	netLogSweepInterval = 10 * time.Second
+	// a udp or icmp flow ends once idle for udpFlowTimeout, a tcp flow
+	// without fin or rst after tcpFlowTimeout
+	udpFlowTimeout = time.Minute
+	tcpFlowTimeout = time.Hour
+	// a dns query is logged unanswered after dnsQueryTimeout
+	dnsQueryTimeout = 30 * time.Second
+	// new flows and queries are not tracked beyond netLogMaxTracked
+	netLogMaxTracked = 1 << 16
+
+	flowEndFIN  = "fin"
+	flowEndRST  = "rst"
+	flowEndIdle = "idle"
+	flowEndStop = "stop"
+)
+
+// ConnRecord is a line of the connection log, a flow of the guest to a
+// remote address. Bytes are counted as ip packet sizes.
+type ConnRecord struct {
+	Type  string    `json:"type"`
+	Time  time.Time `json:"time"`
+	Proto string    `json:"proto"`
+	Src   string    `json:"src"`
+	Dst   string    `json:"dst"`
+	// Names are the dns names the guest resolved Dst by
+	Names      []string `json:"names,omitempty"`
+	BytesOut   int64    `json:"bytesOut"`
+	BytesIn    int64    `json:"bytesIn"`
+	PacketsOut int64    `json:"packetsOut"`
+	PacketsIn  int64    `json:"packetsIn"`
+	// Duration in seconds
+	Duration float64 `json:"duration"`
+	// End is fin or rst for tcp, idle if the flow timed out, stop if the vm
+	// stopped
+	End string `json:"end"`
+}
+
+// DNSRecord is a line of the dns log, a query of the guest and its answer
+type DNSRecord struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Client  string    `json:"client"`
+	Server  string    `json:"server"`
+	Name    string    `json:"name"`
+	QType   string    `json:"qtype"`
+	Rcode   string    `json:"rcode"`
+	Answers []string  `json:"answers,omitempty"`
+	// Duration in seconds
+	Duration float64 `json:"duration"`
+}
+
+// NetLog logs the connections and the dns queries of the guest observed on
+// the virtual network. Traffic to the gateway is not a connection, the
+// queries to its dns server are logged.
+type NetLog struct {
+	conns   *jsonLines
+	queries *jsonLines
+	gateway net.IP
+
+	mu      sync.Mutex
+	flows   map[flowKey]*flow
+	pending map[queryKey]*DNSRecord
+	names   map[[4]byte][]string
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// flowKey is a flow seen from the guest
+type flowKey struct {
+	proto      string
+	local      [4]byte
+	remote     [4]byte
+	localPort  uint16
+	remotePort uint16
+}
+
+type flow struct {
+	record  ConnRecord
+	last    time.Time
+	finOut  bool
+	finIn   bool
+	timeout time.Duration
+}
+
+type queryKey struct {
+	client [4]byte
+	server [4]byte
+	port   uint16
+	id     uint16
+}
+
+// NewNetLog opens the log files of n, nil if no log is on
+func NewNetLog(n vmconfig.Network) (*NetLog, error) {
+	if !n.Log.Enabled() {
+		return nil, nil
+	}
+
+	nl := &NetLog{
+		gateway: net.ParseIP(n.GatewayIP).To4(),
+		flows:   map[flowKey]*flow{},
+		pending: map[queryKey]*DNSRecord{},
+		names:   map[[4]byte][]string{},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	var err error
+	if n.Log.Connections != "" {
+		if nl.conns, err = openJSONLines(n.Log.Connections); err != nil {
+			return nil, err
+		}
+	}
+	if n.Log.DNS != "" {
+		if nl.queries, err = openJSONLines(n.Log.DNS); err != nil {
+			nl.conns.Close() //nolint:errcheck
+			return nil, err
+		}
+	}
+
+	go nl.sweep()
+	return nl, nil
+}
+
+// Close logs the open flows and the unanswered queries and closes the files
+func (nl *NetLog) Close() {
+	close(nl.stop)
+	<-nl.done
+
+	nl.mu.Lock()
+	defer nl.mu.Unlock()
+	for key, f := range nl.flows {
+		nl.endFlowLocked(key, f, flowEndStop, f.last)
+	}
+	for key, q := range nl.pending {
+		nl.endQueryLocked(key, q, "STOP", time.Now(), nil)
+	}
+	nl.conns.Close()   //nolint:errcheck
+	nl.queries.Close() //nolint:errcheck
+}
+
+// Wrap returns conn whose frames are logged, conn must carry one frame per
+// read and write
+func (nl *NetLog) Wrap(conn net.Conn) net.Conn {
+	return &netLogConn{Conn: conn, log: nl}
+}
+
+type netLogConn struct {
+	net.Conn
+	log *NetLog
+}
+
+func (nc *netLogConn) Read(b []byte) (int, error) {
+	n, err := nc.Conn.Read(b)
+	if n > 0 {
+		nc.log.observe(b[:n], true)
+	}
+	return n, err
+}
+
+func (nc *netLogConn) Write(b []byte) (int, error) {
+	n, err := nc.Conn.Write(b)
+	if err == nil {
+		nc.log.observe(b[:n], false)
+	}
+	return n, err
+}
+
+// observe accounts a frame, out is true for the frames sent by the guest
+func (nl *NetLog) observe(frame []byte, out bool) {
+	pkt, ok := parseFrame(frame)
+	if !ok {
+		return
+	}
+
+	local, remote := pkt.src, pkt.dst
+	localPort, remotePort := pkt.srcPort, pkt.dstPort
+	if !out {
+		local, remote = remote, local
+		localPort, remotePort = remotePort, localPort
+	}
+
+	now := time.Now()
+	nl.mu.Lock()
+	defer nl.mu.Unlock()
+
+	if pkt.proto == vmconfig.UDP && pkt.hasPorts && remotePort == dnsPort {
+		nl.observeDNSLocked(pkt, out, now)
+	}
+
+	if nl.conns == nil || remote.Equal(nl.gateway) || remote.IsMulticast() || remote.Equal(net.IPv4bcast) {
+		return
+	}
+	// fragments without ports can not be told apart
+	if !pkt.hasPorts && pkt.proto != vmconfig.ICMP {
+		return
+	}
+
+	key := flowKey{proto: pkt.proto, localPort: localPort, remotePort: remotePort}
+	copy(key.local[:], local.To4())
+	copy(key.remote[:], remote.To4())
+
+	f := nl.flows[key]
+	if f == nil {
+		// the answers of gvproxy to a flow already ended are not a flow
+		if !out || len(nl.flows) >= netLogMaxTracked {
+			return
+		}
+		f = &flow{
+			record: ConnRecord{
+				Type:  "connection",
+				Time:  now,
+				Proto: pkt.proto,
+				Src:   hostPort(local, localPort, pkt.hasPorts),
+				Dst:   hostPort(remote, remotePort, pkt.hasPorts),
+				Names: nl.names[key.remote],
+			},
+			timeout: udpFlowTimeout,
+		}
+		if pkt.proto == vmconfig.TCP {
+			f.timeout = tcpFlowTimeout
+		}
+		nl.flows[key] = f
+	}
+
+	f.last = now
+	if out {
+		f.record.BytesOut += int64(pkt.size)
+		f.record.PacketsOut++
+	} else {
+		f.record.BytesIn += int64(pkt.size)
+		f.record.PacketsIn++
+	}
+
+	if pkt.proto != vmconfig.TCP {
+		return
+	}
+	switch {
+	case pkt.tcpFlags&tcpRST != 0:
+		nl.endFlowLocked(key, f, flowEndRST, now)
+	case pkt.tcpFlags&tcpFIN != 0:
+		if out {
+			f.finOut = true
+		} else {
+			f.finIn = true
+		}
+		if f.finOut && f.finIn {
+			nl.endFlowLocked(key, f, flowEndFIN, now)
+		}
+	}
+}
+
+// observeDNSLocked logs the answer of a query, the queries are kept until
+// answered
+func (nl *NetLog) observeDNSLocked(pkt packet, out bool, now time.Time) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(pkt.payload); err != nil || len(msg.Question) == 0 {
+		return
+	}
+
+	key := queryKey{id: msg.Id}
+	if out {
+		copy(key.client[:], pkt.src.To4())
+		copy(key.server[:], pkt.dst.To4())
+		key.port = pkt.srcPort
+	} else {
+		copy(key.client[:], pkt.dst.To4())
+		copy(key.server[:], pkt.src.To4())
+		key.port = pkt.dstPort
+	}
+
+	if out {
+		if nl.queries == nil || len(nl.pending) >= netLogMaxTracked {
+			return
+		}
+		q := msg.Question[0]
+		nl.pending[key] = &DNSRecord{
+			Type:   "dns",
+			Time:   now,
+			Client: hostPort(pkt.src, pkt.srcPort, true),
+			Server: hostPort(pkt.dst, pkt.dstPort, true),
+			Name:   q.Name,
+			QType:  dns.TypeToString[q.Qtype],
+		}
+		return
+	}
+
+	// the flows to the answered addresses are annotated with the names
+	var answers []string
+	for _, rr := range msg.Answer {
+		answers = append(answers, strings.TrimPrefix(rr.String(), rr.Header().String()))
+		if a, ok := rr.(*dns.A); ok {
+			var ip [4]byte
+			copy(ip[:], a.A.To4())
+			if len(nl.names) >= netLogMaxTracked {
+				nl.names = map[[4]byte][]string{}
+			}
+			nl.names[ip] = appendName(nl.names[ip], msg.Question[0].Name)
+		}
+	}
+
+	if q, found := nl.pending[key]; found {
+		nl.endQueryLocked(key, q, dns.RcodeToString[msg.Rcode], now, answers)
+	}
+}
+
+func (nl *NetLog) endFlowLocked(key flowKey, f *flow, end string, now time.Time) {
+	delete(nl.flows, key)
+	f.record.End = end
+	f.record.Duration = now.Sub(f.record.Time).Seconds()
+	nl.conns.write(f.record)
+}
+
+func (nl *NetLog) endQueryLocked(key queryKey, q *DNSRecord, rcode string, now time.Time, answers []string) {
+	delete(nl.pending, key)
+	q.Rcode = rcode
+	q.Answers = answers
+	q.Duration = now.Sub(q.Time).Seconds()
+	nl.queries.write(q)
+}
+
+// sweep ends the idle flows and the unanswered queries until Close
+func (nl *NetLog) sweep() {
+	defer close(nl.done)
+
+	ticker := time.NewTicker(netLogSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-nl.stop:
+			return
+		case now := <-ticker.C:
+			nl.expire(now)
+		}
+	}
+}
+
+// expire ends the flows idle and the queries unanswered at now
+func (nl *NetLog) expire(now time.Time) {
+	nl.mu.Lock()
+	defer nl.mu.Unlock()
+	for key, f := range nl.flows {
+		if now.Sub(f.last) > f.timeout {
+			nl.endFlowLocked(key, f, flowEndIdle, f.last)
+		}
+	}
+	for key, q := range nl.pending {
+		if now.Sub(q.Time) > dnsQueryTimeout {
+			nl.endQueryLocked(key, q, "TIMEOUT", now, nil)
+		}
+	}
+}
+
+func appendName(names []string, name string) []string {
+	for _, n := range names {
+		if n == name {
+			return names
+		}
+	}
+	return append(names, name)
+}
+
+func hostPort(ip net.IP, port uint16, hasPort bool) string {
+	if !hasPort {
+		return ip.String()
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+// jsonLines appends json values to a file, a line each. A nil jsonLines
+// discards the values.
+type jsonLines struct {
+	f *os.File
+}
+
+func openJSONLines(file string) (*jsonLines, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open network log: %w", err)
+	}
+	return &jsonLines{f: f}, nil
+}
+
+func (j *jsonLines) write(v any) {
+	if j == nil {
+		return
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		logrus.Warnf("failed to marshal network log: %v", err)
+		return
+	}
+	if _, err = j.f.Write(append(b, '\n')); err != nil {
+		logrus.Warnf("failed to write network log: %v", err)
+	}
+}
+
+func (j *jsonLines) Close() error {
+	if j == nil {
+		return nil
+	}
+	return j.f.Close()
+}
@@ -0,0 +1,302 @@
+package network
+
+import (
+	"bufio"
+	"encoding/json"
+	"linuxvm/pkg/vmconfig"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const testRemote = "93.184.216.34"
+
+// newTestNetLog returns a NetLog writing to temp files and the files of the
+// connection and the dns log
+func newTestNetLog(t *testing.T) (*NetLog, string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	conns, queries := filepath.Join(dir, "conns.jsonl"), filepath.Join(dir, "dns.jsonl")
+	nl, err := NewNetLog(vmconfig.Network{
+		GatewayIP: testGateway,
+		Log:       vmconfig.NetworkLog{Connections: conns, DNS: queries},
+	})
+	if err != nil {
+		t.Fatalf("NewNetLog: %v", err)
+	}
+	return nl, conns, queries
+}
+
+// readLines decodes the json lines of file into a T each
+func readLines[T any](t *testing.T, file string) []T {
+	t.Helper()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close() //nolint:errcheck
+
+	var records []T
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r T
+		if err = json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("invalid line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+// guestTCP is a tcp frame of the guest port 40000 and remote:443, from the
+// guest if out
+func guestTCP(remote string, out bool, flags byte, payload string) []byte {
+	if out {
+		return testFrame{proto: 6, src: testGuest, dst: remote, l4: tcpHeader(40000, 443, flags, []byte(payload))}.bytes()
+	}
+	return testFrame{proto: 6, src: remote, dst: testGuest, l4: tcpHeader(443, 40000, flags, []byte(payload))}.bytes()
+}
+
+// dnsFrame carries msg between the guest port 40000 and the gateway dns
+// server, from the guest if out
+func dnsFrame(t *testing.T, msg *dns.Msg, out bool) []byte {
+	t.Helper()
+	b, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out {
+		return testFrame{proto: 17, src: testGuest, dst: testGateway, l4: udpHeader(40000, dnsPort, b)}.bytes()
+	}
+	return testFrame{proto: 17, src: testGateway, dst: testGuest, l4: udpHeader(dnsPort, 40000, b)}.bytes()
+}
+
+func dnsExchange(name, ip string) (*dns.Msg, *dns.Msg) {
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	answer := new(dns.Msg)
+	answer.SetReply(query)
+	answer.Answer = append(answer.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP(ip),
+	})
+	return query, answer
+}
+
+func TestNetLogFlows(t *testing.T) {
+	type frame struct {
+		data []byte
+		out  bool
+	}
+	tests := []struct {
+		name   string
+		frames []frame
+		// expire ends the idle flows this long after the frames
+		expire     time.Duration
+		want       ConnRecord
+		wantNoFlow bool
+	}{
+		{
+			name: "fin",
+			frames: []frame{
+				{data: guestTCP(testRemote, true, tcpSYN, ""), out: true},
+				{data: guestTCP(testRemote, false, tcpSYN|tcpACK, "")},
+				{data: guestTCP(testRemote, true, tcpACK, "hello"), out: true},
+				{data: guestTCP(testRemote, true, tcpFIN|tcpACK, ""), out: true},
+				{data: guestTCP(testRemote, false, tcpFIN|tcpACK, "")},
+			},
+			want: ConnRecord{Proto: vmconfig.TCP, Dst: testRemote + ":443", PacketsOut: 3, PacketsIn: 2, BytesOut: 3*40 + 5, BytesIn: 2 * 40, End: flowEndFIN},
+		},
+		{
+			name: "rst of the remote",
+			frames: []frame{
+				{data: guestTCP(testRemote, true, tcpSYN, ""), out: true},
+				{data: guestTCP(testRemote, false, tcpRST|tcpACK, "")},
+			},
+			want: ConnRecord{Proto: vmconfig.TCP, Dst: testRemote + ":443", PacketsOut: 1, PacketsIn: 1, BytesOut: 40, BytesIn: 40, End: flowEndRST},
+		},
+		{
+			name: "fin of one side is still open",
+			frames: []frame{
+				{data: guestTCP(testRemote, true, tcpSYN, ""), out: true},
+				{data: guestTCP(testRemote, true, tcpFIN|tcpACK, ""), out: true},
+			},
+			want: ConnRecord{Proto: vmconfig.TCP, Dst: testRemote + ":443", PacketsOut: 2, BytesOut: 80, End: flowEndStop},
+		},
+		{
+			name: "idle udp",
+			frames: []frame{
+				{data: testFrame{proto: 17, src: testGuest, dst: testRemote, l4: udpHeader(40000, 123, []byte("ntp"))}.bytes(), out: true},
+			},
+			expire: 2 * udpFlowTimeout,
+			want:   ConnRecord{Proto: vmconfig.UDP, Dst: testRemote + ":123", PacketsOut: 1, BytesOut: 20 + 8 + 3, End: flowEndIdle},
+		},
+		{
+			name: "tcp is not idle after the udp timeout",
+			frames: []frame{
+				{data: guestTCP(testRemote, true, tcpSYN, ""), out: true},
+			},
+			expire: 2 * udpFlowTimeout,
+			want:   ConnRecord{Proto: vmconfig.TCP, Dst: testRemote + ":443", PacketsOut: 1, BytesOut: 40, End: flowEndStop},
+		},
+		{
+			name: "icmp without ports",
+			frames: []frame{
+				{data: testFrame{proto: 1, src: testGuest, dst: testRemote, l4: []byte{8, 0, 0, 0, 0, 1, 0, 1}}.bytes(), out: true},
+			},
+			want: ConnRecord{Proto: vmconfig.ICMP, Dst: testRemote, PacketsOut: 1, BytesOut: 28, End: flowEndStop},
+		},
+		{
+			name: "answer without a flow",
+			frames: []frame{
+				{data: guestTCP(testRemote, false, tcpACK, "late")},
+			},
+			wantNoFlow: true,
+		},
+		{
+			name: "gateway",
+			frames: []frame{
+				{data: guestTCP(testGateway, true, tcpSYN, ""), out: true},
+			},
+			wantNoFlow: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nl, conns, _ := newTestNetLog(t)
+			for _, f := range tt.frames {
+				nl.observe(f.data, f.out)
+			}
+			if tt.expire > 0 {
+				nl.expire(time.Now().Add(tt.expire))
+			}
+			nl.Close()
+
+			records := readLines[ConnRecord](t, conns)
+			if tt.wantNoFlow {
+				if len(records) != 0 {
+					t.Fatalf("records %+v, want none", records)
+				}
+				return
+			}
+			if len(records) != 1 {
+				t.Fatalf("records %+v, want one", records)
+			}
+			got := records[0]
+			if got.Type != "connection" || got.Src == "" {
+				t.Errorf("record %+v is no connection of the guest", got)
+			}
+			if got.Proto != tt.want.Proto || got.Dst != tt.want.Dst || got.End != tt.want.End ||
+				got.PacketsOut != tt.want.PacketsOut || got.PacketsIn != tt.want.PacketsIn ||
+				got.BytesOut != tt.want.BytesOut || got.BytesIn != tt.want.BytesIn {
+				t.Errorf("record = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNetLogFlowNames(t *testing.T) {
+	nl, conns, _ := newTestNetLog(t)
+
+	query, answer := dnsExchange("example.com", testRemote)
+	nl.observe(dnsFrame(t, query, true), true)
+	nl.observe(dnsFrame(t, answer, false), false)
+	_, answer = dnsExchange("www.example.com", testRemote)
+	nl.observe(dnsFrame(t, answer, false), false)
+
+	nl.observe(guestTCP(testRemote, true, tcpSYN, ""), true)
+	nl.observe(guestTCP(testRemote, false, tcpRST, ""), false)
+	nl.Close()
+
+	records := readLines[ConnRecord](t, conns)
+	if len(records) != 1 {
+		t.Fatalf("records %+v, want the tcp flow only", records)
+	}
+	names := records[0].Names
+	if len(names) != 2 || names[0] != "example.com." || names[1] != "www.example.com." {
+		t.Errorf("names = %q, want example.com. and www.example.com.", names)
+	}
+}
+
+func TestNetLogDNS(t *testing.T) {
+	answered, answer := dnsExchange("example.com", testRemote)
+	nxdomain := new(dns.Msg)
+	nxdomain.SetQuestion("missing.example.", dns.TypeAAAA)
+	nxReply := new(dns.Msg)
+	nxReply.SetRcode(nxdomain, dns.RcodeNameError)
+	unanswered := new(dns.Msg)
+	unanswered.SetQuestion("slow.example.", dns.TypeA)
+	// an answer of another id does not match the query
+	other := answer.Copy()
+	other.Id = answered.Id + 1
+
+	tests := []struct {
+		name    string
+		frames  [][]byte
+		outs    []bool
+		expire  bool
+		want    DNSRecord
+		answers int
+	}{
+		{
+			name:    "answered",
+			frames:  [][]byte{dnsFrame(t, answered, true), dnsFrame(t, answer, false)},
+			outs:    []bool{true, false},
+			want:    DNSRecord{Name: "example.com.", QType: "A", Rcode: "NOERROR"},
+			answers: 1,
+		},
+		{
+			name:   "nxdomain",
+			frames: [][]byte{dnsFrame(t, nxdomain, true), dnsFrame(t, nxReply, false)},
+			outs:   []bool{true, false},
+			want:   DNSRecord{Name: "missing.example.", QType: "AAAA", Rcode: "NXDOMAIN"},
+		},
+		{
+			name:   "answer of another id",
+			frames: [][]byte{dnsFrame(t, answered, true), dnsFrame(t, other, false)},
+			outs:   []bool{true, false},
+			want:   DNSRecord{Name: "example.com.", QType: "A", Rcode: "STOP"},
+		},
+		{
+			name:   "timeout",
+			frames: [][]byte{dnsFrame(t, unanswered, true)},
+			outs:   []bool{true},
+			expire: true,
+			want:   DNSRecord{Name: "slow.example.", QType: "A", Rcode: "TIMEOUT"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nl, conns, queries := newTestNetLog(t)
+			for i, f := range tt.frames {
+				nl.observe(f, tt.outs[i])
+			}
+			if tt.expire {
+				nl.expire(time.Now().Add(2 * dnsQueryTimeout))
+			}
+			nl.Close()
+
+			records := readLines[DNSRecord](t, queries)
+			if len(records) != 1 {
+				t.Fatalf("records %+v, want one", records)
+			}
+			got := records[0]
+			if got.Type != "dns" || got.Client != testGuest+":40000" || got.Server != testGateway+":53" {
+				t.Errorf("record %+v is no query of the guest to the gateway", got)
+			}
+			if got.Name != tt.want.Name || got.QType != tt.want.QType || got.Rcode != tt.want.Rcode || len(got.Answers) != tt.answers {
+				t.Errorf("record = %+v, want %+v with %d answers", got, tt.want, tt.answers)
+			}
+			// the queries to the gateway are no connections
+			if conns := readLines[ConnRecord](t, conns); len(conns) != 0 {
+				t.Errorf("connections %+v, want none", conns)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"linuxvm/pkg/vmconfig"
+	"net"
+	"strconv"
+)
+
+const (
+	etherHeaderLen = 14
+	etherTypeIPv4  = 0x0800
+	etherTypeARP   = 0x0806
+	ipv4HeaderLen  = 20
+	udpHeaderLen   = 8
+	tcpHeaderLen   = 20
+	dnsPort        = 53
+
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpACK = 0x10
+)
+
+var ipProtocols = map[byte]string{1: vmconfig.ICMP, 6: vmconfig.TCP, 17: vmconfig.UDP}
+
+// packet is the ipv4 header of a frame, ports, tcp flags and payload are only
+// set for the first fragment of tcp and udp
+type packet struct {
+	proto    string
+	src, dst net.IP
+	// size is the length of the ip packet
+	size     int
+	srcPort  uint16
+	dstPort  uint16
+	hasPorts bool
+	tcpFlags byte
+	payload  []byte
+}
+
+func (p packet) String() string {
+	dst := p.dst.String()
+	if p.hasPorts {
+		dst = net.JoinHostPort(dst, strconv.Itoa(int(p.dstPort)))
+	}
+	return fmt.Sprintf("%s %s -> %s", p.proto, p.src, dst)
+}
+
+// parseFrame parses the ipv4 packet of an ethernet frame, false if the frame
+// does not carry one
+func parseFrame(frame []byte) (packet, bool) {
+	if len(frame) < etherHeaderLen || binary.BigEndian.Uint16(frame[12:14]) != etherTypeIPv4 {
+		return packet{}, false
+	}
+	return parsePacket(frame[etherHeaderLen:])
+}
+
+func isARP(frame []byte) bool {
+	return len(frame) >= etherHeaderLen && binary.BigEndian.Uint16(frame[12:14]) == etherTypeARP
+}
+
+// parsePacket parses an ipv4 packet
+func parsePacket(b []byte) (packet, bool) {
+	if len(b) < ipv4HeaderLen || b[0]>>4 != 4 {
+		return packet{}, false
+	}
+	headerLen := int(b[0]&0x0f) * 4
+	totalLen := int(binary.BigEndian.Uint16(b[2:4]))
+	if headerLen < ipv4HeaderLen || totalLen < headerLen || len(b) < totalLen {
+		return packet{}, false
+	}
+	// drop the padding of short ethernet frames
+	b = b[:totalLen]
+
+	pkt := packet{
+		proto: ipProtocols[b[9]],
+		src:   net.IP(b[12:16]),
+		dst:   net.IP(b[16:20]),
+		size:  totalLen,
+	}
+	if pkt.proto == "" {
+		pkt.proto = fmt.Sprintf("ip/%d", b[9])
+	}
+
+	// only the first fragment carries the ports
+	fragmentOffset := binary.BigEndian.Uint16(b[6:8]) & 0x1fff
+	l4 := b[headerLen:]
+	if fragmentOffset != 0 || len(l4) < 4 || (pkt.proto != vmconfig.TCP && pkt.proto != vmconfig.UDP) {
+		return pkt, true
+	}
+	pkt.srcPort = binary.BigEndian.Uint16(l4[0:2])
+	pkt.dstPort = binary.BigEndian.Uint16(l4[2:4])
+	pkt.hasPorts = true
+	switch {
+	case pkt.proto == vmconfig.UDP && len(l4) >= udpHeaderLen:
+		pkt.payload = l4[udpHeaderLen:]
+	case pkt.proto == vmconfig.TCP && len(l4) >= tcpHeaderLen:
+		pkt.tcpFlags = l4[13]
+		if dataOffset := int(l4[12]>>4) * 4; dataOffset >= tcpHeaderLen && dataOffset <= len(l4) {
+			pkt.payload = l4[dataOffset:]
+		}
+	}
+	return pkt, true
+}
+
+// udpReply returns the frame answering the udp packet pkt of frame with
+// payload, the udp checksum is optional for ipv4 and left 0
+func udpReply(frame []byte, pkt packet, payload []byte) []byte {
+	reply := make([]byte, etherHeaderLen+ipv4HeaderLen+udpHeaderLen+len(payload))
+
+	eth := reply[:etherHeaderLen]
+	copy(eth[0:6], frame[6:12])
+	copy(eth[6:12], frame[0:6])
+	binary.BigEndian.PutUint16(eth[12:14], etherTypeIPv4)
+
+	ip := reply[etherHeaderLen : etherHeaderLen+ipv4HeaderLen]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(ipv4HeaderLen+udpHeaderLen+len(payload)))
+	binary.BigEndian.PutUint16(ip[6:8], 0x4000) // don't fragment
+	ip[8] = 64
+	ip[9] = 17
+	copy(ip[12:16], pkt.dst.To4())
+	copy(ip[16:20], pkt.src.To4())
+	binary.BigEndian.PutUint16(ip[10:12], ipChecksum(ip))
+
+	udp := reply[etherHeaderLen+ipv4HeaderLen:]
+	binary.BigEndian.PutUint16(udp[0:2], pkt.dstPort)
+	binary.BigEndian.PutUint16(udp[2:4], pkt.srcPort)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(udpHeaderLen+len(payload)))
+	copy(udp[udpHeaderLen:], payload)
+
+	return reply
+}
+
+func ipChecksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i : i+2]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,211 @@
+package network
+
+import (
+	"encoding/binary"
+	"linuxvm/pkg/vmconfig"
+	"net"
+	"testing"
+)
+
+// testFrame builds an ethernet frame of an ipv4 packet, options are appended
+// to the ip header and l4 is the tcp or udp header with its payload
+type testFrame struct {
+	proto          byte
+	src, dst       string
+	options        []byte
+	fragmentOffset uint16
+	l4             []byte
+}
+
+func (f testFrame) bytes() []byte {
+	headerLen := ipv4HeaderLen + len(f.options)
+	ip := make([]byte, headerLen, headerLen+len(f.l4))
+	ip[0] = 0x40 | byte(headerLen/4)
+	binary.BigEndian.PutUint16(ip[2:4], uint16(headerLen+len(f.l4)))
+	binary.BigEndian.PutUint16(ip[6:8], f.fragmentOffset)
+	ip[8] = 64
+	ip[9] = f.proto
+	copy(ip[12:16], net.ParseIP(f.src).To4())
+	copy(ip[16:20], net.ParseIP(f.dst).To4())
+	copy(ip[ipv4HeaderLen:], f.options)
+	ip = append(ip, f.l4...)
+
+	frame := make([]byte, etherHeaderLen, etherHeaderLen+len(ip))
+	binary.BigEndian.PutUint16(frame[12:14], etherTypeIPv4)
+	return append(frame, ip...)
+}
+
+func udpHeader(srcPort, dstPort uint16, payload []byte) []byte {
+	b := make([]byte, udpHeaderLen, udpHeaderLen+len(payload))
+	binary.BigEndian.PutUint16(b[0:2], srcPort)
+	binary.BigEndian.PutUint16(b[2:4], dstPort)
+	binary.BigEndian.PutUint16(b[4:6], uint16(udpHeaderLen+len(payload)))
+	return append(b, payload...)
+}
+
+func tcpHeader(srcPort, dstPort uint16, flags byte, payload []byte) []byte {
+	b := make([]byte, tcpHeaderLen, tcpHeaderLen+len(payload))
+	binary.BigEndian.PutUint16(b[0:2], srcPort)
+	binary.BigEndian.PutUint16(b[2:4], dstPort)
+	b[12] = 5 << 4
+	b[13] = flags
+	return append(b, payload...)
+}
+
+func TestParseFrame(t *testing.T) {
+	arp := make([]byte, etherHeaderLen+28)
+	binary.BigEndian.PutUint16(arp[12:14], etherTypeARP)
+
+	tcp := testFrame{proto: 6, src: "192.168.127.2", dst: "1.1.1.1", l4: tcpHeader(40000, 443, tcpSYN, nil)}.bytes()
+	padded := append(testFrame{proto: 17, src: "192.168.127.2", dst: "1.1.1.1", l4: udpHeader(40000, 53, []byte("q"))}.bytes(), 0, 0, 0, 0)
+
+	tests := []struct {
+		name      string
+		frame     []byte
+		wantOK    bool
+		wantProto string
+		wantPorts bool
+		dstPort   uint16
+		payload   string
+		tcpFlags  byte
+	}{
+		{
+			name:      "tcp",
+			frame:     tcp,
+			wantOK:    true,
+			wantProto: vmconfig.TCP,
+			wantPorts: true,
+			dstPort:   443,
+			tcpFlags:  tcpSYN,
+		},
+		{
+			name:      "udp payload",
+			frame:     testFrame{proto: 17, src: "192.168.127.2", dst: "192.168.127.1", l4: udpHeader(40000, 53, []byte("query"))}.bytes(),
+			wantOK:    true,
+			wantProto: vmconfig.UDP,
+			wantPorts: true,
+			dstPort:   53,
+			payload:   "query",
+		},
+		{
+			name:      "ethernet padding dropped",
+			frame:     padded,
+			wantOK:    true,
+			wantProto: vmconfig.UDP,
+			wantPorts: true,
+			dstPort:   53,
+			payload:   "q",
+		},
+		{
+			name:      "ip options skipped",
+			frame:     testFrame{proto: 6, src: "192.168.127.2", dst: "1.1.1.1", options: []byte{1, 1, 1, 0}, l4: tcpHeader(40000, 22, tcpACK, []byte("data"))}.bytes(),
+			wantOK:    true,
+			wantProto: vmconfig.TCP,
+			wantPorts: true,
+			dstPort:   22,
+			payload:   "data",
+			tcpFlags:  tcpACK,
+		},
+		{
+			name:      "first fragment has ports",
+			frame:     testFrame{proto: 17, src: "192.168.127.2", dst: "1.1.1.1", fragmentOffset: 0x2000, l4: udpHeader(40000, 53, nil)}.bytes(),
+			wantOK:    true,
+			wantProto: vmconfig.UDP,
+			wantPorts: true,
+			dstPort:   53,
+		},
+		{
+			name:      "later fragment has no ports",
+			frame:     testFrame{proto: 17, src: "192.168.127.2", dst: "1.1.1.1", fragmentOffset: 185, l4: udpHeader(40000, 53, nil)}.bytes(),
+			wantOK:    true,
+			wantProto: vmconfig.UDP,
+		},
+		{
+			name:      "icmp",
+			frame:     testFrame{proto: 1, src: "192.168.127.2", dst: "1.1.1.1", l4: []byte{8, 0, 0, 0, 0, 1, 0, 1}}.bytes(),
+			wantOK:    true,
+			wantProto: vmconfig.ICMP,
+		},
+		{
+			name:      "unknown protocol",
+			frame:     testFrame{proto: 47, src: "192.168.127.2", dst: "1.1.1.1", l4: []byte{0, 0, 0, 0}}.bytes(),
+			wantOK:    true,
+			wantProto: "ip/47",
+		},
+		{name: "arp", frame: arp},
+		{name: "short ethernet header", frame: []byte{0, 1, 2}},
+		{name: "truncated ip header", frame: tcp[:etherHeaderLen+10]},
+		{name: "truncated packet", frame: tcp[:len(tcp)-4]},
+		{
+			name: "header length below 20",
+			frame: func() []byte {
+				b := append([]byte{}, tcp...)
+				b[etherHeaderLen] = 0x44
+				return b
+			}(),
+		},
+		{
+			name: "ipv6",
+			frame: func() []byte {
+				b := append([]byte{}, tcp...)
+				b[etherHeaderLen] = 0x65
+				return b
+			}(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt, ok := parseFrame(tt.frame)
+			if ok != tt.wantOK {
+				t.Fatalf("parseFrame() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if pkt.proto != tt.wantProto || pkt.hasPorts != tt.wantPorts || pkt.dstPort != tt.dstPort {
+				t.Errorf("parseFrame() = %s ports %v, want %s ports %v dst port %d", pkt, pkt.hasPorts, tt.wantProto, tt.wantPorts, tt.dstPort)
+			}
+			if string(pkt.payload) != tt.payload {
+				t.Errorf("payload = %q, want %q", pkt.payload, tt.payload)
+			}
+			if pkt.tcpFlags != tt.tcpFlags {
+				t.Errorf("tcp flags = %#x, want %#x", pkt.tcpFlags, tt.tcpFlags)
+			}
+		})
+	}
+}
+
+func TestIsARP(t *testing.T) {
+	arp := make([]byte, etherHeaderLen+28)
+	binary.BigEndian.PutUint16(arp[12:14], etherTypeARP)
+	if !isARP(arp) {
+		t.Error("isARP(arp) = false")
+	}
+	if isARP(arp[:10]) {
+		t.Error("isARP(truncated) = true")
+	}
+	if isARP(testFrame{proto: 6, src: "10.0.0.1", dst: "10.0.0.2", l4: tcpHeader(1, 2, 0, nil)}.bytes()) {
+		t.Error("isARP(ipv4) = true")
+	}
+}
+
+func TestUDPReply(t *testing.T) {
+	query := testFrame{proto: 17, src: "192.168.127.2", dst: "192.168.127.1", l4: udpHeader(40000, 53, []byte("query"))}.bytes()
+	pkt, _ := parseFrame(query)
+
+	reply, ok := parseFrame(udpReply(query, pkt, []byte("answer")))
+	if !ok {
+		t.Fatal("the reply does not parse")
+	}
+	if !reply.src.Equal(pkt.dst) || !reply.dst.Equal(pkt.src) || reply.srcPort != 53 || reply.dstPort != 40000 {
+		t.Errorf("reply %s:%d, want it from %s:53 to %s:40000", reply, reply.srcPort, pkt.dst, pkt.src)
+	}
+	if string(reply.payload) != "answer" {
+		t.Errorf("reply payload = %q", reply.payload)
+	}
+	ip := udpReply(query, pkt, nil)[etherHeaderLen : etherHeaderLen+ipv4HeaderLen]
+	if ipChecksum(ip) != 0 {
+		t.Errorf("ip checksum of the reply does not verify")
+	}
+}
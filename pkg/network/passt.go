@@ -0,0 +1,120 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"linuxvm/pkg/define"
+	"linuxvm/pkg/vmconfig"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// passtFD is the fd number of the socket in the passt process, the first of
+// exec.Cmd.ExtraFiles
+const passtFD = 3
+
+// Passt is a passt process serving the guest nic over a socketpair, one end
+// is inherited by passt and the other one by the vmm.
+type Passt struct {
+	vmc      vmconfig.VMConfig
+	passtEnd *os.File
+	vmmEnd   *os.File
+}
+
+// NewPasst creates the socketpair connecting passt to the vmm, passt is
+// started by Run.
+func NewPasst(vmc vmconfig.VMConfig) (*Passt, error) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create passt socketpair: %w", err)
+	}
+
+	return &Passt{
+		vmc:      vmc,
+		passtEnd: os.NewFile(uintptr(fds[0]), "passt"),
+		vmmEnd:   os.NewFile(uintptr(fds[1]), "passt-vmm"),
+	}, nil
+}
+
+// VMMFile is the socket to pass to krun_set_passt_fd in the vmm, the caller
+// closes it once the vmm inherited it
+func (p *Passt) VMMFile() *os.File {
+	return p.vmmEnd
+}
+
+// Run runs passt until ctx is done, then stops it by SIGTERM. An error is
+// returned if passt exits on its own.
+func (p *Passt) Run(ctx context.Context) error {
+	bin, err := exec.LookPath("passt")
+	if err != nil {
+		_ = p.passtEnd.Close()
+		return fmt.Errorf("network mode %s needs passt in $PATH: %w", vmconfig.NetPasst, err)
+	}
+
+	cmd := exec.CommandContext(ctx, bin, passtArgs(p.vmc)...)
+	cmd.ExtraFiles = []*os.File{p.passtEnd}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = define.GuestStopTimeout
+
+	logrus.Infof("start passt: %q", cmd.Args)
+	err = cmd.Start()
+	// passt owns its end from now on
+	_ = p.passtEnd.Close()
+	if err != nil {
+		return fmt.Errorf("failed to start passt: %w", err)
+	}
+
+	err = cmd.Wait()
+	if ctx.Err() != nil {
+		return nil
+	}
+	return fmt.Errorf("passt exited: %v", err)
+}
+
+// passtArgs runs passt in the foreground on the inherited socket, with the
+// addresses of the vm network, the capture file and the published ports
+func passtArgs(vmc vmconfig.VMConfig) []string {
+	n := vmc.Network
+	args := []string{
+		"--foreground",
+		"--fd", strconv.Itoa(passtFD),
+		"--address", n.GuestIP,
+		"--gateway", n.GatewayIP,
+		"--mac-addr", n.GatewayMAC,
+	}
+	if _, subnet, err := net.ParseCIDR(n.Subnet); err == nil {
+		ones, _ := subnet.Mask.Size()
+		args = append(args, "--netmask", strconv.Itoa(ones))
+	}
+
+	// the guest falls back to the gateway as nameserver if the host has no
+	// upstream nameserver it can reach, passt forwards it to the host resolver
+	if slices.Contains(vmc.Resolver.Nameservers, n.GatewayIP) {
+		args = append(args, "--dns-forward", n.GatewayIP)
+	}
+
+	if n.Capture.File != "" {
+		args = append(args, "--pcap", n.Capture.File)
+	}
+
+	for _, port := range publishedPorts(vmc.Ports) {
+		flag := "--tcp-ports"
+		if port.Protocol == vmconfig.UDP {
+			flag = "--udp-ports"
+		}
+		args = append(args, flag, fmt.Sprintf("%s/%d:%d", port.HostIP, port.HostPort, port.GuestPort))
+	}
+
+	return args
+}
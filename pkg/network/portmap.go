@@ -0,0 +1,93 @@
+package network
+
+import (
+	"fmt"
+	"linuxvm/pkg/vmconfig"
+	"net"
+	"strconv"
+)
+
+// forwardsMap maps the published ports to gvproxy forwards, the key of an udp
+// forward is prefixed with "udp:"
+func forwardsMap(guestIP string, ports []vmconfig.PortMapping) map[string]string {
+	forwards := map[string]string{}
+	for _, p := range publishedPorts(ports) {
+		forwards[forwardKey(p)] = net.JoinHostPort(guestIP, strconv.Itoa(int(p.GuestPort)))
+	}
+	return forwards
+}
+
+// publishedPorts returns ports plus the default forward of host:2222 to the
+// guest ssh port, which is kept only if the user does not publish the guest
+// ssh port and host:2222 is free
+func publishedPorts(ports []vmconfig.PortMapping) []vmconfig.PortMapping {
+	for _, p := range ports {
+		if p.Protocol == vmconfig.TCP && p.GuestPort == 22 {
+			return ports
+		}
+	}
+
+	ssh := vmconfig.PortMapping{HostIP: vmconfig.DefaultHostIP, HostPort: 2222, GuestPort: 22, Protocol: vmconfig.TCP}
+	withSSH := append([]vmconfig.PortMapping{ssh}, ports...)
+	if CheckPortMappings(withSSH) != nil {
+		return ports
+	}
+	return withSSH
+}
+
+func forwardKey(p vmconfig.PortMapping) string {
+	if p.Protocol == vmconfig.UDP {
+		return "udp:" + p.HostAddr()
+	}
+	return p.HostAddr()
+}
+
+// CheckPortMappings reports host bindings which are given twice, overlap with
+// each other (a wildcard address overlaps every address of the same port) or
+// are already in use on the host.
+func CheckPortMappings(ports []vmconfig.PortMapping) error {
+	for i, p := range ports {
+		if err := CheckPortConflict(p, ports[:i]); err != nil {
+			return err
+		}
+		if err := checkPortFree(p); err != nil {
+			return fmt.Errorf("port mapping %s is not available: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// CheckPortConflict reports whether p overlaps one of the given ports
+func CheckPortConflict(p vmconfig.PortMapping, ports []vmconfig.PortMapping) error {
+	for _, q := range ports {
+		if overlaps(p, q) {
+			return fmt.Errorf("port mapping %s conflicts with %s", p, q)
+		}
+	}
+	return nil
+}
+
+func overlaps(p, q vmconfig.PortMapping) bool {
+	if p.Protocol != q.Protocol || p.HostPort != q.HostPort {
+		return false
+	}
+	pIP, qIP := net.ParseIP(p.HostIP), net.ParseIP(q.HostIP)
+	return pIP.IsUnspecified() || qIP.IsUnspecified() || pIP.Equal(qIP)
+}
+
+// checkPortFree binds the host address and releases it right away
+func checkPortFree(p vmconfig.PortMapping) error {
+	if p.Protocol == vmconfig.UDP {
+		conn, err := net.ListenPacket("udp", p.HostAddr())
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	ln, err := net.Listen("tcp", p.HostAddr())
+	if err != nil {
+		return err
+	}
+	return ln.Close()
+}
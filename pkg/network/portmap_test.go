@@ -0,0 +1,59 @@
+package network
+
+import (
+	"linuxvm/pkg/vmconfig"
+	"net"
+	"testing"
+)
+
+// boundPort listens on a free tcp port of 127.0.0.1 for the test
+func boundPort(t *testing.T) uint16 {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+// freeTestPort returns a tcp port of 127.0.0.1 nobody listens on
+func freeTestPort(t *testing.T) uint16 {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close() //nolint:errcheck
+	return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func TestCheckPortMappings(t *testing.T) {
+	free, bound := freeTestPort(t), boundPort(t)
+	tcp := func(ip string, port uint16) vmconfig.PortMapping {
+		return vmconfig.PortMapping{HostIP: ip, HostPort: port, GuestPort: 80, Protocol: vmconfig.TCP}
+	}
+	udp := func(ip string, port uint16) vmconfig.PortMapping {
+		return vmconfig.PortMapping{HostIP: ip, HostPort: port, GuestPort: 53, Protocol: vmconfig.UDP}
+	}
+
+	tests := []struct {
+		name    string
+		ports   []vmconfig.PortMapping
+		wantErr bool
+	}{
+		{name: "free", ports: []vmconfig.PortMapping{tcp("127.0.0.1", free)}},
+		{name: "tcp and udp of a port", ports: []vmconfig.PortMapping{tcp("127.0.0.1", free), udp("127.0.0.1", free)}},
+		{name: "given twice", ports: []vmconfig.PortMapping{tcp("127.0.0.1", free), tcp("127.0.0.1", free)}, wantErr: true},
+		{name: "wildcard overlaps", ports: []vmconfig.PortMapping{tcp("127.0.0.1", free), tcp("0.0.0.0", free)}, wantErr: true},
+		{name: "in use on the host", ports: []vmconfig.PortMapping{tcp("127.0.0.1", bound)}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CheckPortMappings(tt.ports); (err != nil) != tt.wantErr {
+				t.Errorf("CheckPortMappings(%v) error = %v, want error %v", tt.ports, err, tt.wantErr)
+			}
+		})
+	}
+}
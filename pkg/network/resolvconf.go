@@ -0,0 +1,137 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"linuxvm/pkg/vmconfig"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	HostResolvConf = "/etc/resolv.conf"
+	// systemd-resolved keeps the upstream nameservers here, /etc/resolv.conf
+	// only lists its stub listener 127.0.0.53
+	systemdResolvConf = "/run/systemd/resolve/resolv.conf"
+)
+
+// ParseResolvConf reads the nameserver, search (or domain) and options lines
+// of a resolv.conf
+func ParseResolvConf(file string) (vmconfig.Resolver, error) {
+	r := vmconfig.Resolver{}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return r, fmt.Errorf("failed to open resolv.conf: %w", err)
+	}
+	defer f.Close() //nolint:errcheck
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+
+		switch fields[0] {
+		case "nameserver":
+			// scoped ipv6 addresses like fe80::1%eth0 are not reachable from the guest
+			if ip := net.ParseIP(fields[1]); ip != nil {
+				r.Nameservers = append(r.Nameservers, ip.String())
+			}
+		case "search", "domain":
+			// the last search or domain line wins
+			r.Search = fields[1:]
+		case "options":
+			r.Options = append(r.Options, fields[1:]...)
+		}
+	}
+
+	return r, sc.Err()
+}
+
+// HostResolver returns the resolver of the host. If /etc/resolv.conf only
+// lists a local stub like the 127.0.0.53 of systemd-resolved, the nameservers
+// are the upstream nameservers of the stub, the stub is not reachable from
+// the guest.
+func HostResolver() (vmconfig.Resolver, error) {
+	r, err := ParseResolvConf(HostResolvConf)
+	if err != nil {
+		return r, err
+	}
+
+	if len(r.Nameservers) > 0 && len(reachable(r.Nameservers)) == 0 {
+		upstream, err := ParseResolvConf(systemdResolvConf)
+		if err != nil {
+			logrus.Debugf("no upstream nameservers of the stub resolver %v: %v", r.Nameservers, err)
+		} else if len(reachable(upstream.Nameservers)) > 0 {
+			logrus.Infof("stub resolver %v found, using its upstream nameservers %v", r.Nameservers, upstream.Nameservers)
+			r.Nameservers = upstream.Nameservers
+			if len(r.Search) == 0 {
+				r.Search = upstream.Search
+			}
+		}
+	}
+
+	r.Nameservers = reachable(r.Nameservers)
+	return r, nil
+}
+
+// GuestResolver returns the resolver of the guest: the nameservers of the
+// vm if given, else the gvproxy dns server on the gateway in the NetGVproxy
+// mode, which resolves by the host resolver, or the upstream nameservers of
+// the host in the NetPasst mode. The search domains and options are taken
+// from the host unless given. A vm of the NetNone mode has no resolver.
+func GuestResolver(n vmconfig.Network) vmconfig.Resolver {
+	if n.Mode == vmconfig.NetNone {
+		return vmconfig.Resolver{}
+	}
+
+	r, err := HostResolver()
+	if err != nil {
+		logrus.Warnf("failed to read the host resolver: %v", err)
+	}
+
+	switch {
+	case len(n.DNS.Nameservers) > 0:
+	case n.Mode == vmconfig.NetGVproxy || len(r.Nameservers) == 0:
+		// passt forwards the queries to the gateway to the host resolver
+		r.Nameservers = []string{n.GatewayIP}
+	}
+	r.Merge(n.DNS)
+
+	return r
+}
+
+// ResolvConfFile returns the resolv.conf of r
+func ResolvConfFile(r vmconfig.Resolver) []byte {
+	var b bytes.Buffer
+	b.WriteString("# generated by revm\n")
+	for _, ns := range r.Nameservers {
+		fmt.Fprintf(&b, "nameserver %s\n", ns)
+	}
+	if len(r.Search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(r.Search, " "))
+	}
+	if len(r.Options) > 0 {
+		fmt.Fprintf(&b, "options %s\n", strings.Join(r.Options, " "))
+	}
+	return b.Bytes()
+}
+
+// reachable drops the loopback and unspecified nameservers
+func reachable(nameservers []string) []string {
+	var out []string
+	for _, ns := range nameservers {
+		ip := net.ParseIP(ns)
+		if ip == nil || ip.IsLoopback() || ip.IsUnspecified() {
+			continue
+		}
+		out = append(out, ns)
+	}
+	return out
+}
@@ -0,0 +1,46 @@
+//go:build darwin
+
+package network
+
+import (
+	"net"
+
+	"golang.org/x/net/route"
+	"golang.org/x/sys/unix"
+)
+
+// hostRoutes dumps the ipv4 routing table of the host
+func hostRoutes() ([]*net.IPNet, error) {
+	rib, err := route.FetchRIB(unix.AF_INET, route.RIBTypeRoute, 0)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := route.ParseRIB(route.RIBTypeRoute, rib)
+	if err != nil {
+		return nil, err
+	}
+
+	var routes []*net.IPNet
+	for _, msg := range msgs {
+		rm, ok := msg.(*route.RouteMessage)
+		if !ok || len(rm.Addrs) <= unix.RTAX_NETMASK {
+			continue
+		}
+		dst, ok := rm.Addrs[unix.RTAX_DST].(*route.Inet4Addr)
+		if !ok {
+			continue
+		}
+
+		mask := net.CIDRMask(32, 32)
+		if rm.Flags&unix.RTF_HOST == 0 {
+			// a missing netmask is the default route
+			mask = net.CIDRMask(0, 32)
+			if m, ok := rm.Addrs[unix.RTAX_NETMASK].(*route.Inet4Addr); ok {
+				mask = net.IPv4Mask(m.IP[0], m.IP[1], m.IP[2], m.IP[3])
+			}
+		}
+		routes = append(routes, &net.IPNet{IP: net.IP(dst.IP[:]).Mask(mask), Mask: mask})
+	}
+
+	return routes, nil
+}
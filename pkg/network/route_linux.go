@@ -0,0 +1,55 @@
+//go:build linux
+
+package network
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// hostRoutes reads the ipv4 routes from /proc/net/route
+func hostRoutes() ([]*net.IPNet, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() //nolint:errcheck
+
+	var routes []*net.IPNet
+	sc := bufio.NewScanner(f)
+	// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+	sc.Scan()
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 8 {
+			continue
+		}
+		dst, err := parseProcIP(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		mask, err := parseProcIP(fields[7])
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, &net.IPNet{IP: dst, Mask: net.IPMask(mask)})
+	}
+
+	return routes, sc.Err()
+}
+
+// parseProcIP parses an address of /proc/net/route, in hex of host byte order
+func parseProcIP(s string) (net.IP, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 4 {
+		return nil, fmt.Errorf("invalid address %q in /proc/net/route", s)
+	}
+	ip := make(net.IP, 4)
+	binary.NativeEndian.PutUint32(ip, binary.BigEndian.Uint32(b))
+	return ip, nil
+}
@@ -0,0 +1,45 @@
+package network
+
+import (
+	"fmt"
+	"net"
+)
+
+// CheckSubnet reports whether subnet overlaps a route or an address of the
+// host, e.g. a vpn range, the guest could not reach those hosts otherwise.
+// The default route is ignored.
+func CheckSubnet(subnet string) error {
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return fmt.Errorf("invalid subnet %q: %w", subnet, err)
+	}
+
+	routes, err := hostRoutes()
+	if err != nil {
+		return fmt.Errorf("failed to list host routes: %w", err)
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return fmt.Errorf("failed to list host addresses: %w", err)
+	}
+	for _, addr := range addrs {
+		if n, ok := addr.(*net.IPNet); ok {
+			routes = append(routes, n)
+		}
+	}
+
+	for _, route := range routes {
+		if ones, _ := route.Mask.Size(); ones == 0 {
+			continue
+		}
+		if route.IP.To4() == nil || route.IP.IsLoopback() {
+			continue
+		}
+		if ipNet.Contains(route.IP) || route.Contains(ipNet.IP) {
+			return fmt.Errorf("subnet %s collides with the host route %s, choose another one with --subnet", ipNet, route)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+// Package sshkey manages the ssh keypair revm logs in to a vm with.
+package sshkey
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const comment = "revm"
+
+// Ensure returns the authorized_keys line of the private key file, the key is
+// generated if the file does not exist. The public key is written next to it
+// with the .pub suffix.
+func Ensure(file string) (string, error) {
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return generate(file)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read ssh key: %w", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse ssh key %q: %w", file, err)
+	}
+	return authorizedKey(signer.PublicKey()), nil
+}
+
+func generate(file string) (string, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate ssh key: %w", err)
+	}
+
+	block, err := ssh.MarshalPrivateKey(priv, comment)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal ssh key: %w", err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal ssh key: %w", err)
+	}
+
+	// ssh refuses a private key readable by others
+	if err = os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+		return "", fmt.Errorf("failed to write ssh key: %w", err)
+	}
+	line := authorizedKey(sshPub)
+	if err = os.WriteFile(file+".pub", []byte(line+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("failed to write ssh key: %w", err)
+	}
+	return line, nil
+}
+
+func authorizedKey(pub ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))) + " " + comment
+}
@@ -0,0 +1,183 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"linuxvm/pkg/define"
+	"linuxvm/pkg/system"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Tracker records every file and dir revm creates on the host or in the rootfs
+// into a journal, so they are removed when the vm exits, or by the next revm
+// process if this one crashed.
+type Tracker struct {
+	mu      sync.Mutex
+	journal string
+	entry   journalEntry
+}
+
+type journalEntry struct {
+	// PIDs are the processes using the artifacts, the artifacts are stale
+	// once all of them are gone
+	PIDs []int
+	// Keep the artifacts on exit for debugging, only the journal is removed
+	Keep  bool
+	Paths []string
+}
+
+// NewTracker removes the artifacts left by crashed revm processes, then
+// starts a journal for this process.
+func NewTracker(keep bool) (*Tracker, error) {
+	base, err := BaseDir()
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(base, define.ArtifactsDir)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create artifacts dir: %w", err)
+	}
+
+	cleanupStale(dir)
+
+	// the pid of a crashed revm process may be reused, the start time keeps
+	// its journal apart
+	t := &Tracker{
+		journal: filepath.Join(dir, fmt.Sprintf("%d-%d.json", os.Getpid(), time.Now().UnixNano())),
+		entry: journalEntry{
+			PIDs: []int{os.Getpid()},
+			Keep: keep,
+		},
+	}
+
+	return t, t.save()
+}
+
+// Track records path before it is created, so a crash in the middle is still
+// covered. path must be owned by revm, e.g. in a dir revm created, use Claim
+// for a path anyone else may create.
+func (t *Tracker) Track(path string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.entry.Paths = append(t.entry.Paths, path)
+	return t.save()
+}
+
+// Claim creates the empty file path and tracks it, it fails with
+// os.ErrExist if path exists, so a file revm did not create is never removed.
+// A crash between the creation and the journal leaves the empty file.
+func (t *Tracker) Claim(path string, perm os.FileMode) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	t.entry.Paths = append(t.entry.Paths, path)
+	return errors.Join(f.Close(), t.save())
+}
+
+// AddPID records another process using the artifacts, e.g. the vmm.
+func (t *Tracker) AddPID(pid int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.entry.PIDs = append(t.entry.PIDs, pid)
+	return t.save()
+}
+
+// Cleanup removes the artifacts in reverse order and the journal, the
+// artifacts are kept if the tracker was created with keep.
+func (t *Tracker) Cleanup() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var errs []error
+	if t.entry.Keep {
+		logrus.Infof("keep artifacts: %q", t.entry.Paths)
+	} else {
+		errs = append(errs, removePaths(t.entry.Paths))
+	}
+
+	if err := os.Remove(t.journal); err != nil && !errors.Is(err, os.ErrNotExist) {
+		errs = append(errs, fmt.Errorf("failed to remove journal: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (t *Tracker) save() error {
+	if err := writeJSON(t.journal, &t.entry); err != nil {
+		return fmt.Errorf("failed to save artifacts journal: %w", err)
+	}
+	return nil
+}
+
+// cleanupStale removes the artifacts of the journals whose processes are all
+// gone. This process has no journal yet, a journal naming its pid was left by
+// a crashed process whose pid is reused.
+func cleanupStale(dir string) {
+	self := os.Getpid()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		logrus.Warnf("failed to read artifacts dir: %v", err)
+		return
+	}
+
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+
+		journal := filepath.Join(dir, e.Name())
+		entry := journalEntry{}
+		if err = readJSON(journal, &entry); err != nil {
+			logrus.Warnf("failed to read artifacts journal %q: %v", journal, err)
+			continue
+		}
+
+		pids := slices.DeleteFunc(slices.Clone(entry.PIDs), func(pid int) bool { return pid == self })
+		if isAnyAlive(pids) {
+			continue
+		}
+
+		if !entry.Keep {
+			logrus.Infof("remove artifacts left by crashed revm %v: %q", entry.PIDs, entry.Paths)
+			if err = removePaths(entry.Paths); err != nil {
+				logrus.Warnf("%v", err)
+				continue
+			}
+		}
+		_ = os.Remove(journal)
+	}
+}
+
+func isAnyAlive(pids []int) bool {
+	for _, pid := range pids {
+		if system.IsProcessAlive(pid) {
+			return true
+		}
+	}
+	return false
+}
+
+func removePaths(paths []string) error {
+	var errs []error
+	for i := len(paths) - 1; i >= 0; i-- {
+		if err := os.RemoveAll(paths[i]); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove %q: %w", paths[i], err))
+		}
+	}
+	return errors.Join(errs...)
+}
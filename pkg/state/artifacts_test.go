@@ -0,0 +1,143 @@
+package state
+
+import (
+	"errors"
+	"linuxvm/pkg/define"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// newTestTracker returns a tracker of a temporary $REVM_HOME and its
+// artifacts dir
+func newTestTracker(t *testing.T, keep bool) (*Tracker, string) {
+	t.Helper()
+	t.Setenv(define.StateDirEnv, t.TempDir())
+	tracker, err := NewTracker(keep)
+	if err != nil {
+		t.Fatalf("NewTracker: %v", err)
+	}
+	base, _ := BaseDir()
+	return tracker, filepath.Join(base, define.ArtifactsDir)
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+func TestTrackerCleanup(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		tracker, _ := newTestTracker(t, keep)
+		dir := t.TempDir()
+
+		// a tracked dir is removed after the files in it
+		sub := filepath.Join(dir, "sub")
+		file := filepath.Join(sub, "file")
+		for _, p := range []string{sub, file} {
+			if err := tracker.Track(p); err != nil {
+				t.Fatalf("Track(%q): %v", p, err)
+			}
+		}
+		if err := os.Mkdir(sub, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		claimed := filepath.Join(dir, "claimed")
+		if err := tracker.Claim(claimed, 0644); err != nil {
+			t.Fatalf("Claim: %v", err)
+		}
+		if !exists(tracker.journal) {
+			t.Fatal("the journal is not written")
+		}
+
+		if err := tracker.Cleanup(); err != nil {
+			t.Fatalf("Cleanup: %v", err)
+		}
+		for _, p := range []string{sub, claimed} {
+			if exists(p) != keep {
+				t.Errorf("keep %v: %q exists %v", keep, p, exists(p))
+			}
+		}
+		if exists(tracker.journal) {
+			t.Errorf("keep %v: the journal is left", keep)
+		}
+	}
+}
+
+func TestTrackerClaim(t *testing.T) {
+	tracker, _ := newTestTracker(t, false)
+	existing := filepath.Join(t.TempDir(), "existing")
+	if err := os.WriteFile(existing, []byte("not revm"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tracker.Claim(existing, 0644); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("Claim of an existing file error = %v, want %v", err, os.ErrExist)
+	}
+	if err := tracker.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(existing); err != nil || string(b) != "not revm" {
+		t.Errorf("the file revm did not create is changed: %q, %v", b, err)
+	}
+}
+
+func TestCleanupStale(t *testing.T) {
+	_, dir := newTestTracker(t, false)
+
+	gone := exec.Command("true")
+	if err := gone.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		journal string
+		entry   journalEntry
+		removed bool
+	}{
+		{name: "crashed", journal: "crashed.json", entry: journalEntry{PIDs: []int{gone.Process.Pid}}, removed: true},
+		{name: "crashed with keep", journal: "keep.json", entry: journalEntry{PIDs: []int{gone.Process.Pid}, Keep: true}},
+		{name: "alive", journal: "alive.json", entry: journalEntry{PIDs: []int{gone.Process.Pid, os.Getppid()}}},
+		// a crashed process whose pid is reused by this process
+		{name: "own pid", journal: "reused.json", entry: journalEntry{PIDs: []int{os.Getpid()}}, removed: true},
+	}
+
+	artifacts := t.TempDir()
+	for i := range tests {
+		tt := &tests[i]
+		path := filepath.Join(artifacts, tt.name)
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		tt.entry.Paths = []string{path}
+		if err := writeJSON(filepath.Join(dir, tt.journal), &tt.entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tracker, err := NewTracker(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.Cleanup() //nolint:errcheck
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if exists(tt.entry.Paths[0]) == tt.removed {
+				t.Errorf("artifact exists %v, want removed %v", exists(tt.entry.Paths[0]), tt.removed)
+			}
+			alive := tt.name == "alive"
+			if got := exists(filepath.Join(dir, tt.journal)); got != alive {
+				t.Errorf("journal exists %v, want %v", got, alive)
+			}
+		})
+	}
+	if !exists(tracker.journal) || filepath.Base(tracker.journal) == "reused.json" {
+		t.Errorf("the journal of the tracker %q is not its own", tracker.journal)
+	}
+}
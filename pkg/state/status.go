@@ -0,0 +1,80 @@
+package state
+
+import (
+	"fmt"
+	"linuxvm/pkg/define"
+	"linuxvm/pkg/system"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+type State string
+
+const (
+	Created State = "created"
+	Running State = "running"
+	Stopped State = "stopped"
+)
+
+var ErrLocked = errors.New("vm is in use by another revm process")
+
+// Status is the runtime status of a named VM.
+type Status struct {
+	State     State
+	PID       int       `json:",omitempty"`
+	StartedAt time.Time `json:",omitempty"`
+	StoppedAt time.Time `json:",omitempty"`
+	// ExitCode is the exit status of the last run, see define.ExitCodeRevmError
+	ExitCode int
+}
+
+// Status loads the runtime status of the VM. A VM recorded as running whose
+// revm process is gone is reported as stopped.
+func (vm *VM) Status() (*Status, error) {
+	st := &Status{}
+	if err := readJSON(vm.Path(define.InstanceStatus), st); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &Status{State: Created}, nil
+		}
+		return nil, fmt.Errorf("failed to load status of %q: %w", vm.Name, err)
+	}
+
+	if st.State == Running && !system.IsProcessAlive(st.PID) {
+		st.State = Stopped
+		st.PID = 0
+	}
+
+	return st, nil
+}
+
+func (vm *VM) SaveStatus(st *Status) error {
+	if err := writeJSON(vm.Path(define.InstanceStatus), st); err != nil {
+		return fmt.Errorf("failed to save status of %q: %w", vm.Name, err)
+	}
+	return nil
+}
+
+// Lock takes an exclusive lock on the VM, which is held until the returned
+// release function is called or the process exits.
+func (vm *VM) Lock() (func(), error) {
+	f, err := os.OpenFile(vm.Path(define.InstanceLock), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	if err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		_ = f.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%q: %w", vm.Name, ErrLocked)
+		}
+		return nil, fmt.Errorf("failed to lock %q: %w", vm.Name, err)
+	}
+
+	return func() {
+		_ = unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		_ = f.Close()
+	}, nil
+}
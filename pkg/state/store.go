@@ -0,0 +1,235 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"linuxvm/pkg/define"
+	"linuxvm/pkg/system"
+	"linuxvm/pkg/vmconfig"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNotExist = errors.New("vm does not exist")
+	ErrExist    = errors.New("vm already exists")
+
+	validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+)
+
+// Store is the per-user directory which keeps every named VM, one
+// sub-directory per VM.
+type Store struct {
+	Root string
+}
+
+// Config is the persisted definition of a named VM.
+type Config struct {
+	Name      string
+	CreatedAt time.Time
+	VMConfig  vmconfig.VMConfig
+	Cmdline   vmconfig.Cmdline
+}
+
+// VM is a named VM inside the store.
+type VM struct {
+	Name string
+	Dir  string
+}
+
+// BaseDir returns $REVM_HOME, or $HOME/.revm if REVM_HOME is not set.
+func BaseDir() (string, error) {
+	base, find := os.LookupEnv(define.StateDirEnv)
+	if find && base != "" {
+		return base, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get user home dir: %w", err)
+	}
+	return filepath.Join(home, define.StateDir), nil
+}
+
+// NewStore returns the store located at BaseDir()/vms.
+func NewStore() (*Store, error) {
+	base, err := BaseDir()
+	if err != nil {
+		return nil, err
+	}
+
+	root := filepath.Join(base, define.VMsDir)
+	if err = os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create state dir: %w", err)
+	}
+
+	return &Store{Root: root}, nil
+}
+
+func ValidateName(name string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("invalid vm name %q, only [a-zA-Z0-9][a-zA-Z0-9_.-]* are allowed", name)
+	}
+	return nil
+}
+
+func (s *Store) vm(name string) *VM {
+	return &VM{
+		Name: name,
+		Dir:  filepath.Join(s.Root, name),
+	}
+}
+
+// Create makes the state directory of a new VM and persists its config, the
+// socket endpoints of vmc are rewritten to point into the state directory.
+func (s *Store) Create(name string, vmc vmconfig.VMConfig, cmdline vmconfig.Cmdline) (*VM, error) {
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+
+	vm := s.vm(name)
+	if err := os.Mkdir(vm.Dir, 0755); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("%q: %w", name, ErrExist)
+		}
+		return nil, fmt.Errorf("failed to create vm dir: %w", err)
+	}
+
+	vmc.GVproxyEndpoint = vm.GVproxyEndpoint()
+	vmc.NetworkStackBackend = vm.NetworkStackBackend()
+	vmc.ControlSocket = vm.Path(define.ControlSocket)
+	vmc.AgentSocket = vm.Path(define.AgentSocket)
+
+	cfg := &Config{
+		Name:      name,
+		CreatedAt: time.Now(),
+		VMConfig:  vmc,
+		Cmdline:   cmdline,
+	}
+
+	if err := vm.SaveConfig(cfg); err != nil {
+		_ = os.RemoveAll(vm.Dir)
+		return nil, err
+	}
+
+	if err := vm.SaveStatus(&Status{State: Created}); err != nil {
+		_ = os.RemoveAll(vm.Dir)
+		return nil, err
+	}
+
+	return vm, nil
+}
+
+// Get returns the VM with the given name, ErrNotExist if there is no such VM.
+func (s *Store) Get(name string) (*VM, error) {
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+
+	vm := s.vm(name)
+	if !system.IsPathExist(vm.Path(define.InstanceConfig)) {
+		return nil, fmt.Errorf("%q: %w", name, ErrNotExist)
+	}
+
+	return vm, nil
+}
+
+// List returns all VMs in the store, sorted by name.
+func (s *Store) List() ([]*VM, error) {
+	entries, err := os.ReadDir(s.Root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state dir: %w", err)
+	}
+
+	var vms []*VM //nolint:prealloc
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		vm, err := s.Get(entry.Name())
+		if err != nil {
+			continue
+		}
+		vms = append(vms, vm)
+	}
+
+	sort.Slice(vms, func(i, j int) bool {
+		return vms[i].Name < vms[j].Name
+	})
+
+	return vms, nil
+}
+
+// Remove deletes the state directory of the VM.
+func (s *Store) Remove(name string) error {
+	vm, err := s.Get(name)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(vm.Dir)
+}
+
+func (vm *VM) Path(file string) string {
+	return filepath.Join(vm.Dir, file)
+}
+
+func (vm *VM) GVproxyEndpoint() string {
+	return "unix://" + vm.Path(define.GVproxyControlSocket)
+}
+
+func (vm *VM) NetworkStackBackend() string {
+	return "unixgram://" + vm.Path(define.NetworkBackendSocket)
+}
+
+func (vm *VM) LoadConfig() (*Config, error) {
+	return LoadConfigFile(vm.Path(define.InstanceConfig))
+}
+
+func (vm *VM) SaveConfig(cfg *Config) error {
+	return cfg.WriteToFile(vm.Path(define.InstanceConfig))
+}
+
+func LoadConfigFile(file string) (*Config, error) {
+	cfg := &Config{}
+	if err := readJSON(file, cfg); err != nil {
+		return nil, fmt.Errorf("failed to load config %q: %w", file, err)
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) WriteToFile(file string) error {
+	if err := writeJSON(file, cfg); err != nil {
+		return fmt.Errorf("failed to save config %q: %w", file, err)
+	}
+	return nil
+}
+
+func readJSON(file string, v any) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// writeJSON writes v into a temp file first and renames it to file, so readers
+// never see a half written file.
+func writeJSON(file string, v any) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := file + ".tmp"
+	if err = os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
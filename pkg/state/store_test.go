@@ -0,0 +1,245 @@
+package state
+
+import (
+	"linuxvm/pkg/define"
+	"linuxvm/pkg/vmconfig"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// newTestStore returns the store of a temporary $REVM_HOME
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	t.Setenv(define.StateDirEnv, t.TempDir())
+	s, err := NewStore()
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	return s
+}
+
+func TestNewStore(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv(define.StateDirEnv, home)
+
+	s, err := NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(home, define.VMsDir); s.Root != want {
+		t.Errorf("Root = %q, want %q", s.Root, want)
+	}
+	if fi, err := os.Stat(s.Root); err != nil || !fi.IsDir() {
+		t.Errorf("the store dir is not created: %v", err)
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{name: "vm"},
+		{name: "vm-1.test_2"},
+		{name: "0vm"},
+		{name: "", wantErr: true},
+		{name: "-vm", wantErr: true},
+		{name: ".vm", wantErr: true},
+		{name: "..", wantErr: true},
+		{name: "a/b", wantErr: true},
+		{name: "vm name", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateName(tt.name); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateName(%q) error = %v, want error %v", tt.name, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStore(t *testing.T) {
+	s := newTestStore(t)
+	cmdline := vmconfig.Cmdline{TargetBin: "/bin/sh"}
+
+	for _, name := range []string{"b", "a"} {
+		if _, err := s.Create(name, vmconfig.VMConfig{}, cmdline); err != nil {
+			t.Fatalf("Create(%q): %v", name, err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		op   func() error
+		// fails is set if op fails with an error other than wantErr
+		fails   bool
+		wantErr error
+	}{
+		{
+			name:    "create existing",
+			op:      func() error { _, err := s.Create("a", vmconfig.VMConfig{}, cmdline); return err },
+			wantErr: ErrExist,
+		},
+		{
+			name:  "create invalid name",
+			op:    func() error { _, err := s.Create("../a", vmconfig.VMConfig{}, cmdline); return err },
+			fails: true,
+		},
+		{
+			name: "get",
+			op:   func() error { _, err := s.Get("a"); return err },
+		},
+		{
+			name:    "get missing",
+			op:      func() error { _, err := s.Get("c"); return err },
+			wantErr: ErrNotExist,
+		},
+		{
+			name:    "remove missing",
+			op:      func() error { return s.Remove("c") },
+			wantErr: ErrNotExist,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.op()
+			switch {
+			case tt.fails:
+				if err == nil {
+					t.Error("want an error")
+				}
+			case tt.wantErr == nil && err != nil:
+				t.Errorf("error = %v", err)
+			case tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// a dir without config is not a vm
+	if err := os.Mkdir(filepath.Join(s.Root, "partial"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	vms, err := s.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(vms) != 2 || vms[0].Name != "a" || vms[1].Name != "b" {
+		t.Errorf("List() = %v, want a and b", vms)
+	}
+
+	if err = s.Remove("a"); err != nil {
+		t.Fatalf("Remove(a): %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(s.Root, "a")); !os.IsNotExist(err) {
+		t.Errorf("the dir of a is left: %v", err)
+	}
+	if vms, _ = s.List(); len(vms) != 1 || vms[0].Name != "b" {
+		t.Errorf("List() after Remove = %v, want b", vms)
+	}
+}
+
+func TestCreateConfig(t *testing.T) {
+	s := newTestStore(t)
+	vm, err := s.Create("vm", vmconfig.VMConfig{MemoryInMB: 512}, vmconfig.Cmdline{TargetBin: "/bin/sh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := vm.LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.Name != "vm" || cfg.VMConfig.MemoryInMB != 512 || cfg.Cmdline.TargetBin != "/bin/sh" {
+		t.Errorf("config = %+v", cfg)
+	}
+	// the sockets of the vm are kept in its dir
+	for _, sock := range []string{cfg.VMConfig.ControlSocket, cfg.VMConfig.AgentSocket} {
+		if filepath.Dir(sock) != vm.Dir {
+			t.Errorf("socket %q is not in the vm dir %q", sock, vm.Dir)
+		}
+	}
+	if cfg.VMConfig.GVproxyEndpoint != "unix://"+vm.Path(define.GVproxyControlSocket) {
+		t.Errorf("gvproxy endpoint = %q", cfg.VMConfig.GVproxyEndpoint)
+	}
+
+	st, err := vm.Status()
+	if err != nil || st.State != Created {
+		t.Errorf("Status() = %+v, %v, want created", st, err)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	s := newTestStore(t)
+	vm, err := s.Create("vm", vmconfig.VMConfig{}, vmconfig.Cmdline{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gone := exec.Command("true")
+	if err = gone.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		saved   *Status
+		want    State
+		wantPID int
+	}{
+		{name: "running", saved: &Status{State: Running, PID: os.Getpid()}, want: Running, wantPID: os.Getpid()},
+		{name: "stale pid", saved: &Status{State: Running, PID: gone.Process.Pid}, want: Stopped},
+		{name: "stopped", saved: &Status{State: Stopped, ExitCode: 3}, want: Stopped},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := vm.SaveStatus(tt.saved); err != nil {
+				t.Fatal(err)
+			}
+			st, err := vm.Status()
+			if err != nil {
+				t.Fatalf("Status: %v", err)
+			}
+			if st.State != tt.want || st.PID != tt.wantPID || st.ExitCode != tt.saved.ExitCode {
+				t.Errorf("Status() = %+v, want %s pid %d", st, tt.want, tt.wantPID)
+			}
+		})
+	}
+
+	if err = os.Remove(vm.Path(define.InstanceStatus)); err != nil {
+		t.Fatal(err)
+	}
+	if st, err := vm.Status(); err != nil || st.State != Created {
+		t.Errorf("Status() without status file = %+v, %v, want created", st, err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	s := newTestStore(t)
+	vm, err := s.Create("vm", vmconfig.VMConfig{}, vmconfig.Cmdline{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unlock, err := vm.Lock()
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if _, err = vm.Lock(); !errors.Is(err, ErrLocked) {
+		t.Errorf("second Lock() error = %v, want %v", err, ErrLocked)
+	}
+
+	unlock()
+	unlock, err = vm.Lock()
+	if err != nil {
+		t.Fatalf("Lock after unlock: %v", err)
+	}
+	unlock()
+}
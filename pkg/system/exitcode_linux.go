@@ -0,0 +1,30 @@
+//go:build linux
+
+package system
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// krunExitCodeIoctl is _IO('v', 2), handled by the virtio-fs device of
+// libkrun, the VMM calls exit() with the given code once the guest is down.
+const krunExitCodeIoctl = 0x7602
+
+// SetExitCode tells the VMM which exit status the host process should exit
+// with, it must be called in the guest.
+func SetExitCode(code int) error {
+	f, err := os.Open("/")
+	if err != nil {
+		return fmt.Errorf("failed to open rootfs: %w", err)
+	}
+	defer f.Close() //nolint:errcheck
+
+	if err = unix.IoctlSetInt(int(f.Fd()), krunExitCodeIoctl, code); err != nil {
+		return fmt.Errorf("failed to set exit code: %w", err)
+	}
+
+	return nil
+}
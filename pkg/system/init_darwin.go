@@ -0,0 +1,38 @@
+//go:build darwin
+
+package system
+
+import (
+	"os/exec"
+	"time"
+)
+
+type Reaper struct{}
+
+func NewReaper() *Reaper {
+	return &Reaper{}
+}
+
+func SetSubreaper() error {
+	return nil
+}
+
+func (r *Reaper) Start(cmd *exec.Cmd, start func() error) error {
+	return start()
+}
+
+func (r *Reaper) Run(cmd *exec.Cmd) error {
+	return cmd.Run()
+}
+
+func (r *Reaper) Wait(cmd *exec.Cmd) error {
+	return cmd.Wait()
+}
+
+func (r *Reaper) Reap() {}
+
+func KillAll(timeout time.Duration) {}
+
+func PowerOff() error {
+	return nil
+}
@@ -0,0 +1,157 @@
+//go:build linux
+
+package system
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Reaper reaps the orphaned processes reparented to the bootstrap, which runs
+// as pid 1 of the guest or as a child subreaper. A child started by exec.Cmd
+// is waited for by its Cmd, it must be started by Reaper.Start so it is not
+// reaped behind the back of the Cmd.
+type Reaper struct {
+	mu      sync.Mutex
+	managed map[int]bool
+}
+
+// NewReaper returns a Reaper, Reap must run for the orphans to be reaped
+func NewReaper() *Reaper {
+	return &Reaper{managed: map[int]bool{}}
+}
+
+// SetSubreaper makes the orphaned descendants of the process its children
+// instead of children of pid 1
+func SetSubreaper() error {
+	if err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to become child subreaper: %w", err)
+	}
+	return nil
+}
+
+// Start starts cmd by start, cmd.Start or a helper calling it, e.g. to start
+// cmd on a pty. cmd must be waited for by Wait.
+func (r *Reaper) Start(cmd *exec.Cmd, start func() error) error {
+	// a child exiting right away must not be reaped before it is managed
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := start(); err != nil {
+		return err
+	}
+	r.managed[cmd.Process.Pid] = true
+	return nil
+}
+
+// Run starts cmd by Start and waits for it
+func (r *Reaper) Run(cmd *exec.Cmd) error {
+	if err := r.Start(cmd, cmd.Start); err != nil {
+		return err
+	}
+	return r.Wait(cmd)
+}
+
+// Wait waits for cmd started by Start
+func (r *Reaper) Wait(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	r.mu.Lock()
+	delete(r.managed, cmd.Process.Pid)
+	r.mu.Unlock()
+	return err
+}
+
+// Reap reaps the exited orphans on SIGCHLD, it never returns
+func (r *Reaper) Reap() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGCHLD)
+
+	for {
+		r.reap()
+		<-sigs
+	}
+}
+
+// reap waits for the zombie children nobody else waits for, signals are
+// coalesced, so every zombie is looked for
+func (r *Reaper) reap() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, pid := range zombieChildren() {
+		if r.managed[pid] {
+			continue
+		}
+		var status unix.WaitStatus
+		_, _ = unix.Wait4(pid, &status, unix.WNOHANG, nil)
+	}
+}
+
+// zombieChildren lists the exited children of the process from /proc
+func zombieChildren() []int {
+	stats, _ := filepath.Glob("/proc/[0-9]*/stat")
+	self := os.Getpid()
+
+	var pids []int
+	for _, file := range stats {
+		stat, err := readStat(file)
+		if err != nil || stat.State != "Z" || stat.PPID != self {
+			continue
+		}
+		pids = append(pids, stat.PID)
+	}
+	return pids
+}
+
+// KillAll sends SIGTERM to every process but pid 1, and SIGKILL to those
+// still alive after timeout, and reaps them. It must only be called by pid 1
+// before the filesystems are unmounted, a process left keeps them busy.
+func KillAll(timeout time.Duration) {
+	if err := unix.Kill(-1, unix.SIGTERM); errors.Is(err, unix.ESRCH) {
+		return
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if !reapAll() {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// a process in uninterruptible sleep may not even die by SIGKILL
+	_ = unix.Kill(-1, unix.SIGKILL)
+	deadline = time.Now().Add(timeout)
+	for reapAll() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// reapAll reaps the exited children, it reports whether children are left
+func reapAll() bool {
+	for {
+		var status unix.WaitStatus
+		pid, err := unix.Wait4(-1, &status, unix.WNOHANG, nil)
+		switch {
+		case errors.Is(err, unix.ECHILD):
+			return false
+		case err != nil, pid == 0:
+			return true
+		}
+	}
+}
+
+// PowerOff syncs the filesystems and powers the vm off, the VMM exits with
+// the code given by SetExitCode. It only returns on error.
+func PowerOff() error {
+	unix.Sync()
+	return unix.Reboot(unix.LINUX_REBOOT_CMD_POWER_OFF)
+}
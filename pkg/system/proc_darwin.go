@@ -0,0 +1,7 @@
+//go:build darwin
+
+package system
+
+func ListProcesses() ([]ProcStat, error) {
+	return nil, nil
+}
@@ -0,0 +1,68 @@
+//go:build linux
+
+package system
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ListProcesses lists the processes of /proc, a process exiting while it is
+// read is left out
+func ListProcesses() ([]ProcStat, error) {
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		return nil, err
+	}
+
+	procs := make([]ProcStat, 0, len(stats))
+	for _, file := range stats {
+		stat, err := readStat(file)
+		if err != nil {
+			continue
+		}
+		dir := filepath.Dir(file)
+		if fi, err := os.Stat(dir); err == nil {
+			if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+				stat.UID = int(st.Uid)
+			}
+		}
+		if b, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil && len(b) > 0 {
+			stat.Cmdline = strings.Split(strings.TrimRight(string(b), "\x00"), "\x00")
+		}
+		procs = append(procs, stat)
+	}
+	return procs, nil
+}
+
+// readStat parses the pid, name, state and ppid of a /proc/<pid>/stat file
+func readStat(file string) (ProcStat, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return ProcStat{}, err
+	}
+
+	// pid (comm) state ppid ..., comm may contain spaces and parens
+	open, end := bytes.IndexByte(b, '('), bytes.LastIndexByte(b, ')')
+	if open < 0 || end < open {
+		return ProcStat{}, fmt.Errorf("invalid %q", file)
+	}
+	fields := bytes.Fields(b[end+1:])
+	if len(fields) < 2 {
+		return ProcStat{}, fmt.Errorf("invalid %q", file)
+	}
+
+	stat := ProcStat{State: string(fields[0]), Name: string(b[open+1 : end])}
+	if stat.PID, err = strconv.Atoi(string(bytes.TrimSpace(b[:open]))); err != nil {
+		return ProcStat{}, fmt.Errorf("invalid pid in %q", file)
+	}
+	if stat.PPID, err = strconv.Atoi(string(fields[1])); err != nil {
+		return ProcStat{}, fmt.Errorf("invalid ppid in %q", file)
+	}
+	return stat, nil
+}
@@ -0,0 +1,26 @@
+package system
+
+import (
+	"errors"
+	"syscall"
+)
+
+// ProcStat is a process of the guest as read from /proc
+type ProcStat struct {
+	PID   int
+	PPID  int
+	UID   int
+	State string
+	Name  string
+	// Cmdline is empty for kernel threads and zombies
+	Cmdline []string
+}
+
+// IsProcessAlive reports whether a process with the given pid still exists.
+func IsProcessAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
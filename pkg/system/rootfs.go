@@ -0,0 +1,65 @@
+package system
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxSymlinks is the same limit as the linux kernel
+const maxSymlinks = 40
+
+// LookupInRootFS resolves path the way the guest sees it, absolute symlinks
+// are resolved against rootfs instead of the host root. It returns the host
+// path and whether it exists.
+func LookupInRootFS(rootfs, path string) (string, bool) {
+	resolved := "/"
+	parts := strings.Split(filepath.Clean("/"+path), "/")
+
+	for links := 0; len(parts) > 0; {
+		part := parts[0]
+		parts = parts[1:]
+		if part == "" || part == "." {
+			continue
+		}
+		if part == ".." {
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		hostPath := filepath.Join(rootfs, next)
+		info, err := os.Lstat(hostPath)
+		if err != nil {
+			return hostPath, false
+		}
+
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return hostPath, false
+		}
+
+		target, err := os.Readlink(hostPath)
+		if err != nil {
+			return hostPath, false
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		parts = append(strings.Split(target, "/"), parts...)
+	}
+
+	return filepath.Join(rootfs, resolved), true
+}
+
+// IsWritable reports whether the current user can write into path.
+func IsWritable(path string) bool {
+	return unix.Access(path, unix.W_OK) == nil
+}
@@ -0,0 +1,138 @@
+package system
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Credential is a user and group resolved against the passwd and group files
+// of a rootfs.
+type Credential struct {
+	Name   string
+	Home   string
+	Shell  string
+	UID    uint32
+	GID    uint32
+	Groups []uint32
+}
+
+// LookupCredential resolves user and group, either names or numeric ids,
+// against passwdFile and groupFile. The group defaults to the primary group of
+// the user, a numeric user not in passwdFile gets gid 0, home "/" and shell
+// /bin/sh.
+func LookupCredential(passwdFile, groupFile, user, group string) (*Credential, error) {
+	cred := &Credential{Name: user, Home: "/", Shell: "/bin/sh"}
+	if user == "" {
+		cred.Name = "root"
+		user = "0"
+	}
+
+	passwd, err := readColonFile(passwdFile, 7) //nolint:mnd
+	if err != nil {
+		return nil, err
+	}
+
+	found := false
+	for _, fields := range passwd {
+		if fields[0] != user && fields[2] != user {
+			continue
+		}
+		uid, err1 := parseID(fields[2])
+		gid, err2 := parseID(fields[3])
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid passwd entry for %q in %q", fields[0], passwdFile)
+		}
+		cred.Name, cred.UID, cred.GID, cred.Home = fields[0], uid, gid, fields[5]
+		if fields[6] != "" {
+			cred.Shell = fields[6]
+		}
+		found = true
+		break
+	}
+
+	if !found {
+		uid, err := parseID(user)
+		if err != nil {
+			return nil, fmt.Errorf("user %q not found in %q", user, passwdFile)
+		}
+		cred.UID = uid
+	}
+
+	groups, err := readColonFile(groupFile, 4) //nolint:mnd
+	if err != nil {
+		return nil, err
+	}
+
+	if group != "" {
+		gid, err := lookupGroup(groups, group)
+		if err != nil {
+			return nil, fmt.Errorf("%w in %q", err, groupFile)
+		}
+		cred.GID = gid
+	}
+
+	// supplementary groups listing the user as member
+	for _, fields := range groups {
+		for _, member := range strings.Split(fields[3], ",") {
+			if member != cred.Name {
+				continue
+			}
+			if gid, err := parseID(fields[2]); err == nil && gid != cred.GID {
+				cred.Groups = append(cred.Groups, gid)
+			}
+		}
+	}
+
+	return cred, nil
+}
+
+func lookupGroup(groups [][]string, group string) (uint32, error) {
+	for _, fields := range groups {
+		if fields[0] == group || fields[2] == group {
+			return parseID(fields[2])
+		}
+	}
+
+	gid, err := parseID(group)
+	if err != nil {
+		return 0, fmt.Errorf("group %q not found", group)
+	}
+	return gid, nil
+}
+
+func parseID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	return uint32(id), err
+}
+
+// readColonFile reads a passwd(5) style file, lines with less than n fields
+// are skipped. A missing file is an empty file.
+func readColonFile(file string, n int) ([][]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open %q: %w", file, err)
+	}
+	defer f.Close() //nolint:errcheck
+
+	var entries [][]string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < n {
+			continue
+		}
+		entries = append(entries, fields)
+	}
+
+	return entries, sc.Err()
+}
@@ -0,0 +1,38 @@
+package vmconfig
+
+import (
+	"linuxvm/pkg/filesystem"
+	"slices"
+)
+
+// BaseMounts selects the pseudo filesystems the bootstrap mounts before the
+// shares, besides the defaults of filesystem.BaseMounts
+type BaseMounts struct {
+	// Extra are optional base mounts to mount as well, e.g. binfmt_misc
+	Extra []string `json:"extra,omitempty"`
+	// Skip are base mounts not to mount, e.g. cgroup2
+	Skip []string `json:"skip,omitempty"`
+}
+
+// Merge adds the names of other
+func (b *BaseMounts) Merge(other BaseMounts) {
+	for _, name := range other.Extra {
+		if !slices.Contains(b.Extra, name) {
+			b.Extra = append(b.Extra, name)
+		}
+	}
+	for _, name := range other.Skip {
+		if !slices.Contains(b.Skip, name) {
+			b.Skip = append(b.Skip, name)
+		}
+	}
+}
+
+func (b BaseMounts) Validate() error {
+	for _, name := range append(slices.Clone(b.Extra), b.Skip...) {
+		if err := filesystem.CheckBaseMount(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
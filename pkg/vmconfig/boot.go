@@ -0,0 +1,106 @@
+package vmconfig
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// the boot stages of the bootstrap, the cmdline runs once they are done
+const (
+	// StageDNS writes /etc/hosts and /etc/resolv.conf
+	StageDNS = "dns"
+	// StageBase mounts the pseudo filesystems, /proc, /dev/pts, /tmp...
+	StageBase = "base"
+	// StageMounts mounts the virtiofs shares, after StageBase
+	StageMounts = "mounts"
+	// StageNetwork leases the guest address
+	StageNetwork = "network"
+	// StageSockets serves the unix sockets, after StageMounts
+	StageSockets = "sockets"
+	// StageSSH sets up ssh, after StageMounts
+	StageSSH = "ssh"
+)
+
+// BootStages are the stages a BootStage can name
+var BootStages = []string{StageBase, StageMounts, StageNetwork, StageDNS, StageSockets, StageSSH}
+
+const (
+	// StageRequired stages must succeed, else the cmdline is not run
+	StageRequired = "required"
+	// StageOptional stages may fail, the cmdline runs anyway
+	StageOptional = "optional"
+)
+
+// BootStage overrides the policy of a boot stage, the stages keep their
+// defaults unless given
+type BootStage struct {
+	Name string `json:"name"`
+	// Policy is StageRequired or StageOptional
+	Policy string `json:"policy,omitempty"`
+	// Timeout fails the stage if it takes longer, e.g. 30s
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// ParseBootStage parses name[:policy][:timeout], e.g. network:optional:10s
+func ParseBootStage(s string) (BootStage, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		return BootStage{}, fmt.Errorf("invalid boot stage %q, want name[:policy][:timeout]", s)
+	}
+
+	stage := BootStage{Name: parts[0]}
+	for _, part := range parts[1:] {
+		if part == StageRequired || part == StageOptional {
+			stage.Policy = part
+		} else {
+			stage.Timeout = part
+		}
+	}
+	if err := stage.Validate(); err != nil {
+		return stage, fmt.Errorf("invalid boot stage %q: %w", s, err)
+	}
+	return stage, nil
+}
+
+func (b BootStage) Validate() error {
+	if !slices.Contains(BootStages, b.Name) {
+		return fmt.Errorf("unknown boot stage %q, must be one of %s", b.Name, strings.Join(BootStages, ", "))
+	}
+	if b.Policy != "" && b.Policy != StageRequired && b.Policy != StageOptional {
+		return fmt.Errorf("invalid policy %q of boot stage %s, must be %s or %s", b.Policy, b.Name, StageRequired, StageOptional)
+	}
+	if b.Timeout != "" {
+		if d, err := time.ParseDuration(b.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("invalid timeout %q of boot stage %s", b.Timeout, b.Name)
+		}
+	}
+	return nil
+}
+
+// TimeoutDuration is the parsed Timeout, 0 if not given
+func (b BootStage) TimeoutDuration() time.Duration {
+	d, _ := time.ParseDuration(b.Timeout)
+	return d
+}
+
+// MergeBootStages returns base with the stages of override, a stage given in
+// both gets the non-empty values of override
+func MergeBootStages(base, override []BootStage) []BootStage {
+	merged := slices.Clone(base)
+	for _, o := range override {
+		i := slices.IndexFunc(merged, func(b BootStage) bool { return b.Name == o.Name })
+		if i < 0 {
+			merged = append(merged, o)
+			continue
+		}
+		if o.Policy != "" {
+			merged[i].Policy = o.Policy
+		}
+		if o.Timeout != "" {
+			merged[i].Timeout = o.Timeout
+		}
+	}
+	return merged
+}
@@ -0,0 +1,166 @@
+package vmconfig
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+var validHostname = regexp.MustCompile(`^[a-zA-Z0-9_]([a-zA-Z0-9_-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9_]([a-zA-Z0-9_-]*[a-zA-Z0-9])?)*$`)
+
+// HostEntry maps a name to an address, like a line of /etc/hosts.
+type HostEntry struct {
+	Name string `json:"name"`
+	IP   string `json:"ip"`
+}
+
+// DNSZone is served by the gvproxy dns server, e.g. the record db of the zone
+// corp.internal resolves db.corp.internal.
+type DNSZone struct {
+	Name    string      `json:"name"`
+	Records []HostEntry `json:"records,omitempty"`
+}
+
+// ParseHostEntry parses name:ip, the ip can be ipv4 or ipv6
+func ParseHostEntry(s string) (HostEntry, error) {
+	name, ip, found := strings.Cut(s, ":")
+	if !found {
+		return HostEntry{}, fmt.Errorf("invalid host %q, want name:ip", s)
+	}
+
+	h := HostEntry{Name: name, IP: strings.Trim(ip, "[]")}
+	return h, h.Validate()
+}
+
+// ParseDNSZone parses zone=name:ip[,name:ip...], e.g.
+// corp.internal=db:10.0.0.5,cache:10.0.0.6
+func ParseDNSZone(s string) (DNSZone, error) {
+	name, records, _ := strings.Cut(s, "=")
+	zone := DNSZone{Name: strings.TrimSuffix(name, ".")}
+
+	for _, r := range strings.Split(records, ",") {
+		if r == "" {
+			continue
+		}
+		record, err := ParseHostEntry(r)
+		if err != nil {
+			return zone, fmt.Errorf("invalid dns zone %q: %w", s, err)
+		}
+		zone.Records = append(zone.Records, record)
+	}
+
+	return zone, zone.Validate()
+}
+
+func (h HostEntry) Validate() error {
+	if !validHostname.MatchString(h.Name) {
+		return fmt.Errorf("invalid host name %q", h.Name)
+	}
+	if net.ParseIP(h.IP) == nil {
+		return fmt.Errorf("invalid ip %q of host %q", h.IP, h.Name)
+	}
+	return nil
+}
+
+// Validate checks the zone name and the records, gvproxy only answers A
+// records so the addresses must be ipv4
+func (z DNSZone) Validate() error {
+	if !validHostname.MatchString(z.Name) {
+		return fmt.Errorf("invalid dns zone name %q", z.Name)
+	}
+	for _, r := range z.Records {
+		if err := r.Validate(); err != nil {
+			return fmt.Errorf("invalid record of dns zone %q: %w", z.Name, err)
+		}
+		if net.ParseIP(r.IP).To4() == nil {
+			return fmt.Errorf("invalid record of dns zone %q: %s must be an ipv4 address", z.Name, r.IP)
+		}
+	}
+	return nil
+}
+
+// FQDN returns the fully qualified name of a record in the zone, without the
+// trailing dot
+func (z DNSZone) FQDN(record HostEntry) string {
+	return record.Name + "." + z.Name
+}
+
+// MergeHosts returns base with the entries of override applied, an entry in
+// override replaces the entry with the same name in base.
+func MergeHosts(base, override []HostEntry) []HostEntry {
+	merged := append([]HostEntry{}, base...)
+next:
+	for _, h := range override {
+		for i := range merged {
+			if merged[i].Name == h.Name {
+				merged[i] = h
+				continue next
+			}
+		}
+		merged = append(merged, h)
+	}
+	return merged
+}
+
+// MergeDNSZones returns base with the zones of override applied, the records
+// of zones with the same name are merged by MergeHosts.
+func MergeDNSZones(base, override []DNSZone) []DNSZone {
+	merged := append([]DNSZone{}, base...)
+next:
+	for _, z := range override {
+		for i := range merged {
+			if merged[i].Name == z.Name {
+				merged[i].Records = MergeHosts(merged[i].Records, z.Records)
+				continue next
+			}
+		}
+		merged = append(merged, z)
+	}
+	return merged
+}
+
+// Resolver is the content of a resolv.conf
+type Resolver struct {
+	Nameservers []string `json:"nameservers,omitempty"`
+	Search      []string `json:"search,omitempty"`
+	Options     []string `json:"options,omitempty"`
+}
+
+// Validate checks the nameservers are reachable from the guest, a loopback
+// nameserver would be the guest itself
+func (r Resolver) Validate() error {
+	for _, ns := range r.Nameservers {
+		ip := net.ParseIP(ns)
+		if ip == nil {
+			return fmt.Errorf("invalid nameserver %q", ns)
+		}
+		if ip.IsLoopback() || ip.IsUnspecified() {
+			return fmt.Errorf("invalid nameserver %q, the guest can not reach it", ns)
+		}
+	}
+	for _, domain := range r.Search {
+		if !validHostname.MatchString(strings.TrimSuffix(domain, ".")) {
+			return fmt.Errorf("invalid search domain %q", domain)
+		}
+	}
+	for _, opt := range r.Options {
+		if opt == "" || strings.ContainsAny(opt, " \t\n") {
+			return fmt.Errorf("invalid resolver option %q", opt)
+		}
+	}
+	return nil
+}
+
+// Merge replaces the lists of r by the non-empty lists of other
+func (r *Resolver) Merge(other Resolver) {
+	if len(other.Nameservers) > 0 {
+		r.Nameservers = other.Nameservers
+	}
+	if len(other.Search) > 0 {
+		r.Search = other.Search
+	}
+	if len(other.Options) > 0 {
+		r.Options = other.Options
+	}
+}
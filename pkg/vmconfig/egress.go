@@ -0,0 +1,183 @@
+package vmconfig
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	EgressAllow = "allow"
+	EgressDeny  = "deny"
+
+	ICMP = "icmp"
+)
+
+// EgressPolicy restricts the traffic of the guest leaving the virtual
+// network. The rules are matched in order, the first matching rule decides,
+// Default decides the traffic no rule matches.
+type EgressPolicy struct {
+	// Default is EgressAllow or EgressDeny, EgressAllow by default
+	Default string       `json:"default,omitempty"`
+	Rules   []EgressRule `json:"rules,omitempty"`
+}
+
+// EgressRule matches the traffic by destination and protocol, CIDR and
+// Domain are exclusive, a rule without both matches every destination.
+type EgressRule struct {
+	Action string `json:"action"`
+	CIDR   string `json:"cidr,omitempty"`
+	// Domain matches the name and its subdomains, the destination address
+	// matches if the dns server of the gateway resolved the name to it
+	Domain string `json:"domain,omitempty"`
+	// Ports is a port or a range like 8000-9000, empty matches every port
+	Ports    string `json:"ports,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+}
+
+// Enabled reports if the policy restricts anything
+func (p EgressPolicy) Enabled() bool {
+	return len(p.Rules) > 0 || p.Default == EgressDeny
+}
+
+// HasDomainRules reports if a rule matches by domain
+func (p EgressPolicy) HasDomainRules() bool {
+	for _, r := range p.Rules {
+		if r.Domain != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the default action and the rules
+func (p EgressPolicy) Validate() error {
+	switch p.Default {
+	case "", EgressAllow, EgressDeny:
+	default:
+		return fmt.Errorf("invalid default egress action %q, must be %s or %s", p.Default, EgressAllow, EgressDeny)
+	}
+	for _, r := range p.Rules {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseEgressRule parses action:target[:ports][/protocol], the target is an
+// ipv4 cidr or address, a domain, or * for any destination, e.g.
+// allow:mirror.example.com:443/tcp, deny:10.0.0.0/8 or allow:*:53/udp
+func ParseEgressRule(s string) (EgressRule, error) {
+	action, spec, found := strings.Cut(s, ":")
+	if !found || spec == "" {
+		return EgressRule{}, fmt.Errorf("invalid egress rule %q, want action:target[:ports][/protocol]", s)
+	}
+	r := EgressRule{Action: action}
+
+	if i := strings.LastIndex(spec, "/"); i >= 0 {
+		switch proto := spec[i+1:]; proto {
+		case TCP, UDP, ICMP:
+			r.Protocol = proto
+			spec = spec[:i]
+		}
+	}
+
+	target, ports, _ := strings.Cut(spec, ":")
+	r.Ports = ports
+	switch {
+	case target == "*":
+	case strings.Contains(target, "/"):
+		r.CIDR = target
+	case net.ParseIP(target) != nil:
+		r.CIDR = target + "/32"
+	default:
+		r.Domain = strings.TrimPrefix(target, "*.")
+	}
+
+	if err := r.Validate(); err != nil {
+		return r, fmt.Errorf("invalid egress rule %q: %w", s, err)
+	}
+	return r, nil
+}
+
+func (r EgressRule) Validate() error {
+	if r.Action != EgressAllow && r.Action != EgressDeny {
+		return fmt.Errorf("invalid egress action %q, must be %s or %s", r.Action, EgressAllow, EgressDeny)
+	}
+	if r.CIDR != "" && r.Domain != "" {
+		return fmt.Errorf("egress rule can not match both cidr %s and domain %s", r.CIDR, r.Domain)
+	}
+	if r.CIDR != "" {
+		ip, _, err := net.ParseCIDR(r.CIDR)
+		if err != nil || ip.To4() == nil {
+			return fmt.Errorf("invalid egress cidr %q, must be an ipv4 cidr", r.CIDR)
+		}
+	}
+	if r.Domain != "" && !validHostname.MatchString(strings.TrimSuffix(r.Domain, ".")) {
+		return fmt.Errorf("invalid egress domain %q", r.Domain)
+	}
+
+	switch r.Protocol {
+	case "", TCP, UDP, ICMP:
+	default:
+		return fmt.Errorf("invalid egress protocol %q, must be %s, %s or %s", r.Protocol, TCP, UDP, ICMP)
+	}
+	if r.Ports != "" {
+		if r.Protocol == ICMP {
+			return fmt.Errorf("egress ports do not apply to %s", ICMP)
+		}
+		if _, _, err := r.PortRange(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PortRange returns the first and last port of Ports, 0 and 65535 if Ports is
+// empty
+func (r EgressRule) PortRange() (uint16, uint16, error) {
+	if r.Ports == "" {
+		return 0, 65535, nil
+	}
+
+	first, last, isRange := strings.Cut(r.Ports, "-")
+	lo, err := parsePort(first)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid egress ports %q: %w", r.Ports, err)
+	}
+	hi := lo
+	if isRange {
+		if hi, err = parsePort(last); err != nil {
+			return 0, 0, fmt.Errorf("invalid egress ports %q: %w", r.Ports, err)
+		}
+	}
+	if hi < lo {
+		return 0, 0, fmt.Errorf("invalid egress ports %q, the range is empty", r.Ports)
+	}
+	return lo, hi, nil
+}
+
+func (r EgressRule) String() string {
+	target := "*"
+	if r.CIDR != "" {
+		target = r.CIDR
+	} else if r.Domain != "" {
+		target = r.Domain
+	}
+	s := r.Action + ":" + target
+	if r.Ports != "" {
+		s += ":" + r.Ports
+	}
+	if r.Protocol != "" {
+		s += "/" + r.Protocol
+	}
+	return s
+}
+
+// MatchDomain reports if name is the domain of the rule or a subdomain of it
+func (r EgressRule) MatchDomain(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	domain := strings.ToLower(strings.TrimSuffix(r.Domain, "."))
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
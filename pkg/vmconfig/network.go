@@ -0,0 +1,324 @@
+package vmconfig
+
+import (
+	"fmt"
+	"net"
+)
+
+// network modes
+const (
+	// NetGVproxy connects the guest to gvproxy, which runs in the revm process
+	NetGVproxy = "gvproxy"
+	// NetPasst connects the guest to a passt process spawned by revm
+	NetPasst = "passt"
+	// NetNone gives the guest no network access at all
+	NetNone = "none"
+)
+
+const (
+	DefaultSubnet     = "192.168.127.0/24"
+	DefaultGatewayMAC = "5a:94:ef:e4:0c:dd"
+	DefaultGuestMAC   = "5a:94:ef:e4:0c:ee"
+)
+
+// Network is the virtual network between the guest and gvproxy. The guest
+// leases GuestIP by the MAC address libkrun gives to its nic.
+type Network struct {
+	// Mode is one of NetGVproxy, NetPasst and NetNone
+	Mode   string `json:"mode,omitempty"`
+	Subnet string `json:"subnet,omitempty"`
+	// GatewayIP is the gvproxy gateway and dns server, the first address of
+	// the subnet by default
+	GatewayIP string `json:"gatewayIP,omitempty"`
+	// GuestIP is the second address of the subnet by default
+	GuestIP string `json:"guestIP,omitempty"`
+	// HostIP is the virtual address by which the guest reaches the host, the
+	// last address before the broadcast address by default
+	HostIP     string `json:"hostIP,omitempty"`
+	GatewayMAC string `json:"gatewayMAC,omitempty"`
+	GuestMAC   string `json:"guestMAC,omitempty"`
+	// Capture writes the guest traffic to a pcap file
+	Capture Capture `json:"capture,omitempty"`
+	// Hosts are written to /etc/hosts of the guest by the bootstrap
+	Hosts []HostEntry `json:"hosts,omitempty"`
+	// ImportHosts adds the entries of /etc/hosts of the host to Hosts when
+	// the vm boots, loopback and link-local entries are skipped
+	ImportHosts *bool `json:"importHosts,omitempty"`
+	// DNSZones are served by gvproxy and written to /etc/hosts of the guest
+	DNSZones []DNSZone `json:"dnsZones,omitempty"`
+	// DNS overrides the resolver the guest derives from the host, e.g. the
+	// guest queries DNS.Nameservers instead of the gateway
+	DNS Resolver `json:"dns,omitempty"`
+	// Egress restricts the traffic of the guest, enforced by gvproxy
+	Egress EgressPolicy `json:"egress,omitempty"`
+	// Log writes the connections and dns queries of the guest to json lines
+	// files
+	Log NetworkLog `json:"log,omitempty"`
+}
+
+// NetworkLog names the json lines files the virtual network logs to, a log
+// is off if its file is empty.
+type NetworkLog struct {
+	Connections string `json:"connections,omitempty"`
+	DNS         string `json:"dns,omitempty"`
+}
+
+// Enabled reports if any log is on
+func (l NetworkLog) Enabled() bool {
+	return l.Connections != "" || l.DNS != ""
+}
+
+// Capture writes the frames of the guest nic to a pcap file, the capture is
+// off if File is empty.
+type Capture struct {
+	File string `json:"file,omitempty"`
+	// MaxSizeMB rotates File once it grows beyond the size, 0 never rotates
+	MaxSizeMB int `json:"maxSizeMB,omitempty"`
+	// MaxFiles is how many rotated files File.1 ... File.N are kept, 1 by
+	// default
+	MaxFiles int `json:"maxFiles,omitempty"`
+}
+
+// Validate checks the rotation settings
+func (c Capture) Validate() error {
+	if c.MaxSizeMB < 0 || c.MaxFiles < 0 {
+		return fmt.Errorf("invalid capture rotation, max size %dMB and max files %d must not be negative", c.MaxSizeMB, c.MaxFiles)
+	}
+	return nil
+}
+
+// IsImportHosts reports whether the hosts of the host are imported
+func (n Network) IsImportHosts() bool {
+	return n.ImportHosts != nil && *n.ImportHosts
+}
+
+// Merge overlays the non-empty values of other on top of n
+func (n *Network) Merge(other Network) {
+	if other.Subnet != "" && other.Subnet != n.Subnet {
+		// the addresses derived from the old subnet do not apply anymore
+		*n = Network{
+			Mode:        n.Mode,
+			Subnet:      other.Subnet,
+			GatewayMAC:  n.GatewayMAC,
+			GuestMAC:    n.GuestMAC,
+			Capture:     n.Capture,
+			Hosts:       n.Hosts,
+			ImportHosts: n.ImportHosts,
+			DNSZones:    n.DNSZones,
+			DNS:         n.DNS,
+			Egress:      n.Egress,
+			Log:         n.Log,
+		}
+	}
+	if other.Mode != "" {
+		n.Mode = other.Mode
+	}
+	if other.GatewayIP != "" {
+		n.GatewayIP = other.GatewayIP
+	}
+	if other.GuestIP != "" {
+		n.GuestIP = other.GuestIP
+	}
+	if other.HostIP != "" {
+		n.HostIP = other.HostIP
+	}
+	if other.GatewayMAC != "" {
+		n.GatewayMAC = other.GatewayMAC
+	}
+	if other.GuestMAC != "" {
+		n.GuestMAC = other.GuestMAC
+	}
+	if other.Capture.File != "" {
+		n.Capture.File = other.Capture.File
+	}
+	if other.Capture.MaxSizeMB != 0 {
+		n.Capture.MaxSizeMB = other.Capture.MaxSizeMB
+	}
+	if other.Capture.MaxFiles != 0 {
+		n.Capture.MaxFiles = other.Capture.MaxFiles
+	}
+	if other.Log.Connections != "" {
+		n.Log.Connections = other.Log.Connections
+	}
+	if other.Log.DNS != "" {
+		n.Log.DNS = other.Log.DNS
+	}
+	if other.ImportHosts != nil {
+		n.ImportHosts = other.ImportHosts
+	}
+	n.Hosts = MergeHosts(n.Hosts, other.Hosts)
+	n.DNSZones = MergeDNSZones(n.DNSZones, other.DNSZones)
+	n.DNS.Merge(other.DNS)
+	if other.Egress.Default != "" {
+		n.Egress.Default = other.Egress.Default
+	}
+	// the first matching rule decides, the rules of other go first to win
+	n.Egress.Rules = append(append([]EgressRule{}, other.Egress.Rules...), n.Egress.Rules...)
+}
+
+// SetDefaults fills the empty values, the addresses are derived from the
+// subnet
+func (n *Network) SetDefaults() error {
+	if n.Mode == "" {
+		n.Mode = NetGVproxy
+	}
+	if n.Subnet == "" {
+		n.Subnet = DefaultSubnet
+	}
+	if n.GatewayMAC == "" {
+		n.GatewayMAC = DefaultGatewayMAC
+	}
+	if n.GuestMAC == "" {
+		n.GuestMAC = DefaultGuestMAC
+	}
+
+	_, subnet, err := parseSubnet(n.Subnet)
+	if err != nil {
+		return err
+	}
+	if n.GatewayIP == "" {
+		n.GatewayIP = nthIP(subnet, 1).String()
+	}
+	if n.GuestIP == "" {
+		n.GuestIP = nthIP(subnet, 2).String()
+	}
+	if n.HostIP == "" {
+		n.HostIP = nthIP(subnet, -2).String()
+	}
+	return nil
+}
+
+// Validate checks the addresses are distinct usable addresses of the subnet
+// and the MAC addresses are distinct unicast addresses
+func (n Network) Validate() error {
+	switch n.Mode {
+	case NetGVproxy, NetPasst, NetNone:
+	default:
+		return fmt.Errorf("invalid network mode %q, must be one of %s, %s and %s", n.Mode, NetGVproxy, NetPasst, NetNone)
+	}
+
+	if err := n.Capture.Validate(); err != nil {
+		return err
+	}
+	if n.Capture.File != "" && n.Mode == NetNone {
+		return fmt.Errorf("there is no traffic to capture in network mode %s", NetNone)
+	}
+	for _, h := range n.Hosts {
+		if err := h.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, z := range n.DNSZones {
+		if err := z.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := n.DNS.Validate(); err != nil {
+		return err
+	}
+	if len(n.DNS.Nameservers) > 0 && n.Mode == NetNone {
+		return fmt.Errorf("there is no nameserver to reach in network mode %s", NetNone)
+	}
+	if err := n.Egress.Validate(); err != nil {
+		return err
+	}
+	// the domain rules only see the answers of the gateway dns server, a
+	// guest asking other nameservers would bypass them
+	if n.Egress.HasDomainRules() && len(n.DNS.Nameservers) > 0 {
+		return fmt.Errorf("egress domain rules need the gateway as the nameserver of the guest, they can not be combined with the nameservers %v", n.DNS.Nameservers)
+	}
+	if n.Egress.Enabled() && n.Mode != NetGVproxy {
+		return fmt.Errorf("the egress policy is enforced by gvproxy, it is not supported in network mode %s", n.Mode)
+	}
+	if n.Log.Enabled() && n.Mode != NetGVproxy {
+		return fmt.Errorf("the network log is written by gvproxy, it is not supported in network mode %s", n.Mode)
+	}
+	if len(n.DNSZones) > 0 && n.Mode != NetGVproxy {
+		return fmt.Errorf("dns zones are served by gvproxy, they are not supported in network mode %s", n.Mode)
+	}
+
+	// passt writes the capture itself and does not rotate
+	if n.Capture.MaxSizeMB > 0 && n.Mode == NetPasst {
+		return fmt.Errorf("capture rotation is not supported in network mode %s", NetPasst)
+	}
+
+	_, subnet, err := parseSubnet(n.Subnet)
+	if err != nil {
+		return err
+	}
+
+	network, broadcast := nthIP(subnet, 0), nthIP(subnet, -1)
+	seen := map[string]string{}
+	for _, addr := range []struct{ name, ip string }{
+		{"gateway ip", n.GatewayIP},
+		{"guest ip", n.GuestIP},
+		{"host ip", n.HostIP},
+	} {
+		ip := net.ParseIP(addr.ip).To4()
+		if ip == nil {
+			return fmt.Errorf("invalid %s %q, must be an ipv4 address", addr.name, addr.ip)
+		}
+		if !subnet.Contains(ip) || ip.Equal(network) || ip.Equal(broadcast) {
+			return fmt.Errorf("%s %s is not a usable address of subnet %s", addr.name, ip, subnet)
+		}
+		if other, ok := seen[ip.String()]; ok {
+			return fmt.Errorf("%s and %s are both %s", other, addr.name, ip)
+		}
+		seen[ip.String()] = addr.name
+	}
+
+	gatewayMAC, err := parseMAC("gateway mac", n.GatewayMAC)
+	if err != nil {
+		return err
+	}
+	guestMAC, err := parseMAC("guest mac", n.GuestMAC)
+	if err != nil {
+		return err
+	}
+	if gatewayMAC.String() == guestMAC.String() {
+		return fmt.Errorf("gateway mac and guest mac are both %s", guestMAC)
+	}
+
+	return nil
+}
+
+func parseSubnet(s string) (net.IP, *net.IPNet, error) {
+	ip, subnet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid subnet %q: %w", s, err)
+	}
+	if ip.To4() == nil {
+		return nil, nil, fmt.Errorf("invalid subnet %q, must be an ipv4 subnet", s)
+	}
+	// gateway, guest and host, plus the network and broadcast address
+	if ones, _ := subnet.Mask.Size(); ones > 29 {
+		return nil, nil, fmt.Errorf("subnet %q is too small, the prefix length must be at most 29", s)
+	}
+	return ip, subnet, nil
+}
+
+// nthIP returns the nth address of subnet, a negative n counts back from the
+// broadcast address, e.g. -1 is the broadcast address
+func nthIP(subnet *net.IPNet, n int) net.IP {
+	base := subnet.IP.To4()
+	mask := subnet.Mask
+	v := uint32(base[0])<<24 | uint32(base[1])<<16 | uint32(base[2])<<8 | uint32(base[3])
+	if n < 0 {
+		hostBits := ^(uint32(mask[0])<<24 | uint32(mask[1])<<16 | uint32(mask[2])<<8 | uint32(mask[3]))
+		v |= hostBits
+		n++
+	}
+	v += uint32(n)
+	return net.IPv4(byte(v>>24), byte(v>>16), byte(v>>8), byte(v)).To4()
+}
+
+func parseMAC(name, s string) (net.HardwareAddr, error) {
+	mac, err := net.ParseMAC(s)
+	if err != nil || len(mac) != 6 {
+		return nil, fmt.Errorf("invalid %s %q, must be a 48-bit mac address", name, s)
+	}
+	if mac[0]&1 != 0 {
+		return nil, fmt.Errorf("invalid %s %q, must be a unicast address", name, s)
+	}
+	return mac, nil
+}
@@ -0,0 +1,122 @@
+package vmconfig
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	TCP = "tcp"
+	UDP = "udp"
+
+	// DefaultHostIP is the host address published ports bind to by default,
+	// so they are not reachable from other machines
+	DefaultHostIP = "127.0.0.1"
+)
+
+// PortMapping publishes a guest port on the host.
+type PortMapping struct {
+	HostIP    string `json:"hostIP,omitempty"`
+	HostPort  uint16 `json:"hostPort"`
+	GuestPort uint16 `json:"guestPort"`
+	Protocol  string `json:"protocol,omitempty"`
+}
+
+// ParsePortMapping parses [hostIP:]hostPort:guestPort[/tcp|/udp], the host ip
+// defaults to DefaultHostIP and the protocol to tcp.
+func ParsePortMapping(s string) (PortMapping, error) {
+	spec, proto, _ := strings.Cut(s, "/")
+
+	i := strings.LastIndex(spec, ":")
+	if i < 0 {
+		return PortMapping{}, fmt.Errorf("invalid port mapping %q, want [hostIP:]hostPort:guestPort[/udp]", s)
+	}
+
+	p, err := parseHostPort(spec[:i], proto)
+	if err != nil {
+		return p, fmt.Errorf("invalid port mapping %q: %w", s, err)
+	}
+	if p.GuestPort, err = parsePort(spec[i+1:]); err != nil {
+		return p, fmt.Errorf("invalid guest port in %q: %w", s, err)
+	}
+
+	return p, p.Validate()
+}
+
+// ParseHostPort parses the host side [hostIP:]hostPort[/tcp|/udp] of a port
+// mapping, the guest port of the result is left unset.
+func ParseHostPort(s string) (PortMapping, error) {
+	spec, proto, _ := strings.Cut(s, "/")
+	p, err := parseHostPort(spec, proto)
+	if err != nil {
+		return p, fmt.Errorf("invalid host port %q: %w", s, err)
+	}
+	if net.ParseIP(p.HostIP) == nil {
+		return p, fmt.Errorf("invalid host ip %q", p.HostIP)
+	}
+	return p, nil
+}
+
+// parseHostPort parses [hostIP:]hostPort, an ipv6 host ip is given in
+// brackets, e.g. [::1]:8080
+func parseHostPort(s, proto string) (PortMapping, error) {
+	p := PortMapping{HostIP: DefaultHostIP, Protocol: TCP}
+	if proto != "" {
+		p.Protocol = proto
+	}
+	if p.Protocol != TCP && p.Protocol != UDP {
+		return p, fmt.Errorf("invalid protocol %q, must be tcp or udp", p.Protocol)
+	}
+
+	if j := strings.LastIndex(s, ":"); j >= 0 {
+		host := s[:j]
+		bracketed := strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]")
+		switch {
+		case bracketed:
+			host = host[1 : len(host)-1]
+		case strings.ContainsAny(host, "[]:"):
+			return p, fmt.Errorf("invalid host ip %q, an ipv6 address is given in brackets, e.g. [::1]:8080", host)
+		}
+		p.HostIP = host
+		s = s[j+1:]
+	}
+
+	var err error
+	p.HostPort, err = parsePort(s)
+	return p, err
+}
+
+func parsePort(s string) (uint16, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, err
+	}
+	if port == 0 {
+		return 0, fmt.Errorf("port 0 is not allowed")
+	}
+	return uint16(port), nil
+}
+
+func (p PortMapping) Validate() error {
+	if p.Protocol != TCP && p.Protocol != UDP {
+		return fmt.Errorf("invalid protocol %q of port mapping, must be tcp or udp", p.Protocol)
+	}
+	if net.ParseIP(p.HostIP) == nil {
+		return fmt.Errorf("invalid host ip %q of port mapping", p.HostIP)
+	}
+	if p.HostPort == 0 || p.GuestPort == 0 {
+		return fmt.Errorf("host port and guest port of port mapping are required")
+	}
+	return nil
+}
+
+// HostAddr is the host address to listen on, e.g. 127.0.0.1:8080
+func (p PortMapping) HostAddr() string {
+	return net.JoinHostPort(p.HostIP, strconv.Itoa(int(p.HostPort)))
+}
+
+func (p PortMapping) String() string {
+	return fmt.Sprintf("%s->%d/%s", p.HostAddr(), p.GuestPort, p.Protocol)
+}
@@ -0,0 +1,98 @@
+package vmconfig
+
+import (
+	"testing"
+)
+
+func TestParsePortMapping(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    PortMapping
+		wantErr bool
+	}{
+		{in: "8080:80", want: PortMapping{HostIP: DefaultHostIP, HostPort: 8080, GuestPort: 80, Protocol: TCP}},
+		{in: "8080:80/tcp", want: PortMapping{HostIP: DefaultHostIP, HostPort: 8080, GuestPort: 80, Protocol: TCP}},
+		{in: "5353:53/udp", want: PortMapping{HostIP: DefaultHostIP, HostPort: 5353, GuestPort: 53, Protocol: UDP}},
+		{in: "0.0.0.0:8080:80", want: PortMapping{HostIP: "0.0.0.0", HostPort: 8080, GuestPort: 80, Protocol: TCP}},
+		{in: "[::1]:8080:80", want: PortMapping{HostIP: "::1", HostPort: 8080, GuestPort: 80, Protocol: TCP}},
+		{in: "[::]:5353:53/udp", want: PortMapping{HostIP: "::", HostPort: 5353, GuestPort: 53, Protocol: UDP}},
+		{in: "[fe80::1]:22:22", want: PortMapping{HostIP: "fe80::1", HostPort: 22, GuestPort: 22, Protocol: TCP}},
+		{in: "80", wantErr: true},
+		{in: "8080:80/sctp", wantErr: true},
+		{in: "0:80", wantErr: true},
+		{in: "8080:0", wantErr: true},
+		{in: "65536:80", wantErr: true},
+		{in: "8080:http", wantErr: true},
+		{in: "localhost:8080:80", wantErr: true},
+		{in: "[::1:8080:80", wantErr: true},
+		{in: "::1:8080:80", wantErr: true},
+		{in: "1.2.3:8080:80", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParsePortMapping(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParsePortMapping(%q) = %v, want error", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParsePortMapping(%q) error = %v", tt.in, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParsePortMapping(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPortMappingHostAddr(t *testing.T) {
+	tests := []struct {
+		p    PortMapping
+		want string
+	}{
+		{p: PortMapping{HostIP: "127.0.0.1", HostPort: 8080}, want: "127.0.0.1:8080"},
+		{p: PortMapping{HostIP: "::1", HostPort: 8080}, want: "[::1]:8080"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.p.HostAddr(); got != tt.want {
+			t.Errorf("HostAddr() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestParseHostPort(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    PortMapping
+		wantErr bool
+	}{
+		{in: "8080", want: PortMapping{HostIP: DefaultHostIP, HostPort: 8080, Protocol: TCP}},
+		{in: "0.0.0.0:53/udp", want: PortMapping{HostIP: "0.0.0.0", HostPort: 53, Protocol: UDP}},
+		{in: "[::1]:8080", want: PortMapping{HostIP: "::1", HostPort: 8080, Protocol: TCP}},
+		{in: "::1:8080", wantErr: true},
+		{in: "host:8080", wantErr: true},
+		{in: "8080/icmp", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseHostPort(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseHostPort(%q) = %v, want error", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseHostPort(%q) error = %v", tt.in, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseHostPort(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package vmconfig
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// SocketForward makes the host socket available at the guest path
+	SocketForward = "forward"
+	// SocketPublish makes the guest socket available at the host path
+	SocketPublish = "publish"
+
+	// maxSocketPath is the size of sun_path on darwin minus the nul, linux
+	// allows 107 bytes
+	maxSocketPath = 103
+)
+
+// SocketMapping connects a unix socket of the host with a path in the guest,
+// the connections are proxied over vsock by libkrun and the bootstrap.
+type SocketMapping struct {
+	HostPath  string `json:"hostPath"`
+	GuestPath string `json:"guestPath"`
+	// Direction is SocketForward or SocketPublish, SocketForward by default
+	Direction string `json:"direction,omitempty"`
+	// VsockPort carries the connections, assigned by Spec.VMConfig
+	VsockPort uint32 `json:"vsockPort,omitempty"`
+}
+
+// ParseSocketMapping parses hostPath:guestPath, both paths must be absolute
+func ParseSocketMapping(s, direction string) (SocketMapping, error) {
+	i := strings.LastIndex(s, ":/")
+	if i < 0 {
+		return SocketMapping{}, fmt.Errorf("invalid socket mapping %q, want /host/path.sock:/guest/path.sock", s)
+	}
+
+	m := SocketMapping{HostPath: s[:i], GuestPath: s[i+1:], Direction: direction}
+	if err := m.Validate(); err != nil {
+		return m, fmt.Errorf("invalid socket mapping %q: %w", s, err)
+	}
+	return m, nil
+}
+
+func (m SocketMapping) Validate() error {
+	if m.Direction != SocketForward && m.Direction != SocketPublish {
+		return fmt.Errorf("invalid socket direction %q, must be %s or %s", m.Direction, SocketForward, SocketPublish)
+	}
+	for _, path := range []string{m.HostPath, m.GuestPath} {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("socket path %q must be absolute", path)
+		}
+		if len(path) > maxSocketPath {
+			return fmt.Errorf("socket path %q is longer than %d bytes", path, maxSocketPath)
+		}
+	}
+	return nil
+}
+
+// Target is the path the socket is made available at, the guest path of a
+// forwarded socket and the host path of a published one
+func (m SocketMapping) Target() string {
+	if m.Direction == SocketPublish {
+		return m.HostPath
+	}
+	return m.GuestPath
+}
+
+func (m SocketMapping) String() string {
+	if m.Direction == SocketPublish {
+		return fmt.Sprintf("guest %s -> host %s", m.GuestPath, m.HostPath)
+	}
+	return fmt.Sprintf("host %s -> guest %s", m.HostPath, m.GuestPath)
+}
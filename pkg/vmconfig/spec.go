@@ -0,0 +1,354 @@
+package vmconfig
+
+import (
+	"fmt"
+	"linuxvm/pkg/define"
+	"linuxvm/pkg/filesystem"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// SpecVersion is the only spec apiVersion understood by this revm.
+const SpecVersion = "v1"
+
+// DefaultInit is the command of Spec.Init if none is given
+const DefaultInit = "/sbin/init"
+
+// Spec is the declarative VM definition loaded from a YAML or JSON file with
+// --config. Relative host paths are resolved against the spec file dir.
+type Spec struct {
+	APIVersion string      `json:"apiVersion"`
+	RootFS     string      `json:"rootfs,omitempty"`
+	Cpus       int8        `json:"cpus,omitempty"`
+	Memory     int32       `json:"memory,omitempty"`
+	LogLevel   string      `json:"logLevel,omitempty"`
+	Envs       []string    `json:"envs,omitempty"`
+	DataDisks  []string    `json:"dataDisks,omitempty"`
+	Mounts     []MountSpec `json:"mounts,omitempty"`
+	// Ports are published from the guest to the host
+	Ports []PortMapping `json:"ports,omitempty"`
+	// Network is the virtual network, the addresses are derived from the
+	// subnet unless given
+	Network Network `json:"network,omitempty"`
+	// Sockets are unix sockets forwarded into or published from the guest
+	Sockets []SocketMapping `json:"sockets,omitempty"`
+	// SSH gives access to the running vm by revm ssh
+	SSH SSH `json:"ssh,omitempty"`
+	// BaseMounts adds optional pseudo filesystems or skips default ones
+	BaseMounts BaseMounts `json:"baseMounts,omitempty"`
+	// BootStages override the policy of the boot stages of the bootstrap
+	BootStages []BootStage `json:"bootStages,omitempty"`
+	// Init execs the command as the init of the guest once the bootstrap set
+	// it up, DefaultInit if no command is given. A pointer so a later layer
+	// can turn it off.
+	Init *bool `json:"init,omitempty"`
+	// Command is the cmdline to run within the rootfs
+	Command []string `json:"command,omitempty"`
+	// Workdir, User and Group of the command
+	Workdir string `json:"workdir,omitempty"`
+	User    string `json:"user,omitempty"`
+	Group   string `json:"group,omitempty"`
+}
+
+type MountSpec struct {
+	Source   string `json:"source"`
+	Target   string `json:"target"`
+	ReadOnly bool   `json:"readOnly,omitempty"`
+}
+
+// DefaultSpec returns the values used when neither the spec file nor the
+// flags set them.
+func DefaultSpec() *Spec {
+	return &Spec{
+		APIVersion: SpecVersion,
+		Workdir:    "/",
+		Cpus:       1,
+		Memory:     512,
+	}
+}
+
+// LoadSpec reads a spec file, unknown fields are rejected.
+func LoadSpec(file string) (*Spec, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spec file: %w", err)
+	}
+
+	spec := &Spec{}
+	if err = yaml.UnmarshalStrict(b, spec); err != nil {
+		return nil, fmt.Errorf("failed to parse spec file %q: %w", file, err)
+	}
+
+	if spec.APIVersion != SpecVersion {
+		return nil, fmt.Errorf("unsupported apiVersion %q in %q, want %q", spec.APIVersion, file, SpecVersion)
+	}
+
+	dir, err := filepath.Abs(filepath.Dir(file))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path: %w", err)
+	}
+	spec.ResolvePaths(dir)
+
+	for i := range spec.Sockets {
+		if spec.Sockets[i].Direction == "" {
+			spec.Sockets[i].Direction = SocketForward
+		}
+	}
+	for i := range spec.Ports {
+		if spec.Ports[i].HostIP == "" {
+			spec.Ports[i].HostIP = DefaultHostIP
+		}
+		if spec.Ports[i].Protocol == "" {
+			spec.Ports[i].Protocol = TCP
+		}
+	}
+
+	return spec, nil
+}
+
+// ResolvePaths makes the relative host paths of s absolute against dir, the
+// spec is kept by create and may be started from any dir
+func (s *Spec) ResolvePaths(dir string) {
+	s.RootFS = resolvePath(dir, s.RootFS)
+	for i := range s.DataDisks {
+		s.DataDisks[i] = resolvePath(dir, s.DataDisks[i])
+	}
+	for i := range s.Mounts {
+		s.Mounts[i].Source = resolvePath(dir, s.Mounts[i].Source)
+	}
+	s.Network.Capture.File = resolvePath(dir, s.Network.Capture.File)
+	s.Network.Log.Connections = resolvePath(dir, s.Network.Log.Connections)
+	s.Network.Log.DNS = resolvePath(dir, s.Network.Log.DNS)
+	for i := range s.Sockets {
+		s.Sockets[i].HostPath = resolvePath(dir, s.Sockets[i].HostPath)
+	}
+}
+
+func resolvePath(dir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// Merge overlays the non-empty values of other on top of s. Envs are merged
+// by key, mounts are merged by target, ports are merged by host address,
+// network values are replaced one by one, hosts and dns zones are merged by
+// name and data disks are appended.
+func (s *Spec) Merge(other *Spec) {
+	if other.RootFS != "" {
+		s.RootFS = other.RootFS
+	}
+	if other.Cpus != 0 {
+		s.Cpus = other.Cpus
+	}
+	if other.Memory != 0 {
+		s.Memory = other.Memory
+	}
+	if other.LogLevel != "" {
+		s.LogLevel = other.LogLevel
+	}
+	if len(other.Command) != 0 {
+		s.Command = other.Command
+	}
+	if other.Init != nil {
+		s.Init = other.Init
+	}
+	if other.Workdir != "" {
+		s.Workdir = other.Workdir
+	}
+	if other.User != "" {
+		s.User = other.User
+	}
+	if other.Group != "" {
+		s.Group = other.Group
+	}
+
+	s.Envs = MergeEnvs(s.Envs, other.Envs)
+
+	for _, disk := range other.DataDisks {
+		if !slices.Contains(s.DataDisks, disk) {
+			s.DataDisks = append(s.DataDisks, disk)
+		}
+	}
+
+	for _, mnt := range other.Mounts {
+		replaced := false
+		for i := range s.Mounts {
+			if s.Mounts[i].Target == mnt.Target {
+				s.Mounts[i] = mnt
+				replaced = true
+			}
+		}
+		if !replaced {
+			s.Mounts = append(s.Mounts, mnt)
+		}
+	}
+
+	for _, port := range other.Ports {
+		replaced := false
+		for i := range s.Ports {
+			if s.Ports[i].Protocol == port.Protocol && s.Ports[i].HostAddr() == port.HostAddr() {
+				s.Ports[i] = port
+				replaced = true
+			}
+		}
+		if !replaced {
+			s.Ports = append(s.Ports, port)
+		}
+	}
+
+	for _, sock := range other.Sockets {
+		replaced := false
+		for i := range s.Sockets {
+			if s.Sockets[i].Direction == sock.Direction && s.Sockets[i].Target() == sock.Target() {
+				s.Sockets[i] = sock
+				replaced = true
+			}
+		}
+		if !replaced {
+			s.Sockets = append(s.Sockets, sock)
+		}
+	}
+
+	s.Network.Merge(other.Network)
+	s.SSH.Merge(other.SSH)
+	s.BaseMounts.Merge(other.BaseMounts)
+	s.BootStages = MergeBootStages(s.BootStages, other.BootStages)
+}
+
+// IsInit reports whether the command runs as the init of the guest
+func (s *Spec) IsInit() bool {
+	return s.Init != nil && *s.Init
+}
+
+func (s *Spec) Validate() error {
+	if s.RootFS == "" {
+		return fmt.Errorf("rootfs is required")
+	}
+	if s.Cpus < 1 {
+		return fmt.Errorf("cpus must be at least 1, got %d", s.Cpus)
+	}
+	if s.Memory < 1 {
+		return fmt.Errorf("memory must be at least 1MB, got %d", s.Memory)
+	}
+	for _, env := range s.Envs {
+		if !strings.Contains(env, "=") {
+			return fmt.Errorf("invalid env %q, must be KEY=VALUE", env)
+		}
+	}
+	for _, mnt := range s.Mounts {
+		if mnt.Source == "" || mnt.Target == "" {
+			return fmt.Errorf("invalid mount %+v, source and target are required", mnt)
+		}
+		if !filepath.IsAbs(mnt.Target) {
+			return fmt.Errorf("invalid mount %+v, target must be an absolute path", mnt)
+		}
+	}
+	for _, port := range s.Ports {
+		if err := port.Validate(); err != nil {
+			return err
+		}
+	}
+	targets := map[string]bool{}
+	for _, sock := range s.Sockets {
+		if err := sock.Validate(); err != nil {
+			return err
+		}
+		key := sock.Direction + ":" + sock.Target()
+		if targets[key] {
+			return fmt.Errorf("socket %s is given twice", sock.Target())
+		}
+		targets[key] = true
+	}
+	network := s.Network
+	if err := network.SetDefaults(); err != nil {
+		return err
+	}
+	if err := network.Validate(); err != nil {
+		return err
+	}
+	if network.Mode == NetNone && len(s.Ports) > 0 {
+		return fmt.Errorf("ports can not be published with network mode %s", NetNone)
+	}
+	if err := s.SSH.Validate(); err != nil {
+		return err
+	}
+	if network.Mode == NetNone && s.SSH.Enabled() {
+		return fmt.Errorf("ssh needs the network, it is not supported in network mode %s", NetNone)
+	}
+	if err := s.BaseMounts.Validate(); err != nil {
+		return err
+	}
+	for _, stage := range s.BootStages {
+		if err := stage.Validate(); err != nil {
+			return err
+		}
+	}
+	if !filepath.IsAbs(s.Workdir) {
+		return fmt.Errorf("workdir must be an absolute path, got %q", s.Workdir)
+	}
+	if len(s.Command) == 0 || s.Command[0] == "" {
+		return fmt.Errorf("no cmdline provided, e.g. -- /bin/sh")
+	}
+	if s.IsInit() && (s.User != "" || s.Group != "") {
+		return fmt.Errorf("the init runs as root, user and group can not be set")
+	}
+	return nil
+}
+
+// VMConfig converts the spec into the static VM configuration, endpoints are
+// left empty for the caller to fill. The spec must be valid.
+func (s *Spec) VMConfig() VMConfig {
+	network := s.Network
+	_ = network.SetDefaults()
+
+	mounts := make([]filesystem.Mount, 0, len(s.Mounts))
+	for _, mnt := range s.Mounts {
+		mounts = append(mounts, filesystem.NewVirtIoFsMount(mnt.Source, mnt.Target, mnt.ReadOnly).ToMount())
+	}
+
+	// every socket gets its own vsock port
+	sockets := make([]SocketMapping, 0, len(s.Sockets))
+	for i, sock := range s.Sockets {
+		sock.VsockPort = define.SocketVsockPortBase + uint32(i)
+		sockets = append(sockets, sock)
+	}
+
+	return VMConfig{
+		MemoryInMB: s.Memory,
+		Cpus:       s.Cpus,
+		RootFS:     s.RootFS,
+		DataDisk:   s.DataDisks,
+		LogLevel:   s.LogLevel,
+		Mounts:     mounts,
+		Ports:      s.Ports,
+		Network:    network,
+		Sockets:    sockets,
+		SSH:        s.SSH,
+		BaseMounts: s.BaseMounts,
+		BootStages: s.BootStages,
+		Init:       s.IsInit(),
+	}
+}
+
+// MergeEnvs returns base with the KEY=VALUE pairs of override applied, a key
+// in override replaces the same key in base.
+func MergeEnvs(base, override []string) []string {
+	merged := make([]string, 0, len(base)+len(override))
+	index := make(map[string]int)
+	for _, env := range append(append([]string{}, base...), override...) {
+		key, _, _ := strings.Cut(env, "=")
+		if i, find := index[key]; find {
+			merged[i] = env
+			continue
+		}
+		index[key] = len(merged)
+		merged = append(merged, env)
+	}
+	return merged
+}
@@ -0,0 +1,203 @@
+package vmconfig
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+// specJSON compares specs by their json, an empty slice is the same as none
+func specJSON(t *testing.T, s *Spec) string {
+	t.Helper()
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestSpecMerge(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     Spec
+		override Spec
+		want     Spec
+	}{
+		{
+			name:     "scalars of the override win",
+			base:     Spec{RootFS: "/a", Cpus: 1, Memory: 512, Workdir: "/"},
+			override: Spec{RootFS: "/b", Memory: 1024},
+			want:     Spec{RootFS: "/b", Cpus: 1, Memory: 1024, Workdir: "/"},
+		},
+		{
+			name:     "empty override keeps the base",
+			base:     Spec{RootFS: "/a", User: "dev", Init: boolPtr(true)},
+			override: Spec{},
+			want:     Spec{RootFS: "/a", User: "dev", Init: boolPtr(true)},
+		},
+		{
+			name:     "init turned off",
+			base:     Spec{Init: boolPtr(true)},
+			override: Spec{Init: boolPtr(false)},
+			want:     Spec{Init: boolPtr(false)},
+		},
+		{
+			name:     "import hosts turned off",
+			base:     Spec{Network: Network{ImportHosts: boolPtr(true)}},
+			override: Spec{Network: Network{ImportHosts: boolPtr(false)}},
+			want:     Spec{Network: Network{ImportHosts: boolPtr(false)}},
+		},
+		{
+			name:     "envs merged by key",
+			base:     Spec{Envs: []string{"A=1", "B=2"}},
+			override: Spec{Envs: []string{"B=3", "C=4"}},
+			want:     Spec{Envs: []string{"A=1", "B=3", "C=4"}},
+		},
+		{
+			name:     "data disks appended once",
+			base:     Spec{DataDisks: []string{"/a.img"}},
+			override: Spec{DataDisks: []string{"/a.img", "/b.img"}},
+			want:     Spec{DataDisks: []string{"/a.img", "/b.img"}},
+		},
+		{
+			name: "mounts merged by target",
+			base: Spec{Mounts: []MountSpec{
+				{Source: "/a", Target: "/mnt/a"},
+				{Source: "/b", Target: "/mnt/b"},
+			}},
+			override: Spec{Mounts: []MountSpec{
+				{Source: "/c", Target: "/mnt/b", ReadOnly: true},
+				{Source: "/d", Target: "/mnt/d"},
+			}},
+			want: Spec{Mounts: []MountSpec{
+				{Source: "/a", Target: "/mnt/a"},
+				{Source: "/c", Target: "/mnt/b", ReadOnly: true},
+				{Source: "/d", Target: "/mnt/d"},
+			}},
+		},
+		{
+			name: "ports merged by host address",
+			base: Spec{Ports: []PortMapping{
+				{HostIP: DefaultHostIP, HostPort: 8080, GuestPort: 80, Protocol: TCP},
+			}},
+			override: Spec{Ports: []PortMapping{
+				{HostIP: DefaultHostIP, HostPort: 8080, GuestPort: 8000, Protocol: TCP},
+				{HostIP: DefaultHostIP, HostPort: 8080, GuestPort: 53, Protocol: "udp"},
+			}},
+			want: Spec{Ports: []PortMapping{
+				{HostIP: DefaultHostIP, HostPort: 8080, GuestPort: 8000, Protocol: TCP},
+				{HostIP: DefaultHostIP, HostPort: 8080, GuestPort: 53, Protocol: "udp"},
+			}},
+		},
+		{
+			name:     "command replaced",
+			base:     Spec{Command: []string{"/bin/sh", "-c", "true"}},
+			override: Spec{Command: []string{"/bin/ls"}},
+			want:     Spec{Command: []string{"/bin/ls"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.base
+			got.Merge(&tt.override)
+			if g, w := specJSON(t, &got), specJSON(t, &tt.want); g != w {
+				t.Errorf("Merge() = %s, want %s", g, w)
+			}
+		})
+	}
+}
+
+func TestLoadSpec(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    func(dir string) *Spec
+		wantErr string
+	}{
+		{
+			name: "relative paths resolved against the spec dir",
+			content: `apiVersion: v1
+rootfs: ./rootfs
+dataDisks: [data.img, /abs.img]
+mounts:
+- source: src
+  target: /src
+network:
+  capture:
+    file: cap.pcap
+sockets:
+- hostPath: agent.sock
+  guestPath: /run/agent.sock
+`,
+			want: func(dir string) *Spec {
+				return &Spec{
+					APIVersion: SpecVersion,
+					RootFS:     filepath.Join(dir, "rootfs"),
+					DataDisks:  []string{filepath.Join(dir, "data.img"), "/abs.img"},
+					Mounts:     []MountSpec{{Source: filepath.Join(dir, "src"), Target: "/src"}},
+					Network:    Network{Capture: Capture{File: filepath.Join(dir, "cap.pcap")}},
+					Sockets: []SocketMapping{{
+						HostPath:  filepath.Join(dir, "agent.sock"),
+						GuestPath: "/run/agent.sock",
+						Direction: SocketForward,
+					}},
+				}
+			},
+		},
+		{
+			name: "port defaults",
+			content: `apiVersion: v1
+ports:
+- hostPort: 8080
+  guestPort: 80
+`,
+			want: func(string) *Spec {
+				return &Spec{
+					APIVersion: SpecVersion,
+					Ports:      []PortMapping{{HostIP: DefaultHostIP, HostPort: 8080, GuestPort: 80, Protocol: TCP}},
+				}
+			},
+		},
+		{
+			name:    "unknown field",
+			content: "apiVersion: v1\nrootfss: /a\n",
+			wantErr: "unknown field",
+		},
+		{
+			name:    "unsupported version",
+			content: "apiVersion: v2\nrootfs: /a\n",
+			wantErr: "unsupported apiVersion",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			file := filepath.Join(dir, "spec.yaml")
+			if err := os.WriteFile(file, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := LoadSpec(file)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("LoadSpec() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadSpec() error = %v", err)
+			}
+			if g, w := specJSON(t, got), specJSON(t, tt.want(dir)); g != w {
+				t.Errorf("LoadSpec() = %s, want %s", g, w)
+			}
+		})
+	}
+}
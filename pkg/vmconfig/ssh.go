@@ -0,0 +1,55 @@
+package vmconfig
+
+import "fmt"
+
+const (
+	// SSHKeys only authorizes the key of the vm, the rootfs starts its own
+	// ssh server, e.g. by its init
+	SSHKeys = "keys"
+	// SSHRootFS starts the sshd of the rootfs
+	SSHRootFS = "rootfs"
+	// SSHBuiltin starts the ssh server of the bootstrap, the rootfs needs no
+	// sshd
+	SSHBuiltin = "builtin"
+)
+
+// SSH gives access to the running vm by revm ssh. revm generates a keypair
+// per vm and the bootstrap adds its public key to the authorized_keys of
+// User. The guest ssh port is published on 127.0.0.1.
+type SSH struct {
+	// Mode is SSHKeys, SSHRootFS or SSHBuiltin, empty disables ssh
+	Mode string `json:"mode,omitempty"`
+	// User logs in, the user of the cmdline by default
+	User string `json:"user,omitempty"`
+	// HostPort is published to the guest ssh port, a free port by default
+	HostPort uint16 `json:"hostPort,omitempty"`
+	// AuthorizedKey is the public key of the vm, set when the vm boots
+	AuthorizedKey string `json:"authorizedKey,omitempty"`
+}
+
+// Enabled reports if ssh is on
+func (s SSH) Enabled() bool {
+	return s.Mode != ""
+}
+
+// Merge overlays the non-empty values of other on top of s
+func (s *SSH) Merge(other SSH) {
+	if other.Mode != "" {
+		s.Mode = other.Mode
+	}
+	if other.User != "" {
+		s.User = other.User
+	}
+	if other.HostPort != 0 {
+		s.HostPort = other.HostPort
+	}
+}
+
+func (s SSH) Validate() error {
+	switch s.Mode {
+	case "", SSHKeys, SSHRootFS, SSHBuiltin:
+	default:
+		return fmt.Errorf("invalid ssh mode %q, must be %s, %s or %s", s.Mode, SSHKeys, SSHRootFS, SSHBuiltin)
+	}
+	return nil
+}
@@ -21,8 +21,37 @@ type VMConfig struct {
 	// NetworkStackBackend is the network stack backend to use. which provided
 	// by gvproxy
 	NetworkStackBackend string
-	LogLevel            string
-	Mounts              []filesystem.Mount
+	// ControlSocket is the host unix socket proxied to the control vsock port
+	// of the bootstrap
+	ControlSocket string
+	// AgentSocket is the host unix socket proxied to the guest agent
+	AgentSocket string `json:",omitempty"`
+	// ShareDir is the host dir shared into the guest as define.ShareTag
+	ShareDir string
+	LogLevel string
+	Mounts   []filesystem.Mount
+	// Ports are published from the guest to the host by gvproxy
+	Ports []PortMapping
+	// Network is the virtual network gvproxy serves the guest
+	Network Network
+	// Resolver is written to /etc/resolv.conf of the guest by the bootstrap,
+	// it is derived from the host and Network.DNS when the vm boots
+	Resolver Resolver `json:",omitempty"`
+	// Sockets are proxied by libkrun between the host and the vsock ports the
+	// bootstrap serves
+	Sockets []SocketMapping `json:",omitempty"`
+	// SSH is set up by the bootstrap, SSH.AuthorizedKey and SSH.HostPort are
+	// filled when the vm boots
+	SSH SSH `json:",omitempty"`
+	// BaseMounts adds optional pseudo filesystems or skips default ones
+	BaseMounts BaseMounts `json:",omitempty"`
+	// BootStages override the policy of the boot stages of the bootstrap
+	BootStages []BootStage `json:",omitempty"`
+	// Init makes the bootstrap exec the cmdline as the init of the guest
+	Init bool `json:",omitempty"`
+	// PasstFD is the vmm end of the socket connected to passt, inherited from
+	// revm. It is only set in the runtime config of the NetPasst mode.
+	PasstFD int `json:",omitempty"`
 }
 
 // Cmdline exec cmdline within rootfs
@@ -31,6 +60,24 @@ type Cmdline struct {
 	TargetBin     string
 	TargetBinArgs []string
 	Env           []string
+	// User and Group run the cmdline, names or numeric ids resolved against
+	// the rootfs, empty means root
+	User  string
+	Group string
+}
+
+// LoadVMConfig reads the VMConfig written by WriteToJsonFile
+func LoadVMConfig(file string) (*VMConfig, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vmconfig: %v", err)
+	}
+
+	vmc := &VMConfig{}
+	if err = json.Unmarshal(b, vmc); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal vmconfig: %v", err)
+	}
+	return vmc, nil
 }
 
 func (vmc *VMConfig) WriteToJsonFile(file string) error {